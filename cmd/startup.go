@@ -1,18 +1,33 @@
 package cmd
 
 import (
+	"context"
 	"net"
 	"net/http"
+	"sync"
 
 	"github.com/guuzaa/email-newsletter/internal"
 	"github.com/guuzaa/email-newsletter/internal/api/routes"
 	"github.com/guuzaa/email-newsletter/internal/database"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/guuzaa/email-newsletter/internal/outbox"
+	"github.com/guuzaa/email-newsletter/internal/suppression"
 	"gorm.io/gorm"
 )
 
 var logger = internal.Logger()
 
-func Build(config *internal.Settings) (*http.Server, error) {
+// Server is the running application: its HTTP server, and the components
+// whose settings can be reloaded.
+type Server struct {
+	*http.Server
+	mu          sync.Mutex
+	settings    internal.Settings
+	emailClient *internal.EmailClient
+	engine      *newsletter.Engine
+}
+
+func Build(config *internal.Settings) (*Server, error) {
 	senderEmail, err := config.EmailClient.Sender()
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to parse sender email")
@@ -20,19 +35,42 @@ func Build(config *internal.Settings) (*http.Server, error) {
 	}
 	timeout := config.EmailClient.Timeout()
 	emailClient := internal.NewEmailClient(config.EmailClient.BaseURL, senderEmail, config.EmailClient.AuthorizationToken, timeout)
+	emailClient.UseStreams(config.EmailClient.TransactionalStream, config.EmailClient.BroadcastStream)
 
 	db, err := database.SetupDB(config)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to connect database")
 		return nil, err
 	}
-	return Run(config.Address(), db, &emailClient, config.Application.BaseURL)
+	return Run(config, db, &emailClient)
 }
 
-func Run(address string, db *gorm.DB, emailClient *internal.EmailClient, baseURL string) (*http.Server, error) {
-	r := routes.SetupRouter(db, emailClient, baseURL)
-	listener, err := net.Listen("tcp", address)
+func Run(config *internal.Settings, db *gorm.DB, emailClient *internal.EmailClient) (*Server, error) {
+	if level := config.Application.LogLevel; level != "" {
+		if err := internal.SetLogLevel(level); err != nil {
+			return nil, err
+		}
+	}
+	emailClient.UseRecipientGuard(suppression.Guard(db))
+	// every email goes out through one engine, and so the provider's rate limit
+	engine := newsletter.NewEngine(emailClient, config.Delivery)
+	engine.UseRetryDeadline(config.EmailClient.RetryDeadline())
+	replicas, err := database.SetupReplicas(config, db)
 	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to connect read replicas")
+		return nil, err
+	}
+	dispatcher := outbox.NewDispatcher(db, engine, config.Outbox)
+	tracker := newsletter.NewTracker(config.Application.BaseURL, config.Tracking.Secret)
+	renderer := newsletter.NewRenderer(config.Application.BaseURL)
+	renderer.UseTracker(tracker)
+	// the scheduler, the outbox dispatcher, the replica health checks and
+	// sends that outlive their request are stopped when the server shuts down
+	ctx, cancel := context.WithCancel(context.Background())
+	r := routes.SetupRouter(ctx, db, replicas, engine, dispatcher, renderer, tracker, config)
+	listener, err := net.Listen("tcp", config.Address())
+	if err != nil {
+		cancel()
 		logger.Fatal().Err(err).Msg("failed to create listener")
 		return nil, err
 	}
@@ -47,5 +85,47 @@ func Run(address string, db *gorm.DB, emailClient *internal.EmailClient, baseURL
 			logger.Fatal().Err(err).Msg("listen and serve")
 		}
 	}()
-	return srv, nil
+
+	// ─── Start the newsletter scheduler, the outbox dispatcher and the ─────────
+	// ─── replica health checks ─────────────────────────────────────────────────
+	go replicas.Run(ctx, config.Database.ReplicaCheckInterval())
+	scheduler := newsletter.NewScheduler(db, renderer, engine, config.Scheduler)
+	go scheduler.Run(ctx)
+	go dispatcher.Run(ctx)
+	srv.RegisterOnShutdown(cancel)
+	return &Server{Server: srv, settings: *config, emailClient: emailClient, engine: engine}, nil
+}
+
+// Reload applies the settings loaded again that can change while the server
+// runs: the log level, the delivery rate limit, and the email client's
+// timeout and sender. Changes to other settings are logged and left out
+// until a restart, see internal.Settings.Reload.
+func (s *Server) Reload(next internal.Settings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reloaded, applied, restart := s.settings.Reload(next)
+	for _, path := range restart {
+		logger.Warn().Str("setting", path).Msg("setting changed but needs a restart, keeping the running value")
+	}
+	if len(applied) == 0 {
+		return nil
+	}
+
+	sender, err := reloaded.EmailClient.Sender()
+	if err != nil {
+		return err
+	}
+	// an emptied log level keeps the running one, the default is only
+	// chosen at start
+	if level := reloaded.Application.LogLevel; level != "" {
+		if err := internal.SetLogLevel(level); err != nil {
+			return err
+		}
+	}
+	s.emailClient.SetSender(sender)
+	s.emailClient.SetTimeout(reloaded.EmailClient.Timeout())
+	s.engine.SetRate(reloaded.Delivery.RatePerSecond, reloaded.Delivery.Burst)
+	s.settings = reloaded
+	logger.Warn().Strs("settings", applied).Msg("settings reloaded")
+	return nil
 }
@@ -0,0 +1,268 @@
+package routes
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guuzaa/email-newsletter/internal/api/middleware"
+	"github.com/guuzaa/email-newsletter/internal/database"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/guuzaa/email-newsletter/web"
+	"gorm.io/gorm"
+)
+
+const (
+	feedTitle   = "Email Newsletter"
+	feedEntries = 20
+)
+
+var (
+	archiveIndexTemplate = template.Must(template.New("archive").Parse(web.ArchiveIndexHTML))
+	archiveIssueTemplate = template.Must(template.New("issue").Parse(web.ArchiveIssueHTML))
+)
+
+// ArchiveHandler serves the sent issues from the replicas, the archive only
+// reads.
+type ArchiveHandler struct {
+	replicas *database.Replicas
+	renderer *newsletter.Renderer
+	baseURL  string
+}
+
+func NewArchiveHandler(replicas *database.Replicas, renderer *newsletter.Renderer, baseURL string) *ArchiveHandler {
+	return &ArchiveHandler{replicas: replicas, renderer: renderer, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+type archivedIssue struct {
+	Slug        string
+	Title       string
+	PublishedAt time.Time
+	Content     template.HTML
+	URL         string
+}
+
+func (h *ArchiveHandler) index(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.replicas.Reader(c.Request.Context())
+
+	issues, err := h.sentIssues(c, db, -1)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load archive")
+		c.String(http.StatusInternalServerError, "Failed to load archive")
+		return
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := archiveIndexTemplate.Execute(c.Writer, gin.H{"Issues": issues}); err != nil {
+		log.Warn().Err(err).Msg("failed to render archive")
+	}
+}
+
+func (h *ArchiveHandler) issue(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.replicas.Reader(c.Request.Context())
+
+	// every email links to the page of its issue, so it is served while the
+	// issue is being sent, before its deliveries are recorded, and once one
+	// went out even if it failed for others
+	var issue models.NewsletterIssue
+	delivered := db.Model(&models.IssueDelivery{}).Select("1").
+		Where("issue_deliveries.newsletter_issue_id = newsletter_issues.newsletter_issue_id AND issue_deliveries.status <> ?", models.DeliveryStatusFailed)
+	if err := db.Where("slug = ?", c.Param("slug")).
+		Where(db.Where("status IN ?", []string{models.IssueStatusSent, models.IssueStatusSending}).Or("EXISTS (?)", delivered)).
+		First(&issue).Error; err != nil {
+		log.Trace().Err(err).Str("slug", c.Param("slug")).Msg("issue not found")
+		c.String(http.StatusNotFound, "Issue not found")
+		return
+	}
+	archived, err := h.archive(issue)
+	if err != nil {
+		log.Warn().Err(err).Str("issue ID", issue.ID).Msg("failed to render issue")
+		c.String(http.StatusInternalServerError, "Failed to render issue")
+		return
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := archiveIssueTemplate.Execute(c.Writer, archived); err != nil {
+		log.Warn().Err(err).Msg("failed to render issue page")
+	}
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published"`
+	Link      atomLink    `xml:"link"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+func (h *ArchiveHandler) atom(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.replicas.Reader(c.Request.Context())
+
+	issues, err := h.sentIssues(c, db, feedEntries)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load feed")
+		c.String(http.StatusInternalServerError, "Failed to load feed")
+		return
+	}
+
+	feed := atomFeed{
+		Title: feedTitle,
+		ID:    h.baseURL + "/feed.atom",
+		Links: []atomLink{
+			{Href: h.baseURL + "/feed.atom", Rel: "self", Type: "application/atom+xml"},
+			{Href: h.baseURL + "/archive", Rel: "alternate", Type: "text/html"},
+		},
+		Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+	}
+	if len(issues) > 0 {
+		feed.Updated = issues[0].PublishedAt.UTC().Format(time.RFC3339)
+	}
+	for _, issue := range issues {
+		published := issue.PublishedAt.UTC().Format(time.RFC3339)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:     issue.Title,
+			ID:        issue.URL,
+			Updated:   published,
+			Published: published,
+			Link:      atomLink{Href: issue.URL, Rel: "alternate", Type: "text/html"},
+			Content:   atomContent{Type: "html", Body: string(issue.Content)},
+		})
+	}
+	h.writeFeed(c, "application/atom+xml; charset=utf-8", feed)
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func (h *ArchiveHandler) rss(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.replicas.Reader(c.Request.Context())
+
+	issues, err := h.sentIssues(c, db, feedEntries)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load feed")
+		c.String(http.StatusInternalServerError, "Failed to load feed")
+		return
+	}
+
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       feedTitle,
+			Link:        h.baseURL + "/archive",
+			Description: fmt.Sprintf("Past issues of the %s", feedTitle),
+		},
+	}
+	if len(issues) > 0 {
+		feed.Channel.LastBuildDate = issues[0].PublishedAt.UTC().Format(time.RFC1123Z)
+	}
+	for _, issue := range issues {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       issue.Title,
+			Link:        issue.URL,
+			GUID:        rssGUID{IsPermaLink: true, Value: issue.URL},
+			PubDate:     issue.PublishedAt.UTC().Format(time.RFC1123Z),
+			Description: string(issue.Content),
+		})
+	}
+	h.writeFeed(c, "application/rss+xml; charset=utf-8", feed)
+}
+
+func (h *ArchiveHandler) writeFeed(c *gin.Context, contentType string, feed any) {
+	log := middleware.GetContextLogger(c)
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to encode feed")
+		c.String(http.StatusInternalServerError, "Failed to encode feed")
+		return
+	}
+	c.Data(http.StatusOK, contentType, append([]byte(xml.Header), body...))
+}
+
+// sentIssues returns sent issues, newest first. A negative limit returns all
+// of them.
+func (h *ArchiveHandler) sentIssues(c *gin.Context, db *gorm.DB, limit int) ([]archivedIssue, error) {
+	log := middleware.GetContextLogger(c)
+	var issues []models.NewsletterIssue
+	if err := db.Where("status = ?", models.IssueStatusSent).Order("published_at DESC").Limit(limit).Find(&issues).Error; err != nil {
+		return nil, err
+	}
+	archived := make([]archivedIssue, 0, len(issues))
+	for _, issue := range issues {
+		a, err := h.archive(issue)
+		if err != nil {
+			log.Warn().Err(err).Str("issue ID", issue.ID).Msg("skipping issue that fails to render")
+			continue
+		}
+		archived = append(archived, a)
+	}
+	return archived, nil
+}
+
+func (h *ArchiveHandler) archive(issue models.NewsletterIssue) (archivedIssue, error) {
+	rendered, err := h.renderer.RenderArchive(issue)
+	if err != nil {
+		return archivedIssue{}, err
+	}
+	archived := archivedIssue{
+		Slug:    issue.Slug,
+		Title:   rendered.Subject,
+		Content: template.HTML(rendered.Html),
+		URL:     h.renderer.ArchiveURL(issue),
+	}
+	if issue.PublishedAt != nil {
+		archived.PublishedAt = *issue.PublishedAt
+	}
+	return archived, nil
+}
@@ -0,0 +1,108 @@
+package routes
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guuzaa/email-newsletter/internal/api/middleware"
+	"github.com/guuzaa/email-newsletter/internal/assets"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"gorm.io/gorm"
+)
+
+// multipartOverhead is the room a multipart body needs beside the file.
+const multipartOverhead = 64 << 10
+
+type AssetsHandler struct {
+	db      *gorm.DB
+	library *assets.Library
+}
+
+func NewAssetsHandler(db *gorm.DB, library *assets.Library) *AssetsHandler {
+	return &AssetsHandler{db: db, library: library}
+}
+
+// upload stores the image in the file field of a multipart form and returns
+// the URLs of it and its resized variants.
+func (h *AssetsHandler) upload(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+
+	if maxSize := h.library.MaxSize(); maxSize > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+multipartOverhead)
+	}
+	header, err := c.FormFile("file")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		log.Trace().Err(err).Msg("upload too large")
+		c.String(http.StatusRequestEntityTooLarge, "Image is too large")
+		return
+	} else if err != nil {
+		log.Trace().Err(err).Msg("missing file")
+		c.String(http.StatusBadRequest, "Missing file")
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to open upload")
+		c.String(http.StatusInternalServerError, "Failed to upload image")
+		return
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to read upload")
+		c.String(http.StatusInternalServerError, "Failed to upload image")
+		return
+	}
+
+	asset, err := h.library.Upload(c.Request.Context(), content)
+	switch {
+	case errors.Is(err, assets.ErrTooLarge):
+		log.Trace().Err(err).Msg("image too large")
+		c.String(http.StatusRequestEntityTooLarge, "Image is too large")
+	case errors.Is(err, assets.ErrUnsupportedImage):
+		log.Trace().Err(err).Msg("unsupported image")
+		c.String(http.StatusUnsupportedMediaType, "Unsupported image")
+	case err != nil:
+		log.Warn().Err(err).Msg("failed to store image")
+		c.String(http.StatusInternalServerError, "Failed to upload image")
+	default:
+		log.Debug().Str("key", asset.Key).Int("variants", len(asset.Variants)).Msg("image uploaded")
+		c.JSON(http.StatusCreated, asset)
+	}
+}
+
+// serve returns an asset. Keys are derived from the content of assets, so
+// they are cached for good.
+func (h *AssetsHandler) serve(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	key := strings.TrimPrefix(c.Param("key"), "/")
+
+	etag := `"` + key + `"`
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	content, contentType, err := h.library.Asset(c.Request.Context(), key)
+	if errors.Is(err, newsletter.ErrUnknownAsset) {
+		log.Trace().Err(err).Msg("asset not found")
+		c.String(http.StatusNotFound, "Asset not found")
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("failed to load asset")
+		c.String(http.StatusInternalServerError, "Failed to load asset")
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Header("ETag", etag)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, contentType, content)
+}
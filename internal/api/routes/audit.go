@@ -0,0 +1,31 @@
+package routes
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"gorm.io/gorm"
+)
+
+const auditSourcePreferences = "preferences"
+
+// audit appends a change of the subscription to the audit trail.
+func audit(tx *gorm.DB, subscriptionID, action, oldValue, newValue, source string) error {
+	return auditForIssue(tx, subscriptionID, "", action, oldValue, newValue, source)
+}
+
+// auditForIssue is audit for a change made through the preferences link of an
+// issue, an empty issueID attributes it to none.
+func auditForIssue(tx *gorm.DB, subscriptionID, issueID, action, oldValue, newValue, source string) error {
+	return tx.Create(&models.SubscriptionAuditEntry{
+		ID:                uuid.NewString(),
+		SubscriptionID:    subscriptionID,
+		Action:            action,
+		OldValue:          oldValue,
+		NewValue:          newValue,
+		Source:            source,
+		CreatedAt:         time.Now().UTC(),
+		NewsletterIssueID: issueID,
+	}).Error
+}
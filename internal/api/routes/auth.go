@@ -0,0 +1,45 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guuzaa/email-newsletter/internal/api/middleware"
+	"github.com/guuzaa/email-newsletter/internal/authentication"
+	"github.com/guuzaa/email-newsletter/internal/repository"
+	"gorm.io/gorm"
+)
+
+func basicAuthentication(c *gin.Context) (authentication.Credentials, error) {
+	username, password, ok := c.Request.BasicAuth()
+	if !ok {
+		return authentication.Credentials{}, errors.New("missing authorization header")
+	}
+	return authentication.Credentials{
+		Username: username,
+		Password: password,
+	}, nil
+}
+
+// authenticate checks the basic auth credentials of the request and responds
+// with 401 if they are missing or invalid.
+func authenticate(c *gin.Context, db *gorm.DB) bool {
+	log := middleware.GetContextLogger(c)
+
+	credentials, err := basicAuthentication(c)
+	if err != nil {
+		log.Trace().Err(err).Msg("failed to decode basic auth")
+		c.Header("WWW-Authenticate", `Basic realm="publish"`)
+		c.String(http.StatusUnauthorized, "Missing credentials")
+		return false
+	}
+
+	if !credentials.Validate(c, repository.NewPostgres(db).Users()) {
+		log.Trace().Str("username", credentials.Username).Msg("invalid credentials")
+		c.Header("WWW-Authenticate", `Basic realm="publish"`)
+		c.String(http.StatusUnauthorized, "Invalid credentials")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/guuzaa/email-newsletter/internal/api/middleware"
+	"github.com/guuzaa/email-newsletter/internal/database"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/guuzaa/email-newsletter/web"
+	"gorm.io/gorm"
+)
+
+type IssueStatsHandler struct {
+	db       *gorm.DB
+	replicas *database.Replicas
+}
+
+func NewIssueStatsHandler(db *gorm.DB, replicas *database.Replicas) *IssueStatsHandler {
+	return &IssueStatsHandler{db: db, replicas: replicas}
+}
+
+// stats reports how an issue performed, GET /api/issues/:id/stats.
+func (h *IssueStatsHandler) stats(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		c.String(http.StatusNotFound, "Newsletter not found")
+		return
+	}
+	var issue models.NewsletterIssue
+	err := db.Where("newsletter_issue_id = ?", id).First(&issue).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.String(http.StatusNotFound, "Newsletter not found")
+		return
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("issue ID", id).Msg("failed to look up issue")
+		c.String(http.StatusInternalServerError, "Failed to load stats")
+		return
+	}
+
+	stats, err := newsletter.Stats(h.replicas.Reader(c.Request.Context()), issue)
+	if err != nil {
+		log.Warn().Err(err).Str("issue ID", id).Msg("failed to compute stats")
+		c.String(http.StatusInternalServerError, "Failed to load stats")
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// adminPage shows the stats of an issue, GET /admin/issues/:id/stats.
+func (h *IssueStatsHandler) adminPage(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+	log.Trace().Str("issue ID", c.Param("id")).Msg("issue stats admin page")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", web.AdminIssueStatsHTML)
+}
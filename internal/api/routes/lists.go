@@ -0,0 +1,132 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/guuzaa/email-newsletter/internal/api/middleware"
+	"github.com/guuzaa/email-newsletter/internal/database"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"gorm.io/gorm"
+)
+
+var listSlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+const maxListSlugLength = 60
+
+var errUnknownList = errors.New("unknown list")
+
+type ListsHandler struct {
+	db       *gorm.DB
+	replicas *database.Replicas
+}
+
+func NewListsHandler(db *gorm.DB, replicas *database.Replicas) *ListsHandler {
+	return &ListsHandler{db: db, replicas: replicas}
+}
+
+type ListData struct {
+	Slug        string `json:"slug" binding:"required"`
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+}
+
+func (h *ListsHandler) createList(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+
+	var body ListData
+	if err := c.ShouldBindJSON(&body); err != nil {
+		log.Trace().Err(err).Msg("failed to bind request body")
+		c.String(http.StatusBadRequest, "")
+		return
+	}
+	if len(body.Slug) > maxListSlugLength || !listSlugPattern.MatchString(body.Slug) {
+		log.Trace().Str("slug", body.Slug).Msg("invalid list slug")
+		c.String(http.StatusBadRequest, "Invalid list slug")
+		return
+	}
+
+	var existing int64
+	if err := db.Model(&models.List{}).Where("slug = ?", body.Slug).Count(&existing).Error; err != nil {
+		log.Warn().Err(err).Msg("failed to look up list")
+		c.String(http.StatusInternalServerError, "Failed to store list")
+		return
+	}
+	if existing > 0 {
+		c.String(http.StatusConflict, fmt.Sprintf("List %s exists already", body.Slug))
+		return
+	}
+
+	list := models.List{
+		ID:          uuid.NewString(),
+		Slug:        body.Slug,
+		Name:        body.Name,
+		Description: body.Description,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := db.Create(&list).Error; err != nil {
+		log.Warn().Err(err).Msg("failed to store list")
+		c.String(http.StatusInternalServerError, "Failed to store list")
+		return
+	}
+	log.Debug().Str("list ID", list.ID).Str("slug", list.Slug).Msg("list created")
+	c.JSON(http.StatusCreated, listResponse(list))
+}
+
+func (h *ListsHandler) lists(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.replicas.Reader(c.Request.Context())
+
+	var lists []models.List
+	if err := db.Order("created_at").Find(&lists).Error; err != nil {
+		log.Warn().Err(err).Msg("failed to load lists")
+		c.String(http.StatusInternalServerError, "Failed to load lists")
+		return
+	}
+	response := make([]gin.H, 0, len(lists))
+	for _, list := range lists {
+		response = append(response, listResponse(list))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func listResponse(list models.List) gin.H {
+	return gin.H{
+		"id":          list.ID,
+		"slug":        list.Slug,
+		"name":        list.Name,
+		"description": list.Description,
+	}
+}
+
+// findLists looks up the lists with the given slugs, an empty slice selects
+// the default list. It returns errUnknownList if any slug doesn't exist.
+func findLists(db *gorm.DB, slugs []string) ([]models.List, error) {
+	if len(slugs) == 0 {
+		slugs = []string{models.DefaultListSlug}
+	}
+	var lists []models.List
+	if err := db.Where("slug IN ?", slugs).Order("created_at").Find(&lists).Error; err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool, len(lists))
+	for _, list := range lists {
+		found[list.Slug] = true
+	}
+	for _, slug := range slugs {
+		if !found[slug] {
+			return nil, fmt.Errorf("%w: %s", errUnknownList, slug)
+		}
+	}
+	return lists, nil
+}
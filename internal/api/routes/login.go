@@ -7,8 +7,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/guuzaa/email-newsletter/internal/api/middleware"
 	"github.com/guuzaa/email-newsletter/internal/authentication"
+	"github.com/guuzaa/email-newsletter/internal/repository"
 	"github.com/guuzaa/email-newsletter/web"
-	"gorm.io/gorm"
 )
 
 const (
@@ -16,11 +16,11 @@ const (
 )
 
 type LoginHandler struct {
-	db *gorm.DB
+	users repository.UserRepository
 }
 
-func NewLoginHandler(db *gorm.DB) *LoginHandler {
-	return &LoginHandler{db: db}
+func NewLoginHandler(users repository.UserRepository) *LoginHandler {
+	return &LoginHandler{users: users}
 }
 
 type FormData struct {
@@ -46,7 +46,6 @@ func (h *LoginHandler) get(c *gin.Context) {
 
 func (h *LoginHandler) post(c *gin.Context) {
 	log := middleware.GetContextLogger(c)
-	h.db = h.db.WithContext(c.Request.Context())
 
 	var data FormData
 	err := c.ShouldBind(&data)
@@ -60,7 +59,7 @@ func (h *LoginHandler) post(c *gin.Context) {
 		Username: data.Username,
 		Password: data.Password,
 	}
-	if !crdentials.Validate(c, h.db) {
+	if !crdentials.Validate(c, h.users) {
 		log.Trace().Msg("failed to validate credentials")
 		c.SetCookie(flashCookieName, "invalid credentials", 0, "/login", "", false, true)
 		c.Redirect(http.StatusSeeOther, "/login")
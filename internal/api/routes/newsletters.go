@@ -1,34 +1,59 @@
 package routes
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/guuzaa/email-newsletter/internal"
 	"github.com/guuzaa/email-newsletter/internal/api/middleware"
-	"github.com/guuzaa/email-newsletter/internal/authentication"
 	"github.com/guuzaa/email-newsletter/internal/database/models"
-	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
 type NewslettersHandler struct {
-	db          *gorm.DB
-	emailClient *internal.EmailClient
+	// lifetime is cancelled when the server shuts down, issues sent right
+	// away go out until then even if their request is gone
+	lifetime context.Context
+	db       *gorm.DB
+	renderer *newsletter.Renderer
+	engine   *newsletter.Engine
+	assets   newsletter.AssetSource
 }
 
-func NewNewslettersHandler(db *gorm.DB, emailClient *internal.EmailClient) *NewslettersHandler {
+func NewNewslettersHandler(lifetime context.Context, db *gorm.DB, renderer *newsletter.Renderer, engine *newsletter.Engine) *NewslettersHandler {
 	return &NewslettersHandler{
-		db:          db,
-		emailClient: emailClient,
+		lifetime: lifetime,
+		db:       db,
+		renderer: renderer,
+		engine:   engine,
 	}
 }
 
 type BodyData struct {
-	Title   string  `json:"title" binding:"required"`
-	Content Content `json:"content" binding:"required"`
+	Title             string   `json:"title" binding:"required"`
+	Content           Content  `json:"content" binding:"required"`
+	Lists             []string `json:"lists"`
+	SendAt            string   `json:"send_at"`
+	TimeZone          string   `json:"time_zone"`
+	RecipientTimeZone bool     `json:"recipient_time_zone"`
+	// Tracking turns on open and click tracking for the issue
+	Tracking bool `json:"tracking"`
+	// Templated renders the title and content as templates, e.g. "Hi
+	// {{.Name}}"; without it they are sent as written, braces and all
+	Templated   bool             `json:"templated"`
+	Attachments []AttachmentData `json:"attachments" binding:"dive"`
+}
+
+type ScheduleData struct {
+	SendAt            string `json:"send_at" binding:"required"`
+	TimeZone          string `json:"time_zone"`
+	RecipientTimeZone bool   `json:"recipient_time_zone"`
 }
 
 type Content struct {
@@ -36,71 +61,315 @@ type Content struct {
 	Text string `json:"text" binding:"required"`
 }
 
-type ConfirmedSubscriber struct {
-	Email domain.SubscriberEmail `gorm:"email"`
-}
+func (h *NewslettersHandler) publishNewsletter(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
 
-func (h *NewslettersHandler) basicAuthentication(c *gin.Context) (authentication.Credentials, error) {
-	username, password, ok := c.Request.BasicAuth()
+	var body BodyData
+	if err := c.ShouldBindJSON(&body); err != nil {
+		log.Trace().Err(err).Msg("failed to bind request body")
+		c.String(http.StatusBadRequest, "")
+		return
+	}
+	issue := newIssue(body)
+	if err := newsletter.Validate(issue); err != nil {
+		log.Trace().Err(err).Msg("failed to parse issue templates")
+		c.String(http.StatusBadRequest, "Invalid newsletter template")
+		return
+	}
+	attachments, ok := h.issueAttachments(c, issue.ID, body.Attachments)
 	if !ok {
-		return authentication.Credentials{}, errors.New("missing authorization header")
+		return
 	}
-	return authentication.Credentials{
-		Username: username,
-		Password: password,
-	}, nil
+	lists, err := findLists(db, body.Lists)
+	if errors.Is(err, errUnknownList) {
+		log.Trace().Err(err).Msg("publish to unknown list")
+		c.String(http.StatusBadRequest, "Unknown list")
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Msg("failed to look up lists")
+		c.String(http.StatusInternalServerError, "Failed to publish newsletter")
+		return
+	}
+	if body.SendAt != "" {
+		h.scheduleNewsletter(c, body, issue, lists, attachments)
+		return
+	}
+
+	confirmedSubscribers, err := newsletter.ConfirmedSubscribers(db, listIDs(lists), time.Now())
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to get confirmed subscribers")
+		c.String(http.StatusInternalServerError, "Failed to publish newsletter")
+		return
+	}
+	log.Debug().Int("len confirmed subscribers", len(confirmedSubscribers)).Send()
+	// the issue is stored before it goes out, so the archive link and the
+	// deliveries of the emails refer to an issue that exists
+	issue.Status = models.IssueStatusSending
+	if err := createIssue(db, issue, lists, attachments); err != nil {
+		log.Warn().Err(err).Str("issue ID", issue.ID).Msg("failed to store issue")
+		c.String(http.StatusInternalServerError, "Failed to publish newsletter")
+		return
+	}
+	sent := newsletter.Attachments(attachments)
+	pending := make([]newsletter.Delivery, len(confirmedSubscribers))
+	for i, subscriber := range confirmedSubscribers {
+		pending[i] = newsletter.IssueDelivery(h.renderer, issue, sent, subscriber.Email, subscriber.Recipient())
+	}
+	// a client that gives up waiting doesn't stop the issue halfway
+	ctx, stop := context.WithCancel(context.WithoutCancel(c.Request.Context()))
+	defer stop()
+	stopOnShutdown := context.AfterFunc(h.lifetime, stop)
+	defer stopOnShutdown()
+	results := h.engine.Deliver(ctx, pending)
+
+	var deliveries []delivery
+	failure := ""
+	for i, result := range results {
+		err := result.Err
+		subscriber := confirmedSubscribers[i]
+		var renderErr *newsletter.RenderError
+		switch {
+		case errors.Is(err, internal.ErrRecipientSuppressed):
+			log.Debug().Str("email", subscriber.Email.String()).Msg("skipping suppressed subscriber")
+			continue
+		case errors.As(err, &renderErr):
+			log.Warn().Err(err).Str("email", subscriber.Email.String()).Msg("failed to render issue")
+			failure = "Failed to render newsletter"
+			continue
+		case err != nil:
+			log.Warn().Err(err).Str("email", subscriber.Email.String()).Msg("failed to send email")
+			if failure == "" {
+				failure = "Failed to send email"
+			}
+		default:
+			log.Trace().Msgf("sent email to %s", subscriber.Email)
+		}
+		deliveries = append(deliveries, delivery{recipient: subscriber.Recipient(), messageID: result.MessageID, err: err})
+	}
+	h.recordDeliveries(c, h.db.WithContext(ctx), issue, deliveries)
+	h.finishIssue(c, h.db.WithContext(ctx), issue, failure == "")
+	if failure != "" {
+		c.String(http.StatusInternalServerError, failure)
+		return
+	}
+	c.String(http.StatusOK, "")
 }
 
-func (h *NewslettersHandler) publishNewsletter(c *gin.Context) {
+// delivery is the outcome of sending an issue to one recipient.
+type delivery struct {
+	recipient newsletter.Recipient
+	messageID string
+	err       error
+}
+
+func (h *NewslettersHandler) recordDeliveries(c *gin.Context, db *gorm.DB, issue models.NewsletterIssue, deliveries []delivery) {
+	log := middleware.GetContextLogger(c)
+	for _, d := range deliveries {
+		if err := newsletter.RecordDelivery(db, issue.ID, d.recipient, d.messageID, d.err); err != nil {
+			log.Warn().Err(err).Str("issue ID", issue.ID).Str("email", d.recipient.Email).Msg("failed to record delivery")
+		}
+	}
+}
+
+func (h *NewslettersHandler) scheduleNewsletter(c *gin.Context, body BodyData, issue models.NewsletterIssue, lists []models.List, attachments []models.IssueAttachment) {
 	log := middleware.GetContextLogger(c)
-	h.db = h.db.WithContext(c.Request.Context())
 
-	credentials, err := h.basicAuthentication(c)
+	schedule, err := newsletter.ParseSchedule(body.SendAt, body.TimeZone, body.RecipientTimeZone)
 	if err != nil {
-		log.Trace().Err(err).Msg("failed to decode basic auth")
-		c.Header("WWW-Authenticate", `Basic realm="publish"`)
-		c.String(http.StatusUnauthorized, "Missing credentials")
+		log.Trace().Err(err).Msg("failed to parse schedule")
+		c.String(http.StatusBadRequest, "Invalid schedule")
+		return
+	}
+	if !schedule.StartsAt().After(time.Now()) {
+		log.Trace().Time("send at", schedule.SendAt).Msg("schedule in the past")
+		c.String(http.StatusBadRequest, "send_at must be in the future")
 		return
 	}
 
-	if !credentials.Validate(c, h.db) {
-		log.Trace().Str("username", credentials.Username).Msg("invalid credentials")
-		c.Header("WWW-Authenticate", `Basic realm="publish"`)
-		c.String(http.StatusUnauthorized, "Invalid credentials")
+	issue.Status = models.IssueStatusScheduled
+	schedule.Apply(&issue)
+	if err := createIssue(h.db.WithContext(c.Request.Context()), issue, lists, attachments); err != nil {
+		log.Warn().Err(err).Msg("failed to store scheduled issue")
+		c.String(http.StatusInternalServerError, "Failed to schedule newsletter")
 		return
 	}
+	log.Debug().Str("issue ID", issue.ID).Time("starts at", *issue.StartsAt).Msg("newsletter scheduled")
+	c.JSON(http.StatusAccepted, issueResponse(issue))
+}
 
-	var body BodyData
+func (h *NewslettersHandler) rescheduleNewsletter(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		c.String(http.StatusNotFound, "Newsletter not found")
+		return
+	}
+
+	var body ScheduleData
 	if err := c.ShouldBindJSON(&body); err != nil {
 		log.Trace().Err(err).Msg("failed to bind request body")
 		c.String(http.StatusBadRequest, "")
 		return
 	}
-	confirmedSubscribers := h.getConfirmedSubscribers()
-	log.Debug().Int("len confirmed subscribers", len(confirmedSubscribers)).Send()
-	for _, subscriber := range confirmedSubscribers {
-		if err := h.emailClient.SendEmail(subscriber.Email, body.Title, body.Content.Html, body.Content.Text); err != nil {
-			log.Warn().Err(err).Str("email", subscriber.Email.String()).Msg("failed to send email")
-			c.String(http.StatusInternalServerError, "Failed to send email")
-			return
-		}
-		log.Trace().Msgf("sending email to %s", subscriber.Email)
+	schedule, err := newsletter.ParseSchedule(body.SendAt, body.TimeZone, body.RecipientTimeZone)
+	if err != nil {
+		log.Trace().Err(err).Msg("failed to parse schedule")
+		c.String(http.StatusBadRequest, "Invalid schedule")
+		return
+	}
+	if !schedule.StartsAt().After(time.Now()) {
+		log.Trace().Time("send at", schedule.SendAt).Msg("schedule in the past")
+		c.String(http.StatusBadRequest, "send_at must be in the future")
+		return
+	}
+
+	var issue models.NewsletterIssue
+	schedule.Apply(&issue)
+	result := db.Model(&models.NewsletterIssue{}).
+		Where("newsletter_issue_id = ? AND status = ?", id, models.IssueStatusScheduled).
+		Updates(map[string]interface{}{
+			"send_at":             issue.SendAt,
+			"starts_at":           issue.StartsAt,
+			"time_zone":           issue.TimeZone,
+			"recipient_time_zone": issue.RecipientTimeZone,
+		})
+	if !h.checkScheduledUpdate(c, db, result) {
+		return
+	}
+	log.Debug().Str("issue ID", id).Time("starts at", *issue.StartsAt).Msg("newsletter rescheduled")
+
+	if err := db.Where("newsletter_issue_id = ?", id).First(&issue).Error; err != nil {
+		log.Warn().Err(err).Msg("failed to load rescheduled issue")
+		c.String(http.StatusInternalServerError, "Failed to reschedule newsletter")
+		return
+	}
+	c.JSON(http.StatusOK, issueResponse(issue))
+}
+
+func (h *NewslettersHandler) cancelNewsletter(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		c.String(http.StatusNotFound, "Newsletter not found")
+		return
 	}
+
+	result := db.Model(&models.NewsletterIssue{}).
+		Where("newsletter_issue_id = ? AND status = ?", id, models.IssueStatusScheduled).
+		Update("status", models.IssueStatusCancelled)
+	if !h.checkScheduledUpdate(c, db, result) {
+		return
+	}
+	log.Debug().Str("issue ID", id).Msg("newsletter cancelled")
 	c.String(http.StatusOK, "")
 }
 
-func (h *NewslettersHandler) getConfirmedSubscribers() []ConfirmedSubscriber {
-	var confirmedSubscribers []ConfirmedSubscriber
-	var subscriberEmails []string
-	if err := h.db.Model(&models.Subscription{}).Select("email").Where("status = ?", models.SubscriptionStatusConfirmed).Find(&subscriberEmails).Error; err != nil {
-		return confirmedSubscribers
+// checkScheduledUpdate reports whether an update guarded by the scheduled
+// status went through, and responds with an error otherwise.
+func (h *NewslettersHandler) checkScheduledUpdate(c *gin.Context, db *gorm.DB, result *gorm.DB) bool {
+	log := middleware.GetContextLogger(c)
+	if result.Error != nil {
+		log.Warn().Err(result.Error).Msg("failed to update scheduled issue")
+		c.String(http.StatusInternalServerError, "Failed to update newsletter")
+		return false
 	}
-	for _, subscriberEmail := range subscriberEmails {
-		email, err := domain.SubscriberEmailFrom(subscriberEmail)
-		if err != nil {
-			continue
+	if result.RowsAffected == 1 {
+		return true
+	}
+
+	var issue models.NewsletterIssue
+	if err := db.Where("newsletter_issue_id = ?", c.Param("id")).First(&issue).Error; err != nil {
+		log.Trace().Err(err).Msg("issue not found")
+		c.String(http.StatusNotFound, "Newsletter not found")
+		return false
+	}
+	log.Trace().Str("status", issue.Status).Msg("issue is no longer scheduled")
+	c.String(http.StatusConflict, "Newsletter is %s", issue.Status)
+	return false
+}
+
+// finishIssue moves an issue that was sent right away from sending to sent,
+// or to failed if some emails didn't go out.
+func (h *NewslettersHandler) finishIssue(c *gin.Context, db *gorm.DB, issue models.NewsletterIssue, ok bool) {
+	log := middleware.GetContextLogger(c)
+	updates := map[string]interface{}{"status": models.IssueStatusFailed}
+	if ok {
+		updates = map[string]interface{}{"status": models.IssueStatusSent, "published_at": time.Now().UTC()}
+	}
+	if err := db.Model(&issue).Updates(updates).Error; err != nil {
+		log.Warn().Err(err).Str("issue ID", issue.ID).Msg("failed to store issue status")
+	}
+}
+
+// createIssue stores the issue together with the lists it targets and its
+// attachments.
+func createIssue(db *gorm.DB, issue models.NewsletterIssue, lists []models.List, attachments []models.IssueAttachment) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&issue).Error; err != nil {
+			return err
+		}
+		issueLists := make([]models.NewsletterIssueList, 0, len(lists))
+		for _, list := range lists {
+			issueLists = append(issueLists, models.NewsletterIssueList{NewsletterIssueID: issue.ID, ListID: list.ID})
+		}
+		if err := tx.Create(&issueLists).Error; err != nil {
+			return err
 		}
-		confirmedSubscribers = append(confirmedSubscribers, ConfirmedSubscriber{Email: email})
+		if len(attachments) == 0 {
+			return nil
+		}
+		return tx.Create(&attachments).Error
+	})
+}
+
+func listIDs(lists []models.List) []string {
+	ids := make([]string, 0, len(lists))
+	for _, list := range lists {
+		ids = append(ids, list.ID)
+	}
+	return ids
+}
+
+func newIssue(body BodyData) models.NewsletterIssue {
+	id := uuid.NewString()
+	return models.NewsletterIssue{
+		ID:          id,
+		Title:       body.Title,
+		Slug:        newsletter.Slug(body.Title, id),
+		TextContent: body.Content.Text,
+		HtmlContent: body.Content.Html,
+		TimeZone:    "UTC",
+		CreatedAt:   time.Now().UTC(),
+		Tracking:    body.Tracking,
+		Templated:   body.Templated,
+	}
+}
+
+func issueResponse(issue models.NewsletterIssue) gin.H {
+	return gin.H{
+		"id":                  issue.ID,
+		"slug":                issue.Slug,
+		"status":              issue.Status,
+		"send_at":             issue.SendAt,
+		"starts_at":           issue.StartsAt,
+		"time_zone":           issue.TimeZone,
+		"recipient_time_zone": issue.RecipientTimeZone,
+		"tracking":            issue.Tracking,
+		"templated":           issue.Templated,
 	}
-	return confirmedSubscribers
 }
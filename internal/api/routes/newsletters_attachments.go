@@ -0,0 +1,100 @@
+package routes
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/api/middleware"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+)
+
+// AttachmentData is an attachment of an issue: its base64 encoded content, or
+// the key of a stored asset. An attachment with a content ID is an inline
+// image, the issue's HTML shows it with <img src="cid:content_id">.
+type AttachmentData struct {
+	Name        string `json:"name" binding:"required"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id"`
+	Content     string `json:"content"`
+	Asset       string `json:"asset"`
+}
+
+// UseAssets lets attachments refer to the assets of source.
+func (h *NewslettersHandler) UseAssets(source newsletter.AssetSource) {
+	h.assets = source
+}
+
+// issueAttachments resolves the attachments of an issue and checks them
+// against the limits of the email client. It responds with an error if they
+// are invalid.
+func (h *NewslettersHandler) issueAttachments(c *gin.Context, issueID string, data []AttachmentData) ([]models.IssueAttachment, bool) {
+	log := middleware.GetContextLogger(c)
+	if len(data) == 0 {
+		return nil, true
+	}
+
+	records := make([]models.IssueAttachment, len(data))
+	for i, attachment := range data {
+		content, contentType, err := h.attachmentContent(c, attachment)
+		if errors.Is(err, newsletter.ErrUnknownAsset) {
+			log.Trace().Err(err).Str("asset", attachment.Asset).Msg("attachment of unknown asset")
+			c.String(http.StatusBadRequest, "Unknown asset")
+			return nil, false
+		} else if err != nil && attachment.Asset != "" {
+			log.Warn().Err(err).Str("asset", attachment.Asset).Msg("failed to load asset")
+			c.String(http.StatusInternalServerError, "Failed to load asset")
+			return nil, false
+		} else if err != nil {
+			log.Trace().Err(err).Str("name", attachment.Name).Msg("failed to decode attachment")
+			c.String(http.StatusBadRequest, "Invalid attachment")
+			return nil, false
+		}
+		records[i] = models.IssueAttachment{
+			ID:                uuid.NewString(),
+			NewsletterIssueID: issueID,
+			Position:          i,
+			Name:              attachment.Name,
+			ContentType:       contentType,
+			ContentID:         attachment.ContentID,
+			Content:           content,
+		}
+	}
+
+	err := internal.ValidateAttachments(newsletter.Attachments(records))
+	if errors.Is(err, internal.ErrAttachmentsTooLarge) {
+		log.Trace().Err(err).Msg("attachments too large")
+		c.String(http.StatusRequestEntityTooLarge, "Attachments are too large")
+		return nil, false
+	} else if err != nil {
+		log.Trace().Err(err).Msg("invalid attachment")
+		c.String(http.StatusBadRequest, "Invalid attachment")
+		return nil, false
+	}
+	return records, true
+}
+
+// attachmentContent returns the content of an attachment and its content
+// type, which is the asset's unless the attachment names one.
+func (h *NewslettersHandler) attachmentContent(c *gin.Context, attachment AttachmentData) ([]byte, string, error) {
+	switch {
+	case attachment.Asset != "" && attachment.Content != "":
+		return nil, "", errors.New("attachment has both content and an asset")
+	case attachment.Asset != "":
+		if h.assets == nil {
+			return nil, "", newsletter.ErrUnknownAsset
+		}
+		content, contentType, err := h.assets.Asset(c.Request.Context(), attachment.Asset)
+		if attachment.ContentType != "" {
+			contentType = attachment.ContentType
+		}
+		return content, contentType, err
+	default:
+		content, err := base64.StdEncoding.DecodeString(attachment.Content)
+		return content, attachment.ContentType, err
+	}
+}
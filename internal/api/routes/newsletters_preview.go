@@ -0,0 +1,189 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/api/middleware"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/guuzaa/email-newsletter/web"
+	"gorm.io/gorm"
+)
+
+type PreviewData struct {
+	Title           string  `json:"title" binding:"required"`
+	Content         Content `json:"content" binding:"required"`
+	SubscriberEmail string  `json:"subscriber_email"`
+	Templated       bool    `json:"templated"`
+}
+
+type TestSendData struct {
+	PreviewData
+	TestEmails  []string         `json:"test_emails" binding:"required,min=1,max=20"`
+	Attachments []AttachmentData `json:"attachments" binding:"dive"`
+}
+
+// sendTestNewsletter renders an issue as the chosen subscriber receives it and
+// sends it to the test addresses only.
+func (h *NewslettersHandler) sendTestNewsletter(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+
+	var body TestSendData
+	if err := c.ShouldBindJSON(&body); err != nil {
+		log.Trace().Err(err).Msg("failed to bind request body")
+		c.String(http.StatusBadRequest, "")
+		return
+	}
+	testEmails := make([]domain.SubscriberEmail, 0, len(body.TestEmails))
+	for _, testEmail := range body.TestEmails {
+		email, err := domain.SubscriberEmailFrom(testEmail)
+		if err != nil {
+			log.Trace().Err(err).Str("email", testEmail).Msg("invalid test email")
+			c.String(http.StatusBadRequest, "Invalid test email")
+			return
+		}
+		testEmails = append(testEmails, email)
+	}
+
+	rendered, ok := h.renderPreview(c, db, previewIssue(body.PreviewData), body.SubscriberEmail)
+	if !ok {
+		return
+	}
+	attachments, ok := h.issueAttachments(c, "", body.Attachments)
+	if !ok {
+		return
+	}
+	for _, email := range testEmails {
+		// test emails go through the stream of the issue they stand for
+		_, err := h.engine.Send(c.Request.Context(), internal.Message{
+			To:       email,
+			Subject:  rendered.Subject,
+			HtmlBody: rendered.Html,
+			TextBody: rendered.Text,
+			MessageOptions: internal.MessageOptions{
+				Stream:      internal.StreamBroadcast,
+				Attachments: newsletter.Attachments(attachments),
+			},
+		})
+		if errors.Is(err, internal.ErrRecipientSuppressed) {
+			log.Info().Str("email", email.String()).Msg("not sending test email to suppressed address")
+			continue
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("email", email.String()).Msg("failed to send test email")
+			c.String(http.StatusInternalServerError, "Failed to send test email")
+			return
+		}
+		log.Trace().Msgf("sending test email to %s", email)
+	}
+	c.String(http.StatusOK, "")
+}
+
+// previewNewsletter returns the HTML body of an unsaved issue as the chosen
+// subscriber receives it.
+func (h *NewslettersHandler) previewNewsletter(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+
+	var body PreviewData
+	if err := c.ShouldBindJSON(&body); err != nil {
+		log.Trace().Err(err).Msg("failed to bind request body")
+		c.String(http.StatusBadRequest, "")
+		return
+	}
+	rendered, ok := h.renderPreview(c, db, previewIssue(body), body.SubscriberEmail)
+	if !ok {
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(rendered.Html))
+}
+
+// previewStoredNewsletter returns the HTML body of a stored issue, such as a
+// scheduled one, as the subscriber in the query receives it.
+func (h *NewslettersHandler) previewStoredNewsletter(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+
+	var issue models.NewsletterIssue
+	if err := db.Where("newsletter_issue_id = ?", c.Param("id")).First(&issue).Error; err != nil {
+		log.Trace().Err(err).Msg("issue not found")
+		c.String(http.StatusNotFound, "Newsletter not found")
+		return
+	}
+	rendered, ok := h.renderPreview(c, db, issue, c.Query("subscriber_email"))
+	if !ok {
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(rendered.Html))
+}
+
+func (h *NewslettersHandler) adminPage(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+	log.Trace().Msg("newsletter admin page")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", web.AdminNewslettersHTML)
+}
+
+// renderPreview renders the issue for the subscriber with the given email, or
+// for a sample subscriber if the email is empty.
+func (h *NewslettersHandler) renderPreview(c *gin.Context, db *gorm.DB, issue models.NewsletterIssue, subscriberEmail string) (newsletter.RenderedIssue, bool) {
+	log := middleware.GetContextLogger(c)
+
+	recipient := newsletter.SampleRecipient
+	if subscriberEmail != "" {
+		var err error
+		recipient, err = newsletter.RecipientFor(db, subscriberEmail)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Trace().Str("email", subscriberEmail).Msg("subscriber not found")
+			c.String(http.StatusNotFound, "Subscriber not found")
+			return newsletter.RenderedIssue{}, false
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to look up subscriber")
+			c.String(http.StatusInternalServerError, "Failed to look up subscriber")
+			return newsletter.RenderedIssue{}, false
+		}
+		// previews and test emails must not hand out the subscriber's
+		// preference center, nor be tracked as the subscriber's
+		recipient.PreferencesToken = ""
+		recipient.SubscriptionID = ""
+	}
+
+	rendered, err := h.renderer.Render(issue, recipient)
+	if err != nil {
+		log.Trace().Err(err).Msg("failed to render issue")
+		c.String(http.StatusBadRequest, "Invalid newsletter template")
+		return newsletter.RenderedIssue{}, false
+	}
+	return rendered, true
+}
+
+func previewIssue(body PreviewData) models.NewsletterIssue {
+	return models.NewsletterIssue{
+		Title:       body.Title,
+		TextContent: body.Content.Text,
+		HtmlContent: body.Content.Html,
+		Templated:   body.Templated,
+	}
+}
@@ -0,0 +1,448 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/guuzaa/email-newsletter/internal/api/middleware"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/guuzaa/email-newsletter/web"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxPauseWeeks                   = 52
+	preferencesActionSave           = "save"
+	preferencesActionUnsubscribeAll = "unsubscribe_all"
+	preferencesTrackingAllow        = "allow"
+	preferencesTrackingOptOut       = "opt_out"
+)
+
+var preferencesTemplate = template.Must(template.New("preferences").Parse(web.PreferencesHTML))
+
+type PreferencesHandler struct {
+	db *gorm.DB
+}
+
+func NewPreferencesHandler(db *gorm.DB) *PreferencesHandler {
+	return &PreferencesHandler{db: db}
+}
+
+type PreferencesForm struct {
+	Token      string   `form:"token" binding:"required"`
+	Action     string   `form:"action"`
+	Name       string   `form:"name"`
+	Lists      []string `form:"lists"`
+	Frequency  string   `form:"frequency"`
+	PauseWeeks string   `form:"pause_weeks"`
+	Tracking   string   `form:"tracking"`
+	// Issue is the issue whose preferences link was followed
+	Issue string `form:"issue"`
+}
+
+type preferencesPage struct {
+	Token          string
+	Issue          string
+	Email          string
+	Name           string
+	Frequency      string
+	PausedUntil    *time.Time
+	TrackingOptOut bool
+	Lists          []preferencesList
+	Saved          bool
+	Unsubscribed   bool
+}
+
+type preferencesList struct {
+	Slug        string
+	Name        string
+	Description string
+	Subscribed  bool
+	Pending     bool
+}
+
+// preferencesChange is a validated form submission, nil fields are left
+// unchanged.
+type preferencesChange struct {
+	name           *domain.SubscriberName
+	frequency      *domain.Frequency
+	pauseWeeks     *int
+	trackingOptOut *bool
+	lists          map[string]bool
+	// issueID is the issue the change is attributed to, if any
+	issueID string
+}
+
+func (h *PreferencesHandler) get(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	subscription, ok := h.subscription(c, db, c.Query("token"))
+	if !ok {
+		return
+	}
+	page, err := h.page(db, subscription)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load preferences")
+		c.String(http.StatusInternalServerError, "Failed to load preferences")
+		return
+	}
+	page.Saved = c.Query("saved") != ""
+	page.Issue = h.issueID(c, db, c.Query("issue"))
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := preferencesTemplate.Execute(c.Writer, page); err != nil {
+		log.Warn().Err(err).Msg("failed to render preferences page")
+	}
+}
+
+func (h *PreferencesHandler) post(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	var form PreferencesForm
+	if err := c.ShouldBind(&form); err != nil {
+		log.Trace().Err(err).Msg("failed to bind request body")
+		c.String(http.StatusBadRequest, "Missing preferences token")
+		return
+	}
+	subscription, ok := h.subscription(c, db, form.Token)
+	if !ok {
+		return
+	}
+
+	issueID := h.issueID(c, db, form.Issue)
+	var err error
+	switch form.Action {
+	case preferencesActionUnsubscribeAll:
+		err = db.Transaction(func(tx *gorm.DB) error {
+			return h.unsubscribeAll(tx, subscription, issueID)
+		})
+	case "", preferencesActionSave:
+		change, ok := h.parseChange(c, db, form)
+		if !ok {
+			return
+		}
+		change.issueID = issueID
+		err = db.Transaction(func(tx *gorm.DB) error {
+			return h.apply(tx, subscription, change, time.Now())
+		})
+	default:
+		c.String(http.StatusBadRequest, "Invalid action")
+		return
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("subscription ID", subscription.ID).Msg("failed to save preferences")
+		c.String(http.StatusInternalServerError, "Failed to save preferences")
+		return
+	}
+	log.Debug().Str("subscription ID", subscription.ID).Str("action", form.Action).Msg("preferences saved")
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/preferences?token=%s&saved=1", url.QueryEscape(form.Token)))
+}
+
+// subscription looks up the subscription of a preferences token, and responds
+// with an error if there is none.
+func (h *PreferencesHandler) subscription(c *gin.Context, db *gorm.DB, token string) (models.Subscription, bool) {
+	log := middleware.GetContextLogger(c)
+	if !domain.ValidSubscriberToken(token) {
+		log.Debug().Msg("invalid preferences token")
+		c.String(http.StatusBadRequest, "Invalid preferences token")
+		return models.Subscription{}, false
+	}
+	var subscription models.Subscription
+	err := db.Where("preferences_token = ?", token).First(&subscription).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Debug().Msg("unknown preferences token")
+		c.String(http.StatusNotFound, "Unknown preferences token")
+		return models.Subscription{}, false
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to look up preferences token")
+		c.String(http.StatusInternalServerError, "Failed to load preferences")
+		return models.Subscription{}, false
+	}
+	return subscription, true
+}
+
+// issueID returns the ID of the issue named by the preferences link, or an
+// empty string if it doesn't name a stored issue.
+func (h *PreferencesHandler) issueID(c *gin.Context, db *gorm.DB, id string) string {
+	log := middleware.GetContextLogger(c)
+	if id == "" {
+		return ""
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		log.Trace().Str("issue", id).Msg("ignoring invalid issue ID")
+		return ""
+	}
+	var count int64
+	if err := db.Model(&models.NewsletterIssue{}).Where("newsletter_issue_id = ?", id).Count(&count).Error; err != nil || count == 0 {
+		log.Trace().Err(err).Str("issue", id).Msg("ignoring unknown issue")
+		return ""
+	}
+	return id
+}
+
+func (h *PreferencesHandler) page(db *gorm.DB, subscription models.Subscription) (preferencesPage, error) {
+	lists, statuses, err := h.listStatuses(db, subscription.ID)
+	if err != nil {
+		return preferencesPage{}, err
+	}
+	page := preferencesPage{
+		Token:          subscription.PreferencesToken,
+		Email:          subscription.Email,
+		Name:           subscription.Name,
+		Frequency:      subscription.Frequency,
+		TrackingOptOut: subscription.TrackingOptOut,
+		Unsubscribed:   subscription.Status == models.SubscriptionStatusUnsubscribed,
+	}
+	if subscription.PausedUntil != nil && subscription.PausedUntil.After(time.Now()) {
+		page.PausedUntil = subscription.PausedUntil
+	}
+	for _, list := range lists {
+		status := statuses[list.ID]
+		page.Lists = append(page.Lists, preferencesList{
+			Slug:        list.Slug,
+			Name:        list.Name,
+			Description: list.Description,
+			Subscribed:  activeListStatus(status),
+			Pending:     status == models.SubscriptionStatusPending,
+		})
+	}
+	return page, nil
+}
+
+// listStatuses returns every list and the subscription's status on each of
+// them, keyed by list ID.
+func (h *PreferencesHandler) listStatuses(db *gorm.DB, subscriptionID string) ([]models.List, map[string]string, error) {
+	var lists []models.List
+	if err := db.Order("created_at").Find(&lists).Error; err != nil {
+		return nil, nil, err
+	}
+	var listSubscriptions []models.ListSubscription
+	if err := db.Where("subscription_id = ?", subscriptionID).Find(&listSubscriptions).Error; err != nil {
+		return nil, nil, err
+	}
+	statuses := make(map[string]string, len(listSubscriptions))
+	for _, listSubscription := range listSubscriptions {
+		statuses[listSubscription.ListID] = listSubscription.Status
+	}
+	return lists, statuses, nil
+}
+
+// parseChange validates a form submission, and responds with an error if it
+// is invalid.
+func (h *PreferencesHandler) parseChange(c *gin.Context, db *gorm.DB, form PreferencesForm) (preferencesChange, bool) {
+	log := middleware.GetContextLogger(c)
+	var change preferencesChange
+	if form.Name != "" {
+		name, err := domain.SubscriberNameFrom(form.Name)
+		if err != nil {
+			log.Trace().Err(err).Msg("failed to parse name")
+			c.String(http.StatusBadRequest, "Invalid name")
+			return preferencesChange{}, false
+		}
+		change.name = &name
+	}
+	if form.Frequency != "" {
+		frequency, err := domain.FrequencyFrom(form.Frequency)
+		if err != nil {
+			log.Trace().Err(err).Msg("failed to parse frequency")
+			c.String(http.StatusBadRequest, "Invalid frequency")
+			return preferencesChange{}, false
+		}
+		change.frequency = &frequency
+	}
+	if form.PauseWeeks != "" {
+		weeks, err := strconv.Atoi(form.PauseWeeks)
+		if err != nil || weeks < 0 || weeks > maxPauseWeeks {
+			log.Trace().Str("pause weeks", form.PauseWeeks).Msg("invalid pause")
+			c.String(http.StatusBadRequest, "Pause must be between 0 and %d weeks", maxPauseWeeks)
+			return preferencesChange{}, false
+		}
+		change.pauseWeeks = &weeks
+	}
+	switch form.Tracking {
+	case "":
+	case preferencesTrackingAllow, preferencesTrackingOptOut:
+		optOut := form.Tracking == preferencesTrackingOptOut
+		change.trackingOptOut = &optOut
+	default:
+		log.Trace().Str("tracking", form.Tracking).Msg("invalid tracking choice")
+		c.String(http.StatusBadRequest, "Invalid tracking choice")
+		return preferencesChange{}, false
+	}
+
+	// the page always submits the lists field, so a missing field leaves the
+	// lists alone while an empty one leaves all of them
+	if _, ok := c.GetPostFormArray("lists"); ok {
+		var slugs []string
+		for _, slug := range form.Lists {
+			if slug != "" {
+				slugs = append(slugs, slug)
+			}
+		}
+		change.lists = make(map[string]bool, len(slugs))
+		if len(slugs) > 0 {
+			lists, err := findLists(db, slugs)
+			if errors.Is(err, errUnknownList) {
+				log.Trace().Err(err).Msg("unknown list")
+				c.String(http.StatusBadRequest, "Unknown list")
+				return preferencesChange{}, false
+			} else if err != nil {
+				log.Warn().Err(err).Msg("failed to look up lists")
+				c.String(http.StatusInternalServerError, "Failed to save preferences")
+				return preferencesChange{}, false
+			}
+			for _, list := range lists {
+				change.lists[list.ID] = true
+			}
+		}
+	}
+	return change, true
+}
+
+// apply writes a change to the subscription and records each difference in
+// the audit trail.
+func (h *PreferencesHandler) apply(tx *gorm.DB, subscription models.Subscription, change preferencesChange, now time.Time) error {
+	updates := map[string]interface{}{}
+	if change.name != nil && change.name.String() != subscription.Name {
+		updates["name"] = change.name.String()
+		if err := audit(tx, subscription.ID, models.AuditActionNameChanged, subscription.Name, change.name.String(), auditSourcePreferences); err != nil {
+			return err
+		}
+	}
+	if change.frequency != nil && change.frequency.String() != subscription.Frequency {
+		updates["frequency"] = change.frequency.String()
+		if *change.frequency == domain.FrequencyWeekly {
+			updates["last_digest_at"] = now.UTC()
+			updates["next_digest_at"] = now.Add(newsletter.DigestInterval).UTC()
+		} else {
+			updates["last_digest_at"] = nil
+			updates["next_digest_at"] = nil
+		}
+		if err := audit(tx, subscription.ID, models.AuditActionFrequencyChanged, subscription.Frequency, change.frequency.String(), auditSourcePreferences); err != nil {
+			return err
+		}
+	}
+	if change.pauseWeeks != nil {
+		paused := subscription.PausedUntil != nil && subscription.PausedUntil.After(now)
+		if *change.pauseWeeks > 0 {
+			until := now.AddDate(0, 0, 7*(*change.pauseWeeks)).UTC()
+			updates["paused_until"] = until
+			if err := audit(tx, subscription.ID, models.AuditActionPaused, "", until.Format(time.RFC3339), auditSourcePreferences); err != nil {
+				return err
+			}
+		} else if paused {
+			updates["paused_until"] = nil
+			if err := audit(tx, subscription.ID, models.AuditActionResumed, subscription.PausedUntil.UTC().Format(time.RFC3339), "", auditSourcePreferences); err != nil {
+				return err
+			}
+		}
+	}
+
+	if change.trackingOptOut != nil && *change.trackingOptOut != subscription.TrackingOptOut {
+		updates["tracking_opt_out"] = *change.trackingOptOut
+		if err := audit(tx, subscription.ID, models.AuditActionTrackingChanged, trackingChoice(subscription.TrackingOptOut), trackingChoice(*change.trackingOptOut), auditSourcePreferences); err != nil {
+			return err
+		}
+	}
+
+	if change.lists != nil {
+		subscribed, err := h.applyLists(tx, subscription, change.lists, change.issueID, now)
+		if err != nil {
+			return err
+		}
+		if subscribed && subscription.Status == models.SubscriptionStatusUnsubscribed {
+			updates["status"] = models.SubscriptionStatusConfirmed
+		}
+	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+	return tx.Model(&models.Subscription{}).Where("id = ?", subscription.ID).Updates(updates).Error
+}
+
+// applyLists subscribes to the wanted lists and unsubscribes from the others.
+// Lists picked here are confirmed right away, the preferences token proves
+// the subscriber owns the email. It reports whether a list was subscribed to.
+func (h *PreferencesHandler) applyLists(tx *gorm.DB, subscription models.Subscription, wanted map[string]bool, issueID string, now time.Time) (bool, error) {
+	lists, statuses, err := h.listStatuses(tx, subscription.ID)
+	if err != nil {
+		return false, err
+	}
+	subscribed := false
+	confirmedAt := now.UTC()
+	for _, list := range lists {
+		active := activeListStatus(statuses[list.ID])
+		switch {
+		case wanted[list.ID] && !active:
+			listSubscription := models.ListSubscription{
+				SubscriptionID: subscription.ID,
+				ListID:         list.ID,
+				Status:         models.SubscriptionStatusConfirmed,
+				SubscribedAt:   now.UTC(),
+				ConfirmedAt:    &confirmedAt,
+			}
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "subscription_id"}, {Name: "list_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"status", "subscribed_at", "confirmed_at"}),
+			}).Create(&listSubscription).Error
+			if err != nil {
+				return false, err
+			}
+			if err := audit(tx, subscription.ID, models.AuditActionListSubscribed, "", list.Slug, auditSourcePreferences); err != nil {
+				return false, err
+			}
+			subscribed = true
+		case !wanted[list.ID] && active:
+			if err := unsubscribeFromList(tx, subscription.ID, list.ID); err != nil {
+				return false, err
+			}
+			if err := auditForIssue(tx, subscription.ID, issueID, models.AuditActionListUnsubscribed, list.Slug, "", auditSourcePreferences); err != nil {
+				return false, err
+			}
+		}
+	}
+	return subscribed, nil
+}
+
+func (h *PreferencesHandler) unsubscribeAll(tx *gorm.DB, subscription models.Subscription, issueID string) error {
+	err := tx.Model(&models.ListSubscription{}).
+		Where("subscription_id = ? AND status IN ?", subscription.ID, []string{models.SubscriptionStatusPending, models.SubscriptionStatusConfirmed}).
+		Update("status", models.SubscriptionStatusUnsubscribed).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Model(&models.Subscription{}).Where("id = ?", subscription.ID).Update("status", models.SubscriptionStatusUnsubscribed).Error; err != nil {
+		return err
+	}
+	return auditForIssue(tx, subscription.ID, issueID, models.AuditActionUnsubscribedAll, subscription.Status, models.SubscriptionStatusUnsubscribed, auditSourcePreferences)
+}
+
+func unsubscribeFromList(tx *gorm.DB, subscriptionID, listID string) error {
+	return tx.Model(&models.ListSubscription{}).
+		Where("subscription_id = ? AND list_id = ?", subscriptionID, listID).
+		Update("status", models.SubscriptionStatusUnsubscribed).Error
+}
+
+func trackingChoice(optOut bool) string {
+	if optOut {
+		return preferencesTrackingOptOut
+	}
+	return preferencesTrackingAllow
+}
+
+func activeListStatus(status string) bool {
+	return status == models.SubscriptionStatusPending || status == models.SubscriptionStatusConfirmed
+}
@@ -1,13 +1,26 @@
 package routes
 
 import (
+	"context"
+
 	"github.com/gin-gonic/gin"
 	"github.com/guuzaa/email-newsletter/internal"
 	"github.com/guuzaa/email-newsletter/internal/api/middleware"
+	"github.com/guuzaa/email-newsletter/internal/assets"
+	"github.com/guuzaa/email-newsletter/internal/database"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/guuzaa/email-newsletter/internal/outbox"
+	"github.com/guuzaa/email-newsletter/internal/repository"
 	"gorm.io/gorm"
 )
 
-func SetupRouter(db *gorm.DB, emailClient *internal.EmailClient, baseURL string) *gin.Engine {
+// SetupRouter routes the requests to their handlers. Heavy read-only pages,
+// like the archive and the stats, read from the replicas. Confirmation emails
+// go through the outbox of the dispatcher. The renderer and tracker are the
+// ones the scheduler uses too. Work that outlives its request stops once ctx
+// is cancelled.
+func SetupRouter(ctx context.Context, db *gorm.DB, replicas *database.Replicas, engine *newsletter.Engine, dispatcher *outbox.Dispatcher, renderer *newsletter.Renderer, tracker *newsletter.Tracker, settings *internal.Settings) *gin.Engine {
+	baseURL := settings.Application.BaseURL
 	r := gin.New()
 	r.Use(gin.Recovery())
 	r.Use(middleware.RequestID())
@@ -15,19 +28,63 @@ func SetupRouter(db *gorm.DB, emailClient *internal.EmailClient, baseURL string)
 
 	r.GET("/", home)
 
-	loginHandler := NewLoginHandler(db)
+	store := repository.NewPostgres(db)
+	loginHandler := NewLoginHandler(store.Users())
 	r.GET("/login", loginHandler.get)
 	r.POST("/login", loginHandler.post)
 
 	r.GET("/health_check", healthCheck)
-	confirmSubscriptionHandler := NewConfirmSubscriptionHandler(db)
+	confirmSubscriptionHandler := NewConfirmSubscriptionHandler(db, store)
 	r.GET("/subscriptions/confirm", confirmSubscriptionHandler.confirm)
 
-	subscriptionHandler := NewSubscriptionHandler(db, emailClient, baseURL)
+	subscriptionHandler := NewSubscriptionHandler(db, store, dispatcher, baseURL)
 	r.POST("/subscriptions", subscriptionHandler.subscribe)
 
-	newslettersHandler := NewNewslettersHandler(db, emailClient)
+	preferencesHandler := NewPreferencesHandler(db)
+	r.GET("/preferences", preferencesHandler.get)
+	r.POST("/preferences", preferencesHandler.post)
+
+	listsHandler := NewListsHandler(db, replicas)
+	r.GET("/lists", listsHandler.lists)
+	r.POST("/lists", listsHandler.createList)
+
+	library := assets.NewLibrary(assets.NewLocalStorage(settings.Assets.Directory), baseURL, settings.Assets.MaxUploadBytes)
+	assetsHandler := NewAssetsHandler(db, library)
+	r.POST("/assets", assetsHandler.upload)
+	r.GET("/assets/*key", assetsHandler.serve)
+
+	newslettersHandler := NewNewslettersHandler(ctx, db, renderer, engine)
+	newslettersHandler.UseAssets(library)
 	r.POST("/newsletters", newslettersHandler.publishNewsletter)
+	r.PATCH("/newsletters/:id", newslettersHandler.rescheduleNewsletter)
+	r.DELETE("/newsletters/:id", newslettersHandler.cancelNewsletter)
+	r.POST("/newsletters/test", newslettersHandler.sendTestNewsletter)
+	r.POST("/newsletters/preview", newslettersHandler.previewNewsletter)
+	r.GET("/newsletters/:id/preview", newslettersHandler.previewStoredNewsletter)
+	r.GET("/admin/newsletters", newslettersHandler.adminPage)
+
+	issueStatsHandler := NewIssueStatsHandler(db, replicas)
+	r.GET("/api/issues/:id/stats", issueStatsHandler.stats)
+	r.GET("/admin/issues/:id/stats", issueStatsHandler.adminPage)
+
+	archiveHandler := NewArchiveHandler(replicas, renderer, baseURL)
+	r.GET("/archive", archiveHandler.index)
+	r.GET("/archive/:slug", archiveHandler.issue)
+	r.GET("/feed.atom", archiveHandler.atom)
+	r.GET("/feed.rss", archiveHandler.rss)
+
+	suppressionsHandler := NewSuppressionsHandler(db, replicas)
+	r.GET("/admin/suppressions", suppressionsHandler.suppressions)
+	r.POST("/admin/suppressions", suppressionsHandler.addSuppression)
+	r.POST("/admin/suppressions/import", suppressionsHandler.importSuppressions)
+	r.DELETE("/admin/suppressions/:email", suppressionsHandler.removeSuppression)
+
+	trackingHandler := NewTrackingHandler(db, tracker)
+	r.GET("/t/o/:token", trackingHandler.open)
+	r.GET("/t/c/:token", trackingHandler.click)
+
+	webhooksHandler := NewWebhooksHandler(db, settings.Webhooks)
+	r.POST("/webhooks/postmark", webhooksHandler.postmark)
 
 	return r
 }
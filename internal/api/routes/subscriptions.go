@@ -1,151 +1,174 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
+	"html"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/guuzaa/email-newsletter/internal"
 	"github.com/guuzaa/email-newsletter/internal/api/middleware"
 	"github.com/guuzaa/email-newsletter/internal/database/models"
 	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/guuzaa/email-newsletter/internal/outbox"
+	"github.com/guuzaa/email-newsletter/internal/repository"
 	"gorm.io/gorm"
 )
 
+// SubscriptionHandler stores subscriptions through the repositories, the
+// lists are looked up in the database. Confirmation emails are added to the
+// outbox along with the subscription, and sent once it is stored.
 type SubscriptionHandler struct {
-	db          *gorm.DB
-	emailClient *internal.EmailClient
-	baseURL     string
+	db         *gorm.DB
+	store      repository.Store
+	dispatcher *outbox.Dispatcher
+	baseURL    string
 }
 
-func NewSubscriptionHandler(db *gorm.DB, emailClient *internal.EmailClient, baseURL string) *SubscriptionHandler {
-	return &SubscriptionHandler{db: db, emailClient: emailClient, baseURL: baseURL}
+func NewSubscriptionHandler(db *gorm.DB, store repository.Store, dispatcher *outbox.Dispatcher, baseURL string) *SubscriptionHandler {
+	return &SubscriptionHandler{db: db, store: store, dispatcher: dispatcher, baseURL: baseURL}
 }
 
-func (h *SubscriptionHandler) insertSubscriber(c *gin.Context, tx *gorm.DB, subscriber domain.NewSubscriber) (string, error) {
-	log := middleware.GetContextLogger(c)
-	log.Trace().Msg("inserting subscription")
-	subscriberID := uuid.NewString()
-	subscription := models.Subscription{
-		Name:   subscriber.Name.String(),
-		Email:  subscriber.Email.String(),
-		ID:     subscriberID,
-		Status: models.SubscriptionStatusPending,
+// newSubscription is the subscriber as they are stored, pending
+// confirmation.
+func newSubscription(subscriber domain.NewSubscriber) models.Subscription {
+	return models.Subscription{
+		Name:             subscriber.Name.String(),
+		Email:            subscriber.Email.String(),
+		ID:               uuid.NewString(),
+		Status:           models.SubscriptionStatusPending,
+		TimeZone:         subscriber.TimeZone.String(),
+		SubscribedAt:     time.Now().UTC(),
+		PreferencesToken: domain.NewPreferencesToken(),
 	}
+}
 
-	if err := tx.Create(&subscription).Error; err != nil {
-		return "", err
-	}
-	log.Trace().Str("name", subscription.Name).Str("email", subscription.Email).Msg("added new subscriber")
-	return subscriberID, nil
+type SubscriptionForm struct {
+	Name     string `form:"name"`
+	Email    string `form:"email"`
+	TimeZone string `form:"time_zone"`
+	List     string `form:"list"`
 }
 
-func (h *SubscriptionHandler) parseSubscription(c *gin.Context) (domain.NewSubscriber, error) {
+// parseSubscription returns the new subscriber and the slug of the list they
+// subscribe to.
+func (h *SubscriptionHandler) parseSubscription(c *gin.Context) (domain.NewSubscriber, string, error) {
 	log := middleware.GetContextLogger(c)
 
-	var data models.Subscription
+	var data SubscriptionForm
 	if err := c.ShouldBind(&data); err != nil {
 		log.Trace().Err(err).Msg("failed to bind request body")
-		return domain.NewSubscriber{}, err
+		return domain.NewSubscriber{}, "", err
 	}
 	name, err := domain.SubscriberNameFrom(data.Name)
 	if err != nil {
 		log.Trace().Err(err).Msg("failed to parse name")
-		return domain.NewSubscriber{}, err
+		return domain.NewSubscriber{}, "", err
 	}
 
 	email, err := domain.SubscriberEmailFrom(data.Email)
 	if err != nil {
 		log.Trace().Err(err).Msg("failed to parse email")
-		return domain.NewSubscriber{}, err
+		return domain.NewSubscriber{}, "", err
 	}
 
-	log.Trace().Str("name", data.Name).Str("email", data.Email).Msg("parsed subscription")
-	return domain.NewSubscriber{
-		Name:  name,
-		Email: email,
-	}, nil
-}
+	var timeZone domain.TimeZone
+	if data.TimeZone != "" {
+		timeZone, err = domain.TimeZoneFrom(data.TimeZone)
+		if err != nil {
+			log.Trace().Err(err).Msg("failed to parse time zone")
+			return domain.NewSubscriber{}, "", err
+		}
+	}
 
-func (h *SubscriptionHandler) hasPendingSubscriber(subscriber domain.NewSubscriber) bool {
-	email := subscriber.Email.String()
-	var subscription models.Subscription
-	result := h.db.Where("email = ?", email).First(&subscription)
-	if err := result.Error; err != nil {
-		return false
+	list := data.List
+	if list == "" {
+		list = models.DefaultListSlug
 	}
-	return result.RowsAffected == 1 && subscription.Status == models.SubscriptionStatusPending
+
+	log.Trace().Str("name", data.Name).Str("email", data.Email).Str("list", list).Msg("parsed subscription")
+	return domain.NewSubscriber{
+		Name:     name,
+		Email:    email,
+		TimeZone: timeZone,
+	}, list, nil
 }
 
 func (h *SubscriptionHandler) subscribe(c *gin.Context) {
 	log := middleware.GetContextLogger(c)
-	h.db = h.db.WithContext(c.Request.Context())
+	db := h.db.WithContext(c.Request.Context())
 
-	newSubscriber, err := h.parseSubscription(c)
+	newSubscriber, listSlug, err := h.parseSubscription(c)
 	if err != nil {
 		log.Trace().Err(err).Msg("failed to parse subscription")
 		c.String(http.StatusBadRequest, "Invalid subscription")
 		return
 	}
 
-	if h.hasPendingSubscriber(newSubscriber) {
-		log.Trace().Msg("subscribe twice")
-		c.String(http.StatusOK, "You've subscribed already!")
+	lists, err := findLists(db, []string{listSlug})
+	if errors.Is(err, errUnknownList) {
+		log.Trace().Err(err).Msg("subscribe to unknown list")
+		c.String(http.StatusBadRequest, "Unknown list")
 		return
-	}
-
-	tx := h.db.Begin()
-	subscriberID, err := h.insertSubscriber(c, tx, newSubscriber)
-	if err != nil {
-		log.Debug().Err(err).Msg("failed to insert subscription")
-		tx.Rollback()
+	} else if err != nil {
+		log.Warn().Err(err).Msg("failed to look up list")
 		c.String(http.StatusInternalServerError, "Failed to store subscription")
 		return
 	}
+	list := lists[0]
 
+	ctx := c.Request.Context()
+	var result repository.SubscribeResult
 	subscriptionToken := domain.NewSubscriptionToken()
-	if err = h.storeToken(tx, subscriberID, subscriptionToken); err != nil {
+	confirmation := h.confirmationEmail(newSubscriber, list, subscriptionToken)
+	err = h.store.Transaction(ctx, func(store repository.Store) error {
+		var err error
+		result, err = store.Subscriptions().Subscribe(ctx, newSubscription(newSubscriber), list.ID, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("failed to subscribe: %w", err)
+		}
+		if result.Outcome == repository.AlreadyConfirmed {
+			return nil
+		}
+		// pending subscribers get another link, in case they lost the first
+		token := models.SubscriptionTokens{SubscriptionID: result.SubscriberID, ListID: list.ID, SubscriptionToken: subscriptionToken}
+		if err := store.Tokens().Add(ctx, token); err != nil {
+			return fmt.Errorf("failed to store subscription token: %w", err)
+		}
+		if err := store.Outbox().Add(ctx, confirmation); err != nil {
+			return fmt.Errorf("failed to store confirmation email: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
 		log.Warn().Err(err).Msg("failed to store subscription")
-		tx.Rollback()
-		c.String(http.StatusInternalServerError, "Failed to store subscription token")
+		c.String(http.StatusInternalServerError, "Failed to store subscription")
 		return
 	}
-	log.Debug().Msgf("subscription token stored for subscriber ID %s, token %s", subscriberID, subscriptionToken)
-
-	if err = tx.Commit().Error; err != nil {
-		log.Warn().Err(err).Msg("failed to commit transaction")
-		tx.Rollback()
-		c.String(http.StatusInternalServerError, "Internal server error from database")
+	if result.Outcome == repository.AlreadyConfirmed {
+		log.Trace().Str("list", list.Slug).Msg("subscribe twice")
+		c.String(http.StatusOK, "You've subscribed already!")
 		return
 	}
-	log.Debug().Msgf("subscription created, ID %s, token %s", subscriberID, subscriptionToken)
+	log.Debug().Msgf("subscription %s, ID %s, list %s, token %s", result.Outcome, result.SubscriberID, list.Slug, subscriptionToken)
 
-	if err = h.sendConfirmationEmail(newSubscriber, subscriptionToken); err != nil {
-		log.Warn().Err(err).Msg("failed to send confirmation email")
-		c.String(http.StatusInternalServerError, "Failed to send confirmation email")
-		return
-	}
-	log.Debug().Msgf("confirmation email sent to subscriber ID %s, token %s", subscriberID, subscriptionToken)
+	// the outbox sends the email, and retries it if it fails, after the
+	// response
+	h.dispatcher.Wake()
 
 	c.String(http.StatusOK, "")
 }
 
-func (h *SubscriptionHandler) sendConfirmationEmail(newSubscriber domain.NewSubscriber, token string) error {
+// confirmationEmail is the email with the link that confirms the
+// subscription to the list.
+func (h *SubscriptionHandler) confirmationEmail(newSubscriber domain.NewSubscriber, list models.List, token string) models.OutboxMessage {
 	subject := "Welcome!"
 	confirmationLink := fmt.Sprintf("%s/subscriptions/confirm?subscription_token=%s", h.baseURL, token)
-	htmlContent := fmt.Sprintf(`Welcome to our newsletter!<br />
-	Click <a href="%s">here</a> to confirm your subscription.`, confirmationLink)
-	textContent := fmt.Sprintf(`Welcome to our newsletter!
-	Click %s to confirm your subscription.`, confirmationLink)
-	return h.emailClient.SendEmail(newSubscriber.Email, subject, htmlContent, textContent)
-}
-
-func (h *SubscriptionHandler) storeToken(tx *gorm.DB, subscriberID string, subscriptionToken string) error {
-	token := models.SubscriptionTokens{
-		SubscriptionID:    subscriberID,
-		SubscriptionToken: subscriptionToken,
-	}
-	result := tx.Create(token)
-	return result.Error
+	htmlContent := fmt.Sprintf(`Welcome to %s!<br />
+	Click <a href="%s">here</a> to confirm your subscription.`, html.EscapeString(list.Name), confirmationLink)
+	textContent := fmt.Sprintf(`Welcome to %s!
+	Click %s to confirm your subscription.`, list.Name, confirmationLink)
+	return outbox.NewMessage(newSubscriber.Email, subject, htmlContent, textContent)
 }
@@ -2,25 +2,30 @@ package routes
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/guuzaa/email-newsletter/internal/api/middleware"
 	"github.com/guuzaa/email-newsletter/internal/database/models"
 	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/guuzaa/email-newsletter/internal/repository"
 	"gorm.io/gorm"
 )
 
+// ConfirmSubscriptionHandler confirms subscriptions through the repositories,
+// the default list is looked up in the database.
 type ConfirmSubscriptionHandler struct {
-	db *gorm.DB
+	db    *gorm.DB
+	store repository.Store
 }
 
-func NewConfirmSubscriptionHandler(db *gorm.DB) *ConfirmSubscriptionHandler {
-	return &ConfirmSubscriptionHandler{db: db}
+func NewConfirmSubscriptionHandler(db *gorm.DB, store repository.Store) *ConfirmSubscriptionHandler {
+	return &ConfirmSubscriptionHandler{db: db, store: store}
 }
 
 func (h *ConfirmSubscriptionHandler) confirm(c *gin.Context) {
 	log := middleware.GetContextLogger(c)
-	h.db = h.db.WithContext(c.Request.Context())
+	ctx := c.Request.Context()
 
 	subscriptionToken, ok := c.GetQuery("subscription_token")
 	if !ok {
@@ -35,45 +40,49 @@ func (h *ConfirmSubscriptionHandler) confirm(c *gin.Context) {
 		return
 	}
 
-	subscriptionID, err := h.getSubscriberIDFromToken(subscriptionToken)
+	token, err := h.getToken(c, subscriptionToken)
 	if err != nil {
 		log.Debug().Err(err).Msg("failed to get subscription ID from token")
 		c.String(http.StatusInternalServerError, "Failed to confirm subscription")
 		return
 	}
+	subscriptionID := token.SubscriptionID
 
-	if h.subscriptionHasConfirmed(subscriptionID) {
+	status, err := h.store.Subscriptions().ListStatus(ctx, subscriptionID, token.ListID)
+	if err != nil {
+		log.Debug().Err(err).Msg("failed to look up subscription")
+		c.String(http.StatusInternalServerError, "Failed to confirm subscription")
+		return
+	}
+	if status == models.SubscriptionStatusConfirmed {
 		log.Trace().Msg("click subscription link twice")
 		c.String(http.StatusOK, "You've confirmed the email!")
 		return
 	}
 
-	if err = h.confirmSubscription(subscriptionID); err != nil {
+	if err = h.store.Subscriptions().ConfirmList(ctx, subscriptionID, token.ListID, time.Now().UTC()); err != nil {
 		log.Debug().Err(err).Msg("failed to confirm subscription")
 		c.String(http.StatusInternalServerError, "Failed to confirm subscription")
 		return
 	}
-	log.Trace().Str("subscription ID", subscriptionID).Str("subscription token", subscriptionToken).Msg("subscription confirmed")
+	log.Trace().Str("subscription ID", subscriptionID).Str("list ID", token.ListID).Str("subscription token", subscriptionToken).Msg("subscription confirmed")
 
 	c.String(http.StatusOK, "")
 }
 
-func (h *ConfirmSubscriptionHandler) subscriptionHasConfirmed(subscriptionID string) bool {
-	var subscription models.Subscription
-	result := h.db.Where(&models.Subscription{ID: subscriptionID, Status: models.SubscriptionStatusConfirmed}).First(&subscription)
-	return result.Error == nil
-}
-
-func (h *ConfirmSubscriptionHandler) confirmSubscription(subscriptionID string) error {
-	var subscription models.Subscription
-	result := h.db.Model(&subscription).Where("id = ?", subscriptionID).Update("status", models.SubscriptionStatusConfirmed)
-	return result.Error
-}
-
-func (h *ConfirmSubscriptionHandler) getSubscriberIDFromToken(subscriptionToken string) (string, error) {
-	var token models.SubscriptionTokens
-	if err := h.db.Where("subscription_token = ?", subscriptionToken).First(&token).Error; err != nil {
-		return "", err
+// getToken looks up the subscription token, tokens issued before lists
+// existed confirm the default list.
+func (h *ConfirmSubscriptionHandler) getToken(c *gin.Context, subscriptionToken string) (models.SubscriptionTokens, error) {
+	token, err := h.store.Tokens().Find(c.Request.Context(), subscriptionToken)
+	if err != nil {
+		return models.SubscriptionTokens{}, err
+	}
+	if token.ListID == "" {
+		var list models.List
+		if err := h.db.WithContext(c.Request.Context()).Where("slug = ?", models.DefaultListSlug).First(&list).Error; err != nil {
+			return models.SubscriptionTokens{}, err
+		}
+		token.ListID = list.ID
 	}
-	return token.SubscriptionID, nil
+	return token, nil
 }
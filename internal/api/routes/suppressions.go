@@ -0,0 +1,218 @@
+package routes
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guuzaa/email-newsletter/internal/api/middleware"
+	"github.com/guuzaa/email-newsletter/internal/database"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/guuzaa/email-newsletter/internal/suppression"
+	"gorm.io/gorm"
+)
+
+const maxSuppressionImportSize = 10 << 20
+
+type SuppressionsHandler struct {
+	db       *gorm.DB
+	replicas *database.Replicas
+}
+
+func NewSuppressionsHandler(db *gorm.DB, replicas *database.Replicas) *SuppressionsHandler {
+	return &SuppressionsHandler{db: db, replicas: replicas}
+}
+
+type SuppressionData struct {
+	Email  string `json:"email" binding:"required"`
+	Reason string `json:"reason"`
+}
+
+// importSkip is a line of an import that wasn't applied.
+type importSkip struct {
+	Line  int    `json:"line"`
+	Email string `json:"email"`
+	Error string `json:"error"`
+}
+
+// suppressions lists the suppression list, optionally filtered by ?reason=.
+func (h *SuppressionsHandler) suppressions(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+
+	query := h.replicas.Reader(c.Request.Context()).Order("created_at DESC").Order("email")
+	if reason := c.Query("reason"); reason != "" {
+		if !suppression.ValidReason(reason) {
+			c.String(http.StatusBadRequest, "Invalid reason")
+			return
+		}
+		query = query.Where("reason = ?", reason)
+	}
+	var suppressions []models.Suppression
+	if err := query.Find(&suppressions).Error; err != nil {
+		log.Warn().Err(err).Msg("failed to load suppressions")
+		c.String(http.StatusInternalServerError, "Failed to load suppressions")
+		return
+	}
+	response := make([]gin.H, 0, len(suppressions))
+	for _, s := range suppressions {
+		response = append(response, suppressionResponse(s))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *SuppressionsHandler) addSuppression(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+
+	var body SuppressionData
+	if err := c.ShouldBindJSON(&body); err != nil {
+		log.Trace().Err(err).Msg("failed to bind request body")
+		c.String(http.StatusBadRequest, "")
+		return
+	}
+	email, err := domain.SubscriberEmailFrom(strings.TrimSpace(body.Email))
+	if err != nil {
+		log.Trace().Err(err).Str("email", body.Email).Msg("invalid email")
+		c.String(http.StatusBadRequest, "Invalid email")
+		return
+	}
+	reason := body.Reason
+	if reason == "" {
+		reason = models.SuppressionReasonManual
+	}
+	if !suppression.ValidReason(reason) {
+		c.String(http.StatusBadRequest, "Invalid reason")
+		return
+	}
+
+	s, err := suppression.Add(db, email.String(), reason, models.SuppressionSourceAdmin)
+	if err != nil {
+		log.Warn().Err(err).Str("email", email.String()).Msg("failed to store suppression")
+		c.String(http.StatusInternalServerError, "Failed to store suppression")
+		return
+	}
+	log.Debug().Str("email", s.Email).Str("reason", s.Reason).Msg("address suppressed")
+	c.JSON(http.StatusCreated, suppressionResponse(s))
+}
+
+func (h *SuppressionsHandler) removeSuppression(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+
+	email := c.Param("email")
+	removed, err := suppression.Remove(db, email, "")
+	if err != nil {
+		log.Warn().Err(err).Str("email", email).Msg("failed to remove suppression")
+		c.String(http.StatusInternalServerError, "Failed to remove suppression")
+		return
+	}
+	if !removed {
+		c.String(http.StatusNotFound, "Unknown suppression")
+		return
+	}
+	log.Debug().Str("email", email).Msg("suppression removed")
+	c.String(http.StatusOK, "")
+}
+
+// importSuppressions suppresses every address of a CSV body with the columns
+// email and an optional reason. Lines without a reason use ?reason=, or
+// manual. Invalid lines are skipped and reported, the rest is imported.
+func (h *SuppressionsHandler) importSuppressions(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !authenticate(c, db) {
+		return
+	}
+
+	defaultReason := c.DefaultQuery("reason", models.SuppressionReasonManual)
+	if !suppression.ValidReason(defaultReason) {
+		c.String(http.StatusBadRequest, "Invalid reason")
+		return
+	}
+
+	reader := csv.NewReader(http.MaxBytesReader(c.Writer, c.Request.Body, maxSuppressionImportSize))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	imported := 0
+	skipped := make([]importSkip, 0)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for line := 1; ; line++ {
+			record, err := reader.Read()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			address := strings.TrimSpace(record[0])
+			if line == 1 && strings.EqualFold(address, "email") {
+				continue
+			}
+			if address == "" {
+				continue
+			}
+			email, err := domain.SubscriberEmailFrom(address)
+			if err != nil {
+				skipped = append(skipped, importSkip{Line: line, Email: address, Error: "invalid email"})
+				continue
+			}
+			reason := defaultReason
+			if len(record) > 1 && strings.TrimSpace(record[1]) != "" {
+				reason = strings.TrimSpace(record[1])
+			}
+			if !suppression.ValidReason(reason) {
+				skipped = append(skipped, importSkip{Line: line, Email: address, Error: "invalid reason"})
+				continue
+			}
+			if _, err := suppression.Add(tx, email.String(), reason, models.SuppressionSourceImport); err != nil {
+				return err
+			}
+			imported++
+		}
+	})
+	var parseErr *csv.ParseError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &parseErr):
+		log.Trace().Err(err).Msg("failed to parse import")
+		c.String(http.StatusBadRequest, "Invalid CSV")
+		return
+	case errors.As(err, &tooLarge):
+		c.String(http.StatusRequestEntityTooLarge, "Import is too large")
+		return
+	case err != nil:
+		log.Warn().Err(err).Msg("failed to import suppressions")
+		c.String(http.StatusInternalServerError, "Failed to import suppressions")
+		return
+	}
+	log.Debug().Int("imported", imported).Int("skipped", len(skipped)).Msg("suppressions imported")
+	c.JSON(http.StatusOK, gin.H{"imported": imported, "skipped": skipped})
+}
+
+func suppressionResponse(s models.Suppression) gin.H {
+	return gin.H{
+		"email":      s.Email,
+		"reason":     s.Reason,
+		"source":     s.Source,
+		"created_at": s.CreatedAt,
+	}
+}
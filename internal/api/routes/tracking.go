@@ -0,0 +1,109 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/guuzaa/email-newsletter/internal/api/middleware"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"gorm.io/gorm"
+)
+
+// transparentGIF is a 1x1 transparent GIF.
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+type TrackingHandler struct {
+	db      *gorm.DB
+	tracker *newsletter.Tracker
+}
+
+func NewTrackingHandler(db *gorm.DB, tracker *newsletter.Tracker) *TrackingHandler {
+	return &TrackingHandler{db: db, tracker: tracker}
+}
+
+// open serves the open pixel of an issue, GET /t/o/:token.gif.
+func (h *TrackingHandler) open(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	signed, ok := strings.CutSuffix(c.Param("token"), ".gif")
+	if !ok {
+		c.String(http.StatusNotFound, "")
+		return
+	}
+	token, ok := h.verify(c, signed, models.TrackingEventOpen)
+	if !ok {
+		return
+	}
+	if err := h.record(db, token); err != nil {
+		log.Warn().Err(err).Str("issue ID", token.IssueID).Msg("failed to record open")
+	}
+	c.Header("Cache-Control", "no-store, no-cache, must-revalidate, private")
+	c.Data(http.StatusOK, "image/gif", transparentGIF)
+}
+
+// click records a click and redirects to the link's target, GET /t/c/:token.
+func (h *TrackingHandler) click(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	token, ok := h.verify(c, c.Param("token"), models.TrackingEventClick)
+	if !ok {
+		return
+	}
+	if err := h.record(db, token); err != nil {
+		log.Warn().Err(err).Str("issue ID", token.IssueID).Msg("failed to record click")
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, token.URL)
+}
+
+// verify checks the signature and kind of a token, and responds with 404 if
+// it isn't valid.
+func (h *TrackingHandler) verify(c *gin.Context, signed string, kind string) (newsletter.TrackingToken, bool) {
+	log := middleware.GetContextLogger(c)
+	if h.tracker == nil {
+		c.String(http.StatusNotFound, "")
+		return newsletter.TrackingToken{}, false
+	}
+	token, err := h.tracker.Verify(signed)
+	if err != nil || token.Kind != kind || (kind == models.TrackingEventClick && token.URL == "") {
+		log.Debug().Err(err).Msg("invalid tracking token")
+		c.String(http.StatusNotFound, "Invalid link")
+		return newsletter.TrackingToken{}, false
+	}
+	return token, true
+}
+
+// record stores the event unless the subscriber has opted out of tracking
+// since the issue was sent.
+func (h *TrackingHandler) record(db *gorm.DB, token newsletter.TrackingToken) error {
+	var subscription models.Subscription
+	err := db.Select("id", "tracking_opt_out").Where("id = ?", token.SubscriptionID).First(&subscription).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if subscription.TrackingOptOut {
+		return nil
+	}
+	return db.Create(&models.TrackingEvent{
+		ID:                uuid.NewString(),
+		NewsletterIssueID: token.IssueID,
+		SubscriptionID:    token.SubscriptionID,
+		Kind:              token.Kind,
+		URL:               token.URL,
+		CreatedAt:         time.Now().UTC(),
+	}).Error
+}
@@ -0,0 +1,265 @@
+package routes
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/api/middleware"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/guuzaa/email-newsletter/internal/suppression"
+	"gorm.io/gorm"
+)
+
+const webhookSecretHeader = "X-Webhook-Secret"
+
+// Postmark record types, bounce types and suppression reasons, see
+// https://postmarkapp.com/developer/webhooks/webhooks-overview
+const (
+	postmarkRecordDelivery           = "Delivery"
+	postmarkRecordBounce             = "Bounce"
+	postmarkRecordSpamComplaint      = "SpamComplaint"
+	postmarkRecordSubscriptionChange = "SubscriptionChange"
+
+	postmarkHardBounce      = "HardBounce"
+	postmarkBadEmailAddress = "BadEmailAddress"
+
+	postmarkReasonHardBounce        = "HardBounce"
+	postmarkReasonSpamComplaint     = "SpamComplaint"
+	postmarkReasonManualSuppression = "ManualSuppression"
+)
+
+type WebhooksHandler struct {
+	db       *gorm.DB
+	settings internal.WebhookSettings
+}
+
+func NewWebhooksHandler(db *gorm.DB, settings internal.WebhookSettings) *WebhooksHandler {
+	return &WebhooksHandler{db: db, settings: settings}
+}
+
+// PostmarkEvent holds the fields of the Bounce, SpamComplaint and
+// SubscriptionChange payloads the handler acts on.
+type PostmarkEvent struct {
+	RecordType        string `json:"RecordType"`
+	Type              string `json:"Type"`
+	Email             string `json:"Email"`
+	Inactive          bool   `json:"Inactive"`
+	Recipient         string `json:"Recipient"`
+	SuppressSending   bool   `json:"SuppressSending"`
+	SuppressionReason string `json:"SuppressionReason"`
+	// MessageID identifies the email the event is about
+	MessageID string `json:"MessageID"`
+}
+
+// suppressionChange is what an event does to an address.
+type suppressionChange struct {
+	email    string
+	suppress bool
+	reason   string
+	// status is the subscriber's new status, empty to leave it alone
+	status string
+	action string
+}
+
+func (h *WebhooksHandler) postmark(c *gin.Context) {
+	log := middleware.GetContextLogger(c)
+	db := h.db.WithContext(c.Request.Context())
+
+	if !h.authenticate(c) {
+		return
+	}
+
+	var event PostmarkEvent
+	if err := c.ShouldBindJSON(&event); err != nil {
+		log.Trace().Err(err).Msg("failed to bind webhook payload")
+		c.String(http.StatusBadRequest, "Invalid payload")
+		return
+	}
+	if event.RecordType == postmarkRecordDelivery {
+		h.delivered(c, db, event)
+		return
+	}
+	change, ok := postmarkChange(event)
+	if !ok {
+		// acknowledge events we don't act on, Postmark retries anything else
+		log.Debug().Str("record type", event.RecordType).Str("type", event.Type).Msg("ignoring webhook event")
+		c.String(http.StatusOK, "")
+		return
+	}
+	if change.email == "" {
+		log.Debug().Str("record type", event.RecordType).Msg("webhook event without an email")
+		c.String(http.StatusBadRequest, "Missing email")
+		return
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if change.status == models.SubscriptionStatusBounced {
+			bounced := []string{models.DeliveryStatusSent, models.DeliveryStatusDelivered}
+			if _, err := newsletter.UpdateLatestDelivery(tx, event.MessageID, strings.TrimSpace(change.email), bounced, models.DeliveryStatusBounced); err != nil {
+				return err
+			}
+		}
+		return applySuppressionChange(tx, change, models.SuppressionSourcePostmark)
+	}); err != nil {
+		log.Warn().Err(err).Str("email", change.email).Msg("failed to apply webhook event")
+		c.String(http.StatusInternalServerError, "Failed to apply event")
+		return
+	}
+	log.Debug().Str("record type", event.RecordType).Str("email", change.email).Bool("suppress", change.suppress).Msg("webhook event applied")
+	c.String(http.StatusOK, "")
+}
+
+// delivered marks the delivery of the message as delivered, see
+// newsletter.UpdateLatestDelivery.
+func (h *WebhooksHandler) delivered(c *gin.Context, db *gorm.DB, event PostmarkEvent) {
+	log := middleware.GetContextLogger(c)
+	if event.Recipient == "" {
+		c.String(http.StatusBadRequest, "Missing email")
+		return
+	}
+	found, err := newsletter.UpdateLatestDelivery(db, event.MessageID, strings.TrimSpace(event.Recipient), []string{models.DeliveryStatusSent}, models.DeliveryStatusDelivered)
+	if err != nil {
+		log.Warn().Err(err).Str("email", event.Recipient).Msg("failed to record delivery")
+		c.String(http.StatusInternalServerError, "Failed to apply event")
+		return
+	}
+	log.Debug().Str("email", event.Recipient).Bool("found", found).Msg("delivery recorded")
+	c.String(http.StatusOK, "")
+}
+
+// authenticate accepts either the configured Basic auth credentials or the
+// shared secret. Without either configured every request is rejected.
+func (h *WebhooksHandler) authenticate(c *gin.Context) bool {
+	log := middleware.GetContextLogger(c)
+
+	if h.settings.Secret != "" {
+		secret := c.GetHeader(webhookSecretHeader)
+		if secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(h.settings.Secret)) == 1 {
+			return true
+		}
+	}
+	if h.settings.Username != "" && h.settings.Password != "" {
+		username, password, ok := c.Request.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(username), []byte(h.settings.Username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(h.settings.Password)) == 1 {
+			return true
+		}
+	}
+	if h.settings.Secret == "" && (h.settings.Username == "" || h.settings.Password == "") {
+		log.Warn().Msg("webhook authentication is not configured")
+	}
+	log.Trace().Msg("invalid webhook credentials")
+	c.Header("WWW-Authenticate", `Basic realm="webhooks"`)
+	c.String(http.StatusUnauthorized, "Invalid credentials")
+	return false
+}
+
+// postmarkChange maps a Postmark event to a change of the suppression list.
+// Soft bounces and unknown record types are ignored.
+func postmarkChange(event PostmarkEvent) (suppressionChange, bool) {
+	switch event.RecordType {
+	case postmarkRecordBounce:
+		if event.Type != postmarkHardBounce && event.Type != postmarkBadEmailAddress && !event.Inactive {
+			return suppressionChange{}, false
+		}
+		return suppressionChange{
+			email:    event.Email,
+			suppress: true,
+			reason:   models.SuppressionReasonHardBounce,
+			status:   models.SubscriptionStatusBounced,
+			action:   models.AuditActionBounced,
+		}, true
+	case postmarkRecordSpamComplaint:
+		return suppressionChange{
+			email:    event.Email,
+			suppress: true,
+			reason:   models.SuppressionReasonSpamComplaint,
+			status:   models.SubscriptionStatusComplained,
+			action:   models.AuditActionComplained,
+		}, true
+	case postmarkRecordSubscriptionChange:
+		if !event.SuppressSending {
+			return suppressionChange{email: event.Recipient, action: models.AuditActionReactivated}, true
+		}
+		switch event.SuppressionReason {
+		case postmarkReasonHardBounce:
+			return suppressionChange{
+				email:    event.Recipient,
+				suppress: true,
+				reason:   models.SuppressionReasonHardBounce,
+				status:   models.SubscriptionStatusBounced,
+				action:   models.AuditActionBounced,
+			}, true
+		case postmarkReasonSpamComplaint:
+			return suppressionChange{
+				email:    event.Recipient,
+				suppress: true,
+				reason:   models.SuppressionReasonSpamComplaint,
+				status:   models.SubscriptionStatusComplained,
+				action:   models.AuditActionComplained,
+			}, true
+		case postmarkReasonManualSuppression:
+			return suppressionChange{
+				email:    event.Recipient,
+				suppress: true,
+				reason:   models.SuppressionReasonUnsubscribed,
+				status:   models.SubscriptionStatusUnsubscribed,
+				action:   models.AuditActionUnsubscribedAll,
+			}, true
+		}
+	}
+	return suppressionChange{}, false
+}
+
+// applySuppressionChange suppresses or reactivates an address and updates the
+// subscriber with that email, if there is one. Reactivation only lifts
+// suppressions from the same source.
+func applySuppressionChange(tx *gorm.DB, change suppressionChange, source string) error {
+	email := strings.TrimSpace(change.email)
+	if change.suppress {
+		if _, err := suppression.Add(tx, email, change.reason, source); err != nil {
+			return err
+		}
+	} else {
+		if _, err := suppression.Remove(tx, email, source); err != nil {
+			return err
+		}
+	}
+
+	var subscription models.Subscription
+	// suppressions are stored lowercased, the address may not be
+	err := tx.Where("LOWER(email) = LOWER(?)", email).First(&subscription).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	newStatus := subscription.Status
+	if change.status != "" {
+		newStatus = change.status
+	}
+	if !change.suppress && (subscription.Status == models.SubscriptionStatusBounced || subscription.Status == models.SubscriptionStatusComplained) {
+		newStatus = models.SubscriptionStatusConfirmed
+	}
+	if newStatus != subscription.Status {
+		if err := tx.Model(&subscription).Update("status", newStatus).Error; err != nil {
+			return err
+		}
+	}
+	if newStatus == models.SubscriptionStatusUnsubscribed {
+		err := tx.Model(&models.ListSubscription{}).
+			Where("subscription_id = ? AND status IN ?", subscription.ID, []string{models.SubscriptionStatusPending, models.SubscriptionStatusConfirmed}).
+			Update("status", models.SubscriptionStatusUnsubscribed).Error
+		if err != nil {
+			return err
+		}
+	}
+	return audit(tx, subscription.ID, change.action, subscription.Status, newStatus, source)
+}
@@ -0,0 +1,170 @@
+// Package assets stores the images of newsletter issues and the smaller
+// variants of them that are served under /assets.
+package assets
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+)
+
+// VariantWidths are the widths images are resized to, for those wider.
+var VariantWidths = []int{320, 640, 1280}
+
+// maxPixels bounds the images that are decoded, a small file can claim to be
+// an enormous image.
+const maxPixels = 40_000_000
+
+var (
+	ErrTooLarge         = errors.New("asset is too large")
+	ErrUnsupportedImage = errors.New("unsupported image")
+)
+
+// extensions are the image types that can be uploaded, by content type.
+var extensions = map[string]string{
+	"image/gif":  ".gif",
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// Asset is an uploaded image. Width and Height are zero for images that
+// can't be decoded here, such as WebP, which also have no variants.
+type Asset struct {
+	Key         string    `json:"key"`
+	URL         string    `json:"url"`
+	ContentType string    `json:"content_type"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Variants    []Variant `json:"variants"`
+}
+
+// Variant is an uploaded image resized to a smaller width.
+type Variant struct {
+	Key   string `json:"key"`
+	URL   string `json:"url"`
+	Width int    `json:"width"`
+}
+
+// Library uploads images to a storage and hands them out again. Assets are
+// stored under the hash of their content, so their keys never change meaning
+// and can be cached for good.
+type Library struct {
+	storage Storage
+	baseURL string
+	maxSize int64
+}
+
+func NewLibrary(storage Storage, baseURL string, maxSize int64) *Library {
+	return &Library{storage: storage, baseURL: strings.TrimSuffix(baseURL, "/"), maxSize: maxSize}
+}
+
+// MaxSize is the largest upload the library accepts, zero for no limit.
+func (l *Library) MaxSize() int64 {
+	return l.maxSize
+}
+
+// Upload stores the image and its variants.
+func (l *Library) Upload(ctx context.Context, content []byte) (Asset, error) {
+	if l.maxSize > 0 && int64(len(content)) > l.maxSize {
+		return Asset{}, fmt.Errorf("%w: %d bytes, at most %d", ErrTooLarge, len(content), l.maxSize)
+	}
+	contentType := http.DetectContentType(content)
+	extension, ok := extensions[contentType]
+	if !ok {
+		return Asset{}, fmt.Errorf("%w: %s", ErrUnsupportedImage, contentType)
+	}
+	sum := sha256.Sum256(content)
+	name := "images/" + hex.EncodeToString(sum[:16])
+
+	asset := Asset{Key: name + extension, ContentType: contentType, Variants: []Variant{}}
+	asset.URL = l.URL(asset.Key)
+	if contentType != "image/webp" {
+		config, _, err := image.DecodeConfig(bytes.NewReader(content))
+		if err != nil {
+			return Asset{}, fmt.Errorf("%w: %v", ErrUnsupportedImage, err)
+		}
+		if config.Width*config.Height > maxPixels {
+			return Asset{}, fmt.Errorf("%w: %dx%d pixels", ErrTooLarge, config.Width, config.Height)
+		}
+		asset.Width, asset.Height = config.Width, config.Height
+	}
+	if err := l.storage.Put(ctx, asset.Key, content, contentType); err != nil {
+		return Asset{}, err
+	}
+
+	// animated GIFs would lose their animation, WebP can't be decoded
+	if contentType != "image/png" && contentType != "image/jpeg" {
+		return asset, nil
+	}
+	// the image is decoded and converted once, for every width to be
+	// resized from the same buffer
+	var src *image.RGBA
+	for _, width := range VariantWidths {
+		if width >= asset.Width {
+			break
+		}
+		if src == nil {
+			img, _, err := image.Decode(bytes.NewReader(content))
+			if err != nil {
+				return Asset{}, fmt.Errorf("%w: %v", ErrUnsupportedImage, err)
+			}
+			src = toRGBA(img)
+		}
+		resized, err := encode(resize(src, width), contentType)
+		if err != nil {
+			return Asset{}, err
+		}
+		key := fmt.Sprintf("%s-%dw%s", name, width, extension)
+		if err := l.storage.Put(ctx, key, resized, contentType); err != nil {
+			return Asset{}, err
+		}
+		asset.Variants = append(asset.Variants, Variant{Key: key, URL: l.URL(key), Width: width})
+	}
+	return asset, nil
+}
+
+// Asset returns the content of the asset with the key and its content type,
+// it makes the library a newsletter.AssetSource.
+func (l *Library) Asset(ctx context.Context, key string) ([]byte, string, error) {
+	content, err := l.storage.Get(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, "", fmt.Errorf("%w: %s", newsletter.ErrUnknownAsset, key)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return content, mime.TypeByExtension(path.Ext(key)), nil
+}
+
+// URL is where the asset with the key is served.
+func (l *Library) URL(key string) string {
+	return l.baseURL + "/assets/" + key
+}
+
+func encode(img image.Image, contentType string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch contentType {
+	case "image/png":
+		err = png.Encode(&buf, img)
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	default:
+		err = fmt.Errorf("%w: can't encode %s", ErrUnsupportedImage, contentType)
+	}
+	return buf.Bytes(), err
+}
@@ -0,0 +1,68 @@
+package assets
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResizeAveragesThePixelsItCovers(t *testing.T) {
+	// black and white columns average to grey
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			img.Set(x, y, color.Gray{Y: uint8(255 * (x % 2))})
+		}
+	}
+
+	resized := resize(img, 2)
+
+	assert.Equal(t, image.Rect(0, 0, 2, 1), resized.Bounds())
+	assert.Equal(t, color.RGBA{R: 127, G: 127, B: 127, A: 255}, resized.At(1, 0))
+}
+
+func TestImagesAreConvertedToRGBAOnce(t *testing.T) {
+	rgba := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	assert.Same(t, rgba, toRGBA(rgba))
+
+	// other formats and origins are converted to RGBA at the origin
+	nrgba := image.NewNRGBA(image.Rect(3, 3, 7, 5))
+	nrgba.Set(3, 3, color.NRGBA{R: 255, A: 128})
+	converted := toRGBA(nrgba)
+	assert.Equal(t, image.Rect(0, 0, 4, 2), converted.Bounds())
+	assert.Equal(t, color.RGBA{R: 128, A: 128}, converted.At(0, 0))
+}
+
+func TestJPEGsKeepTheirFormat(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 700, 350)), nil))
+	library := NewLibrary(NewLocalStorage(t.TempDir()), "https://example.com/", 0)
+
+	asset, err := library.Upload(context.Background(), buf.Bytes())
+	require.NoError(t, err)
+
+	assert.Equal(t, "image/jpeg", asset.ContentType)
+	require.Len(t, asset.Variants, 2)
+	assert.Equal(t, "https://example.com/assets/"+asset.Variants[1].Key, asset.Variants[1].URL)
+	content, contentType, err := library.Asset(context.Background(), asset.Variants[1].Key)
+	require.NoError(t, err)
+	assert.Equal(t, "image/jpeg", contentType)
+	config, err := jpeg.DecodeConfig(bytes.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, 640, config.Width)
+}
+
+func TestKeysCannotLeaveTheStorage(t *testing.T) {
+	library := NewLibrary(NewLocalStorage(t.TempDir()), "https://example.com", 0)
+	for _, key := range []string{"../secret", "/etc/passwd", "", "images/../../secret"} {
+		_, _, err := library.Asset(context.Background(), key)
+		assert.ErrorIs(t, err, newsletter.ErrUnknownAsset, key)
+	}
+}
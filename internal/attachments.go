@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// MaxAttachmentsSize bounds the attachments of a message. Postmark accepts
+// messages of up to 10 MB, and base64 grows attachments by a third.
+const MaxAttachmentsSize = 7 << 20
+
+// AttachmentTypes are the content types attachments may have.
+var AttachmentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/gif":       true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/webp":      true,
+	"text/calendar":   true,
+	"text/csv":        true,
+	"text/plain":      true,
+}
+
+// forbiddenExtensions are file extensions Postmark refuses to send whatever
+// their content type.
+var forbiddenExtensions = map[string]bool{
+	".bat": true, ".cmd": true, ".com": true, ".cpl": true, ".dll": true, ".exe": true,
+	".jar": true, ".js": true, ".msi": true, ".ps1": true, ".scr": true, ".sh": true,
+	".vbe": true, ".vbs": true, ".wsf": true,
+}
+
+var (
+	ErrAttachmentsTooLarge = errors.New("attachments are too large")
+	ErrInvalidAttachment   = errors.New("invalid attachment")
+)
+
+// Attachment is a file sent with a message. An attachment with a ContentID
+// is an inline image the HTML body shows with <img src="cid:ContentID">.
+type Attachment struct {
+	Name        string
+	ContentType string
+	ContentID   string
+	Content     []byte
+}
+
+// ValidateAttachments checks the attachments against the size and type
+// limits, so a message isn't refused by the provider once it is sent.
+func ValidateAttachments(attachments []Attachment) error {
+	size := 0
+	for _, attachment := range attachments {
+		if err := validateAttachment(attachment); err != nil {
+			return err
+		}
+		size += len(attachment.Content)
+	}
+	if size > MaxAttachmentsSize {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrAttachmentsTooLarge, size, MaxAttachmentsSize)
+	}
+	return nil
+}
+
+func validateAttachment(attachment Attachment) error {
+	name := attachment.Name
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("%w: name %q", ErrInvalidAttachment, name)
+	}
+	if forbiddenExtensions[strings.ToLower(path.Ext(name))] {
+		return fmt.Errorf("%w: %s files can't be sent", ErrInvalidAttachment, path.Ext(name))
+	}
+	if !AttachmentTypes[attachment.ContentType] {
+		return fmt.Errorf("%w: content type %q of %s", ErrInvalidAttachment, attachment.ContentType, name)
+	}
+	if len(attachment.Content) == 0 {
+		return fmt.Errorf("%w: %s is empty", ErrInvalidAttachment, name)
+	}
+	// images and PDFs are recognized by their content, which has to agree
+	// with the type they claim
+	if sniffed := http.DetectContentType(attachment.Content); isSniffable(attachment.ContentType) && sniffed != attachment.ContentType {
+		return fmt.Errorf("%w: %s claims to be %s but is %s", ErrInvalidAttachment, name, attachment.ContentType, sniffed)
+	}
+	if id := attachment.ContentID; id != "" {
+		if !strings.HasPrefix(attachment.ContentType, "image/") {
+			return fmt.Errorf("%w: only images can be inline, %s is %s", ErrInvalidAttachment, name, attachment.ContentType)
+		}
+		if strings.ContainsAny(id, " <>\"'") {
+			return fmt.Errorf("%w: content ID %q", ErrInvalidAttachment, id)
+		}
+	}
+	return nil
+}
+
+func isSniffable(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/") || contentType == "application/pdf"
+}
+
+// AttachmentRequest is an attachment as Postmark takes it, its content base64
+// encoded.
+type AttachmentRequest struct {
+	Name        string `json:"Name"`
+	Content     string `json:"Content"`
+	ContentType string `json:"ContentType"`
+	ContentID   string `json:"ContentID,omitempty"`
+}
+
+func attachmentRequests(attachments []Attachment) []AttachmentRequest {
+	if len(attachments) == 0 {
+		return nil
+	}
+	requests := make([]AttachmentRequest, len(attachments))
+	for i, attachment := range attachments {
+		requests[i] = AttachmentRequest{
+			Name:        attachment.Name,
+			Content:     base64.StdEncoding.EncodeToString(attachment.Content),
+			ContentType: attachment.ContentType,
+		}
+		if attachment.ContentID != "" {
+			requests[i].ContentID = "cid:" + attachment.ContentID
+		}
+	}
+	return requests
+}
@@ -2,10 +2,9 @@ package authentication
 
 import (
 	"github.com/guuzaa/email-newsletter/internal/api/middleware"
-	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/repository"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 
 	"crypto/rand"
 	"crypto/subtle"
@@ -21,13 +20,14 @@ type Credentials struct {
 	Password string
 }
 
-func (cred *Credentials) Validate(c *gin.Context, db *gorm.DB) bool {
+// Validate reports whether the user with the username exists and has the
+// password. Unknown users take as long to check as known ones.
+func (cred *Credentials) Validate(c *gin.Context, users repository.UserRepository) bool {
 	log := middleware.GetContextLogger(c)
-	var user = models.User{
-		Password: `$argon2id$v=19$m=15000,t=2,p=1$gZiV/M1gPc22ElAH/Jh1Hw$CWOrkoo7oJBQ/iyh7uJ0LO2aLEfrHwTWllSAxT0zRno`,
-	}
-	if err := db.Where("username = ?", cred.Username).First(&user).Error; err != nil {
+	user, err := users.Find(c.Request.Context(), cred.Username)
+	if err != nil {
 		log.Trace().Err(err).Str("username", cred.Username).Msg("failed to find user")
+		user.Password = `$argon2id$v=19$m=15000,t=2,p=1$gZiV/M1gPc22ElAH/Jh1Hw$CWOrkoo7oJBQ/iyh7uJ0LO2aLEfrHwTWllSAxT0zRno`
 	}
 
 	valid, err := VerifyPassword(cred.Password, user.Password)
@@ -2,32 +2,51 @@ package internal
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/caarlos0/env/v11"
 	"github.com/guuzaa/email-newsletter/internal/domain"
-	"gopkg.in/yaml.v3"
 )
 
+// Settings are the configuration of the application. Each setting has a
+// YAML path, an environment variable and a flag, see LoadConfiguration, and
+// the rules of its validate tag, see Validate. Settings with a reload tag can
+// change while the application runs, see Reload.
 type Settings struct {
 	Database    DatabaseSettings    `yaml:"database"`
 	Application ApplicationSettings `yaml:"application"`
 	EmailClient EmailClientSettings `yaml:"email_client"`
+	Scheduler   SchedulerSettings   `yaml:"scheduler"`
+	Delivery    DeliverySettings    `yaml:"delivery"`
+	Outbox      OutboxSettings      `yaml:"outbox"`
+	Webhooks    WebhookSettings     `yaml:"webhooks"`
+	Tracking    TrackingSettings    `yaml:"tracking"`
+	Assets      AssetsSettings      `yaml:"assets"`
 }
 
 type ApplicationSettings struct {
-	Port    uint16 `yaml:"port" env:"APP_PORT"`
-	Host    string `yaml:"host" env:"APP_HOST"`
-	BaseURL string `yaml:"base_url" env:"APP_BASE_URL"`
+	Port    uint16 `yaml:"port" env:"APP_PORT" validate:"required"`
+	Host    string `yaml:"host" env:"APP_HOST" validate:"required"`
+	BaseURL string `yaml:"base_url" env:"APP_BASE_URL" validate:"url"`
+	// LogLevel overrides the default level of the logs, trace or warn in
+	// release mode
+	LogLevel string `yaml:"log_level" env:"LOG_LEVEL" validate:"log_level" reload:"true"`
 }
 
 type EmailClientSettings struct {
-	BaseURL             string `yaml:"base_url" env:"APP_EMAIL_BASE_URL"`
-	SenderEmail         string `yaml:"sender_email" env:"APP_SENDER_EMAIL"`
-	AuthorizationToken  string `yaml:"authorization_token" env:"APP_EMAIL_AUTHORIZATION_TOKEN"`
-	TimeoutMilliseconds uint64 `yaml:"timeout_milliseconds" env:"APP_EMAIL_CLIENT_TIMEOUT_MILLISECONDS"`
+	BaseURL             string `yaml:"base_url" env:"APP_EMAIL_BASE_URL" validate:"required,url"`
+	SenderEmail         string `yaml:"sender_email" env:"APP_SENDER_EMAIL" validate:"required,email" reload:"true"`
+	AuthorizationToken  string `yaml:"authorization_token" env:"APP_EMAIL_AUTHORIZATION_TOKEN" secret:"true"`
+	TimeoutMilliseconds uint64 `yaml:"timeout_milliseconds" env:"APP_EMAIL_CLIENT_TIMEOUT_MILLISECONDS" validate:"positive" reload:"true"`
+	// transient failures are retried until the deadline has passed since the
+	// first attempt. Zero leaves retries to the delivery's max attempts alone.
+	RetryDeadlineMilliseconds uint64 `yaml:"retry_deadline_milliseconds" env:"APP_EMAIL_CLIENT_RETRY_DEADLINE_MILLISECONDS"`
+	// the Postmark message streams of transactional emails, like confirmations,
+	// and of broadcasts, like newsletters
+	TransactionalStream string `yaml:"transactional_stream" env:"APP_EMAIL_TRANSACTIONAL_STREAM"`
+	BroadcastStream     string `yaml:"broadcast_stream" env:"APP_EMAIL_BROADCAST_STREAM"`
 }
 
 func (ecs EmailClientSettings) Sender() (domain.SubscriberEmail, error) {
@@ -38,112 +57,236 @@ func (ecs EmailClientSettings) Timeout() time.Duration {
 	return time.Duration(ecs.TimeoutMilliseconds) * time.Millisecond
 }
 
+func (ecs EmailClientSettings) RetryDeadline() time.Duration {
+	return time.Duration(ecs.RetryDeadlineMilliseconds) * time.Millisecond
+}
+
+type SchedulerSettings struct {
+	PollIntervalMilliseconds uint64 `yaml:"poll_interval_milliseconds" env:"APP_SCHEDULER_POLL_INTERVAL_MILLISECONDS"`
+}
+
+func (ss SchedulerSettings) PollInterval() time.Duration {
+	return time.Duration(ss.PollIntervalMilliseconds) * time.Millisecond
+}
+
+// OutboxSettings paces the dispatcher of the outbox, the emails written in
+// the same transaction as the change they tell about, like confirmation
+// emails. Transient failures are retried for as long as they last, waiting
+// longer each time up to the max backoff.
+type OutboxSettings struct {
+	PollIntervalMilliseconds uint64 `yaml:"poll_interval_milliseconds" env:"APP_OUTBOX_POLL_INTERVAL_MILLISECONDS"`
+	MaxBackoffMilliseconds   uint64 `yaml:"max_backoff_milliseconds" env:"APP_OUTBOX_MAX_BACKOFF_MILLISECONDS"`
+}
+
+func (obs OutboxSettings) PollInterval() time.Duration {
+	return time.Duration(obs.PollIntervalMilliseconds) * time.Millisecond
+}
+
+func (obs OutboxSettings) MaxBackoff() time.Duration {
+	return time.Duration(obs.MaxBackoffMilliseconds) * time.Millisecond
+}
+
+// DeliverySettings sizes the delivery engine to the email provider's plan.
+// The rate limits calls to the provider, a batch counting as one call. A zero
+// rate doesn't limit sending.
+type DeliverySettings struct {
+	Workers                int     `yaml:"workers" env:"APP_DELIVERY_WORKERS" validate:"nonnegative"`
+	RatePerSecond          float64 `yaml:"rate_per_second" env:"APP_DELIVERY_RATE_PER_SECOND" validate:"nonnegative" reload:"true"`
+	Burst                  int     `yaml:"burst" env:"APP_DELIVERY_BURST" validate:"nonnegative" reload:"true"`
+	MaxAttempts            int     `yaml:"max_attempts" env:"APP_DELIVERY_MAX_ATTEMPTS" validate:"nonnegative"`
+	MinBackoffMilliseconds uint64  `yaml:"min_backoff_milliseconds" env:"APP_DELIVERY_MIN_BACKOFF_MILLISECONDS"`
+	MaxBackoffMilliseconds uint64  `yaml:"max_backoff_milliseconds" env:"APP_DELIVERY_MAX_BACKOFF_MILLISECONDS"`
+}
+
+func (ds DeliverySettings) MinBackoff() time.Duration {
+	return time.Duration(ds.MinBackoffMilliseconds) * time.Millisecond
+}
+
+func (ds DeliverySettings) MaxBackoff() time.Duration {
+	return time.Duration(ds.MaxBackoffMilliseconds) * time.Millisecond
+}
+
+// WebhookSettings protects the email provider webhooks, either with Basic auth
+// credentials, a shared secret sent in the X-Webhook-Secret header, or both.
+type WebhookSettings struct {
+	Username string `yaml:"username" env:"APP_WEBHOOK_USERNAME"`
+	Password string `yaml:"password" env:"APP_WEBHOOK_PASSWORD" secret:"true"`
+	Secret   string `yaml:"secret" env:"APP_WEBHOOK_SECRET" secret:"true"`
+}
+
+// TrackingSettings holds the key open and click tracking links are signed
+// with. Tracking is off without one.
+type TrackingSettings struct {
+	Secret string `yaml:"secret" env:"APP_TRACKING_SECRET" secret:"true"`
+}
+
+// AssetsSettings configures where uploaded images are stored and how large
+// an upload may be.
+type AssetsSettings struct {
+	Directory      string `yaml:"directory" env:"APP_ASSETS_DIRECTORY"`
+	MaxUploadBytes int64  `yaml:"max_upload_bytes" env:"APP_ASSETS_MAX_UPLOAD_BYTES" validate:"nonnegative"`
+}
+
+// DatabaseSettings connects to Postgres, either with the connection settings
+// or with the URL, which overrides them. The statement timeout and the
+// application name are added to the URL unless it sets them. A sqlite:// URL,
+// like sqlite://newsletter.db, uses the SQLite database at the path instead,
+// for development and tests without a Postgres server.
+//
+// Heavy read-only queries go to the read replicas, if there are any, with
+// the same pool and session settings. Replicas failing their health check
+// are skipped until they pass it again.
 type DatabaseSettings struct {
-	Username     string `yaml:"username" env:"APP_DB_USERNAME"`
-	Password     string `yaml:"password" env:"APP_DB_PASSWORD"`
-	Port         uint16 `yaml:"port" env:"APP_DB_PORT"`
-	Host         string `yaml:"host" env:"APP_DB_HOST"`
-	DatabaseName string `yaml:"database_name" env:"APP_DB_NAME"`
-	RequireSSL   bool   `yaml:"require_ssl" env:"APP_DB_REQUIRE_SSL"`
+	URL string `yaml:"url" env:"DATABASE_URL" secret:"true"`
+	// ReplicaURLs are the URLs of the read replicas, comma separated in the
+	// environment variable and the flag
+	ReplicaURLs []string `yaml:"replica_urls" env:"APP_DB_REPLICA_URLS" secret:"true"`
+	// ReplicaCheckIntervalMilliseconds is how often the replicas' health is
+	// checked, every 5 seconds if zero
+	ReplicaCheckIntervalMilliseconds uint64 `yaml:"replica_check_interval_milliseconds" env:"APP_DB_REPLICA_CHECK_INTERVAL_MILLISECONDS"`
+	Username                         string `yaml:"username" env:"APP_DB_USERNAME" validate:"required_without=database.url"`
+	Password                         string `yaml:"password" env:"APP_DB_PASSWORD" secret:"true" validate:"required_without=database.url"`
+	Port                             uint16 `yaml:"port" env:"APP_DB_PORT" validate:"required_without=database.url"`
+	Host                             string `yaml:"host" env:"APP_DB_HOST" validate:"required_without=database.url"`
+	DatabaseName                     string `yaml:"database_name" env:"APP_DB_NAME" validate:"required_without=database.url"`
+	// RequireSSL is short for the require SSL mode, SSLMode overrides it
+	RequireSSL bool   `yaml:"require_ssl" env:"APP_DB_REQUIRE_SSL"`
+	SSLMode    string `yaml:"ssl_mode" env:"APP_DB_SSL_MODE" validate:"oneof=disable allow prefer require verify-ca verify-full"`
+	// the paths of the CA certificate the server's is verified with, and of
+	// the client certificate and its key
+	SSLRootCert string `yaml:"ssl_root_cert" env:"APP_DB_SSL_ROOT_CERT"`
+	SSLCert     string `yaml:"ssl_cert" env:"APP_DB_SSL_CERT"`
+	SSLKey      string `yaml:"ssl_key" env:"APP_DB_SSL_KEY"`
+	// the connection pool. Zero open connections are unlimited, zero idle
+	// connections keep the driver's default, and zero durations never
+	// close a connection.
+	MaxOpenConnections          int    `yaml:"max_open_connections" env:"APP_DB_MAX_OPEN_CONNECTIONS" validate:"nonnegative"`
+	MaxIdleConnections          int    `yaml:"max_idle_connections" env:"APP_DB_MAX_IDLE_CONNECTIONS" validate:"nonnegative"`
+	ConnMaxLifetimeMilliseconds uint64 `yaml:"conn_max_lifetime_milliseconds" env:"APP_DB_CONN_MAX_LIFETIME_MILLISECONDS"`
+	ConnMaxIdleTimeMilliseconds uint64 `yaml:"conn_max_idle_time_milliseconds" env:"APP_DB_CONN_MAX_IDLE_TIME_MILLISECONDS"`
+	// StatementTimeoutMilliseconds aborts statements running longer, zero
+	// lets them run
+	StatementTimeoutMilliseconds uint64 `yaml:"statement_timeout_milliseconds" env:"APP_DB_STATEMENT_TIMEOUT_MILLISECONDS"`
+	// ApplicationName names the connections in pg_stat_activity
+	ApplicationName string `yaml:"application_name" env:"APP_DB_APPLICATION_NAME"`
 }
 
-func (setting Settings) PostgresSQLDSN() string {
-	sslMode := "disable"
-	if setting.Database.RequireSSL {
-		sslMode = "require"
-	}
-	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s", setting.Database.Host, setting.Database.Username, setting.Database.Password, setting.Database.DatabaseName, setting.Database.Port, sslMode)
+func (ds DatabaseSettings) ConnMaxLifetime() time.Duration {
+	return time.Duration(ds.ConnMaxLifetimeMilliseconds) * time.Millisecond
 }
 
-func (setting *Settings) Valid() bool {
-	return setting.Application.Host != "" && setting.Application.Port != 0 &&
-		setting.Database.Host != "" && setting.Database.Port != 0 &&
-		setting.Database.Username != "" && setting.Database.Password != "" &&
-		setting.Database.DatabaseName != ""
+func (ds DatabaseSettings) ConnMaxIdleTime() time.Duration {
+	return time.Duration(ds.ConnMaxIdleTimeMilliseconds) * time.Millisecond
 }
 
-func (setting Settings) Address() string {
-	return fmt.Sprintf("%s:%d", setting.Application.Host, setting.Application.Port)
+// SQLite is the path of the SQLite database of a sqlite:// URL. It is false
+// for Postgres.
+func (ds DatabaseSettings) SQLite() (string, bool) {
+	return strings.CutPrefix(ds.URL, sqliteScheme)
 }
 
-// mergeSettings combines the settings from the target into the base settings
-// only if they are not empty or zero values
-func mergeSettings(base, overlay Settings) Settings {
-	result := base
+const sqliteScheme = "sqlite://"
 
-	if overlay.Database.Host != "" {
-		result.Database.Host = overlay.Database.Host
-	}
-	if overlay.Database.Port != 0 {
-		result.Database.Port = overlay.Database.Port
-	}
-	if overlay.Database.Username != "" {
-		result.Database.Username = overlay.Database.Username
-	}
-	if overlay.Database.Password != "" {
-		result.Database.Password = overlay.Database.Password
-	}
-	if overlay.Database.DatabaseName != "" {
-		result.Database.DatabaseName = overlay.Database.DatabaseName
-	}
-	if overlay.Database.RequireSSL {
-		result.Database.RequireSSL = overlay.Database.RequireSSL
+func (ds DatabaseSettings) ReplicaCheckInterval() time.Duration {
+	return time.Duration(ds.ReplicaCheckIntervalMilliseconds) * time.Millisecond
+}
+
+// ReplicaDSNs are the data source names of the read replicas.
+func (ds DatabaseSettings) ReplicaDSNs() []string {
+	dsns := make([]string, len(ds.ReplicaURLs))
+	for i, replica := range ds.ReplicaURLs {
+		dsns[i] = ds.urlDSN(replica)
 	}
+	return dsns
+}
 
-	if overlay.Application.Port != 0 {
-		result.Application.Port = overlay.Application.Port
+// sslMode is the SSL mode of the connections, disable unless set.
+func (ds DatabaseSettings) sslMode() string {
+	switch {
+	case ds.SSLMode != "":
+		return ds.SSLMode
+	case ds.RequireSSL:
+		return "require"
 	}
-	if overlay.Application.Host != "" {
-		result.Application.Host = overlay.Application.Host
+	return "disable"
+}
+
+// runtimeParameters are the settings of each session, set when connecting.
+func (ds DatabaseSettings) runtimeParameters() [][2]string {
+	var params [][2]string
+	if ds.ApplicationName != "" {
+		params = append(params, [2]string{"application_name", ds.ApplicationName})
 	}
-	if overlay.Application.BaseURL != "" {
-		result.Application.BaseURL = overlay.Application.BaseURL
+	if ds.StatementTimeoutMilliseconds > 0 {
+		params = append(params, [2]string{"statement_timeout", strconv.FormatUint(ds.StatementTimeoutMilliseconds, 10)})
 	}
+	return params
+}
 
-	if overlay.EmailClient.BaseURL != "" {
-		result.EmailClient.BaseURL = overlay.EmailClient.BaseURL
+// PostgresSQLDSN is the data source name of the database: the URL if there is
+// one, or else the keyword/value connection string of the settings.
+func (setting Settings) PostgresSQLDSN() string {
+	db := setting.Database
+	if db.URL != "" {
+		return db.urlDSN(db.URL)
 	}
-	if overlay.EmailClient.SenderEmail != "" {
-		result.EmailClient.SenderEmail = overlay.EmailClient.SenderEmail
+	params := [][2]string{
+		{"host", db.Host},
+		{"user", db.Username},
+		{"password", db.Password},
+		{"dbname", db.DatabaseName},
+		{"port", strconv.Itoa(int(db.Port))},
+		{"sslmode", db.sslMode()},
 	}
-	if overlay.EmailClient.AuthorizationToken != "" {
-		result.EmailClient.AuthorizationToken = overlay.EmailClient.AuthorizationToken
+	for _, param := range [][2]string{{"sslrootcert", db.SSLRootCert}, {"sslcert", db.SSLCert}, {"sslkey", db.SSLKey}} {
+		if param[1] != "" {
+			params = append(params, param)
+		}
 	}
-	if overlay.EmailClient.TimeoutMilliseconds != 0 {
-		result.EmailClient.TimeoutMilliseconds = overlay.EmailClient.TimeoutMilliseconds
+	params = append(params, db.runtimeParameters()...)
+	pairs := make([]string, len(params))
+	for i, param := range params {
+		pairs[i] = param[0] + "=" + quoteDSNValue(param[1])
 	}
-
-	return result
+	return strings.Join(pairs, " ")
 }
 
-func Configuration(path string) (Settings, error) {
-	var settings Settings
-	logger := Logger()
-
-	baseFilePath := filepath.Join(path, "base.yaml")
-	data, err := os.ReadFile(baseFilePath)
-	if err == nil {
-		yaml.Unmarshal(data, &settings)
+// urlDSN adds the runtime parameters the URL doesn't set to it. A URL that
+// can't be parsed is left for the driver to report.
+func (ds DatabaseSettings) urlDSN(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return raw
 	}
-
-	environment := ParseEnvironment(os.Getenv("APP_ENVIRONMENT"))
-	envFilePath := filepath.Join(path, fmt.Sprintf("%s.yaml", environment.String()))
-	data, err = os.ReadFile(envFilePath)
-	var envSettings Settings
-	if err == nil {
-		yaml.Unmarshal(data, &envSettings)
+	query := u.Query()
+	for _, param := range ds.runtimeParameters() {
+		if !query.Has(param[0]) {
+			query.Set(param[0], param[1])
+		}
 	}
-	settings = mergeSettings(settings, envSettings)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
 
-	var envVarSettings Settings
-	if err := env.Parse(&envVarSettings); err != nil {
-		logger.Debug().Err(err).Msg("failed to parse environment variables")
+// quoteDSNValue quotes a value of a keyword/value connection string if it is
+// empty or has spaces, quotes or backslashes.
+func quoteDSNValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
 	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+func (setting Settings) Address() string {
+	return fmt.Sprintf("%s:%d", setting.Application.Host, setting.Application.Port)
+}
 
-	settings = mergeSettings(settings, envVarSettings)
-	if !settings.Valid() {
-		logger.Error().Msg("missing required settings")
-		return settings, fmt.Errorf("missing required settings")
+// Configuration loads the settings from the configuration files in the
+// directory and the environment variables, see LoadConfiguration.
+func Configuration(path string) (Settings, error) {
+	loaded, err := LoadConfiguration(path, nil)
+	if err != nil {
+		return Settings{}, err
 	}
-	return settings, nil
+	return loaded.Settings, nil
 }
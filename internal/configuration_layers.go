@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Layer is where the value of a setting came from. Each layer overrides the
+// ones before it, for the settings it sets.
+type Layer int
+
+const (
+	LayerUnset Layer = iota
+	LayerBaseFile
+	LayerEnvironmentFile
+	LayerEnvironmentVariable
+	LayerFlag
+)
+
+func (l Layer) String() string {
+	switch l {
+	case LayerBaseFile:
+		return "base file"
+	case LayerEnvironmentFile:
+		return "environment file"
+	case LayerEnvironmentVariable:
+		return "environment variable"
+	case LayerFlag:
+		return "flag"
+	default:
+		return "unset"
+	}
+}
+
+// redacted replaces the values of secret settings in dumps.
+const redacted = "[redacted]"
+
+// Origin is the layer a setting was set by, and the file, environment
+// variable or flag within it.
+type Origin struct {
+	Layer Layer
+	Name  string
+}
+
+func (o Origin) String() string {
+	if o.Layer == LayerUnset {
+		return o.Layer.String()
+	}
+	return fmt.Sprintf("%s %s", o.Layer, o.Name)
+}
+
+// setting is a leaf of Settings: its YAML path like database.port, which is
+// also the name of its flag, its environment variable, and the field.
+type setting struct {
+	path   string
+	env    string
+	secret bool
+	reload bool
+	rules  string
+	value  reflect.Value
+}
+
+// settingsOf lists the settings of s, in the order of their fields.
+func settingsOf(s *Settings) []setting {
+	var result []setting
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			path := prefix + name
+			if field.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), path+".")
+				continue
+			}
+			result = append(result, setting{
+				path:   path,
+				env:    field.Tag.Get("env"),
+				secret: field.Tag.Get("secret") == "true",
+				reload: field.Tag.Get("reload") == "true",
+				rules:  field.Tag.Get("validate"),
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(s).Elem(), "")
+	return result
+}
+
+// set parses the text into the setting.
+func (s setting) set(text string) error {
+	v := s.value
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(text, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(text, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		// lists are comma separated outside of YAML
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported setting type %s", v.Type())
+		}
+		v.Set(reflect.ValueOf(strings.Split(text, ",")))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// display quotes a value of the setting for messages, secrets are redacted.
+func (s setting) display(value string) string {
+	if s.secret {
+		return redacted
+	}
+	return strconv.Quote(value)
+}
+
+func (s setting) String() string {
+	if s.secret && !s.value.IsZero() {
+		return redacted
+	}
+	if s.value.Kind() == reflect.String {
+		return strconv.Quote(s.value.String())
+	}
+	return fmt.Sprint(s.value.Interface())
+}
+
+// LoadedSettings are the settings with the origin of each value.
+type LoadedSettings struct {
+	Settings
+	origins map[string]Origin
+}
+
+// Origin is where the setting with the YAML path, like database.port, was
+// set. Its layer is LayerUnset for settings no layer set.
+func (l *LoadedSettings) Origin(path string) Origin {
+	return l.origins[path]
+}
+
+// Dump lists every setting with its value and origin, one per line. The
+// values of secrets are redacted.
+func (l *LoadedSettings) Dump() string {
+	var b strings.Builder
+	for _, s := range settingsOf(&l.Settings) {
+		fmt.Fprintf(&b, "%s = %s  # %s\n", s.path, s.String(), l.origins[s.path])
+	}
+	return b.String()
+}
+
+// LoadConfiguration loads the settings in layers: base.yaml in the directory,
+// then the file of the APP_ENVIRONMENT, then the environment variables, then
+// the flags in args. A layer only overrides the settings it sets, even to
+// their zero value, so a file can turn off what the base turned on.
+//
+// Malformed YAML and flags fail right away. Values that can't be parsed and
+// settings that aren't valid are collected, and returned joined as
+// SettingErrors. The settings are returned even if they are invalid, for them
+// to be dumped.
+func LoadConfiguration(path string, args []string) (*LoadedSettings, error) {
+	loaded := &LoadedSettings{origins: map[string]Origin{}}
+	settings := settingsOf(&loaded.Settings)
+	var errs []error
+
+	environment := ParseEnvironment(os.Getenv("APP_ENVIRONMENT"))
+	files := []struct {
+		layer Layer
+		name  string
+	}{
+		{LayerBaseFile, "base.yaml"},
+		{LayerEnvironmentFile, environment.String() + ".yaml"},
+	}
+	for _, file := range files {
+		fileErrs, err := loaded.loadFile(settings, file.layer, filepath.Join(path, file.name))
+		if err != nil {
+			return loaded, err
+		}
+		errs = append(errs, fileErrs...)
+	}
+
+	for _, s := range settings {
+		if err := loaded.loadEnv(s); err != nil {
+			errs = append(errs, s.error(err))
+		}
+	}
+
+	if err := loaded.parseFlags(settings, args); err != nil {
+		return loaded, err
+	}
+	errs = append(errs, validationErrors(&loaded.Settings)...)
+	if err := errors.Join(errs...); err != nil {
+		logger := Logger()
+		logger.Error().Err(err).Msg("invalid settings")
+		return loaded, err
+	}
+	return loaded, nil
+}
+
+// loadEnv sets the setting from its environment variable, or from the file
+// the variable with the _FILE suffix names, like APP_DB_PASSWORD_FILE. Empty
+// variables count as unset.
+func (l *LoadedSettings) loadEnv(s setting) error {
+	if s.env == "" {
+		return nil
+	}
+	name := s.env
+	value := os.Getenv(name)
+	if file := os.Getenv(s.env + "_FILE"); file != "" {
+		if value != "" {
+			return fmt.Errorf("both %s and %s_FILE are set", s.env, s.env)
+		}
+		name = s.env + "_FILE"
+		var err error
+		if value, err = readSecretFile(file); err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+	}
+	if value == "" {
+		return nil
+	}
+	if err := s.set(value); err != nil {
+		return fmt.Errorf("invalid value %s in %s: %w", s.display(value), name, err)
+	}
+	l.origins[s.path] = Origin{Layer: LayerEnvironmentVariable, Name: name}
+	return nil
+}
+
+// loadFile sets the settings the YAML file has a value for, resolving
+// secret references like file:///run/secrets/x. A missing file sets
+// nothing. It returns the errors of values that don't fit their setting,
+// and fails if the file isn't valid YAML.
+func (l *LoadedSettings) loadFile(settings []setting, layer Layer, path string) ([]error, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("malformed configuration file %s: %w", path, err)
+	}
+	if len(document.Content) == 0 {
+		return nil, nil
+	}
+	var errs []error
+	for _, s := range settings {
+		node := lookup(document.Content[0], strings.Split(s.path, "."))
+		if node == nil {
+			continue
+		}
+		origin := Origin{Layer: layer, Name: path}
+		resolved, isReference, err := resolveSecret(node.Value)
+		switch {
+		case err != nil:
+			errs = append(errs, s.error(err))
+			continue
+		case isReference:
+			if err := s.set(resolved); err != nil {
+				errs = append(errs, s.error(fmt.Errorf("invalid value of %s: %w", node.Value, err)))
+				continue
+			}
+			origin.Name += " " + node.Value
+		default:
+			if err := node.Decode(s.value.Addr().Interface()); err != nil {
+				errs = append(errs, s.error(fmt.Errorf("invalid value in %s line %d: %s", path, node.Line, s.display(node.Value))))
+				continue
+			}
+		}
+		l.origins[s.path] = origin
+	}
+	return errs, nil
+}
+
+// lookup finds the node at the path of mapping keys, nil if there is none. A
+// key with a null value, like `port:` or `port: ~`, counts as unset.
+func lookup(node *yaml.Node, path []string) *yaml.Node {
+	for _, key := range path {
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				next = node.Content[i+1]
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		node = next
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return nil
+	}
+	return node
+}
+
+// parseFlags sets the settings given as flags, named by their YAML path like
+// --database.port=5433.
+func (l *LoadedSettings) parseFlags(settings []setting, args []string) error {
+	flags := flag.NewFlagSet("email-newsletter", flag.ContinueOnError)
+	for _, s := range settings {
+		usage := "sets " + s.path
+		if s.env != "" {
+			usage += ", overriding " + s.env
+		}
+		flags.Var(&settingFlag{setting: s, origins: l.origins}, s.path, usage)
+	}
+	return flags.Parse(args)
+}
+
+// settingFlag is the flag.Value of a setting.
+type settingFlag struct {
+	setting
+	origins map[string]Origin
+}
+
+func (f *settingFlag) Set(text string) error {
+	if err := f.set(text); err != nil {
+		return err
+	}
+	f.origins[f.path] = Origin{Layer: LayerFlag, Name: "--" + f.path}
+	return nil
+}
+
+func (f *settingFlag) String() string {
+	// the flag package calls String on a zero value for its usage message
+	if !f.value.IsValid() {
+		return ""
+	}
+	return f.setting.String()
+}
+
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.value.IsValid() && f.value.Kind() == reflect.Bool
+}
@@ -0,0 +1,25 @@
+package internal
+
+import "reflect"
+
+// Reload compares settings loaded again, like on SIGHUP, with the ones the
+// application runs with. It returns the running settings with the changes of
+// the settings that have a reload tag, and the YAML paths of the settings
+// that changed: those applied, and those left out because they only take
+// effect after a restart.
+func (setting Settings) Reload(next Settings) (reloaded Settings, applied, restart []string) {
+	reloaded = setting
+	current := settingsOf(&reloaded)
+	for i, s := range settingsOf(&next) {
+		if reflect.DeepEqual(current[i].value.Interface(), s.value.Interface()) {
+			continue
+		}
+		if !s.reload {
+			restart = append(restart, s.path)
+			continue
+		}
+		current[i].value.Set(s.value)
+		applied = append(applied, s.path)
+	}
+	return reloaded, applied, restart
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SecretResolver resolves the reference of a secret, what follows the scheme
+// in a value like file:///run/secrets/db_password, to the secret.
+type SecretResolver func(reference string) (string, error)
+
+var (
+	secretResolversMu sync.RWMutex
+	secretResolvers   = map[string]SecretResolver{
+		"file": readSecretFile,
+		"env":  lookupSecretEnv,
+	}
+)
+
+// RegisterSecretResolver resolves values of configuration files that start
+// with scheme:// through the resolver, such as the references of a secret
+// manager. file:// and env:// are built in.
+func RegisterSecretResolver(scheme string, resolver SecretResolver) {
+	secretResolversMu.Lock()
+	defer secretResolversMu.Unlock()
+	secretResolvers[scheme] = resolver
+}
+
+// resolveSecret resolves the value if it is a reference with a registered
+// scheme, and reports whether it was one.
+func resolveSecret(value string) (string, bool, error) {
+	scheme, reference, ok := strings.Cut(value, "://")
+	if !ok {
+		return value, false, nil
+	}
+	secretResolversMu.RLock()
+	resolve, ok := secretResolvers[scheme]
+	secretResolversMu.RUnlock()
+	if !ok {
+		return value, false, nil
+	}
+	secret, err := resolve(reference)
+	if err != nil {
+		return "", true, fmt.Errorf("failed to resolve %s: %w", value, err)
+	}
+	return secret, true, nil
+}
+
+// readSecretFile reads a secret from a file, such as a Docker or Kubernetes
+// secret, without the line break files tend to end with.
+func readSecretFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func lookupSecretEnv(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("%s is not set", name)
+	}
+	return value, nil
+}
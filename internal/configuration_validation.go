@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/rs/zerolog"
+)
+
+// SettingError is a setting that couldn't be loaded or breaks a rule of its
+// validate tag, named by its YAML path and environment variable.
+type SettingError struct {
+	Path string
+	Env  string
+	Err  error
+}
+
+func (e *SettingError) Error() string {
+	if e.Env == "" {
+		return fmt.Sprintf("%s: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("%s (%s): %v", e.Path, e.Env, e.Err)
+}
+
+func (e *SettingError) Unwrap() error {
+	return e.Err
+}
+
+// Validate checks every setting against the comma separated rules of its
+// validate tag:
+//
+//   - required: the setting is not its zero value
+//   - required_without=path: required unless the setting at the path is set
+//   - positive: the number is greater than zero
+//   - nonnegative: the number is zero or greater
+//   - url: the setting is empty or an absolute http or https URL
+//   - email: the setting is empty or an email address
+//   - log_level: the setting is empty or a log level like debug or warn
+//   - oneof=a b c: the setting is empty or one of the space separated values
+//
+// It returns a SettingError for each setting that breaks a rule, joined.
+func (setting *Settings) Validate() error {
+	return errors.Join(validationErrors(setting)...)
+}
+
+func validationErrors(settings *Settings) []error {
+	var errs []error
+	all := settingsOf(settings)
+	byPath := make(map[string]setting, len(all))
+	for _, s := range all {
+		byPath[s.path] = s
+	}
+	for _, s := range all {
+		if err := s.validate(byPath); err != nil {
+			errs = append(errs, s.error(err))
+		}
+	}
+	return errs
+}
+
+// validate checks the setting against its rules. Rules that depend on other
+// settings find them by path in settings.
+func (s setting) validate(settings map[string]setting) error {
+	v := s.value
+	for _, rule := range strings.Split(s.rules, ",") {
+		rule, param, _ := strings.Cut(rule, "=")
+		switch rule {
+		case "":
+		case "required":
+			if v.IsZero() {
+				return errors.New("must be set")
+			}
+		case "required_without":
+			other, ok := settings[param]
+			if !ok {
+				return fmt.Errorf("unknown setting %q in rule %s", param, rule)
+			}
+			if v.IsZero() && other.value.IsZero() {
+				return fmt.Errorf("must be set unless %s is", param)
+			}
+		case "oneof":
+			if v.String() != "" && !slices.Contains(strings.Fields(param), v.String()) {
+				return fmt.Errorf("must be one of %s, is %s", param, s.display(v.String()))
+			}
+		case "positive", "nonnegative":
+			if sign(v) < 0 || (rule == "positive" && sign(v) == 0) {
+				return fmt.Errorf("must be %s, is %v", rule, v.Interface())
+			}
+		case "url":
+			if v.String() == "" {
+				continue
+			}
+			u, err := url.Parse(v.String())
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("must be an http or https URL, is %s", s.display(v.String()))
+			}
+		case "email":
+			if v.String() == "" {
+				continue
+			}
+			if _, err := domain.SubscriberEmailFrom(v.String()); err != nil {
+				return fmt.Errorf("must be an email address, is %s", s.display(v.String()))
+			}
+		case "log_level":
+			if v.String() == "" {
+				continue
+			}
+			if _, err := zerolog.ParseLevel(v.String()); err != nil {
+				return fmt.Errorf("must be a log level, is %s", s.display(v.String()))
+			}
+		default:
+			return fmt.Errorf("unknown validation rule %q", rule)
+		}
+	}
+	return nil
+}
+
+// sign is -1, 0 or 1 for negative, zero and positive numbers.
+func sign(v reflect.Value) int {
+	var f float64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		f = v.Float()
+	}
+	switch {
+	case f < 0:
+		return -1
+	case f > 0:
+		return 1
+	}
+	return 0
+}
+
+func (s setting) error(err error) *SettingError {
+	return &SettingError{Path: s.path, Env: s.env, Err: err}
+}
@@ -0,0 +1,14 @@
+package models
+
+// IssueAttachment is a file sent with every email of an issue. One with a
+// ContentID is an inline image of the issue's HTML.
+type IssueAttachment struct {
+	ID                string `gorm:"column:attachment_id;not null;primaryKey;type:uuid"`
+	NewsletterIssueID string `gorm:"column:newsletter_issue_id;not null;type:uuid;index"`
+	// Position keeps the attachments in the order they were given
+	Position    int    `gorm:"column:position;not null"`
+	Name        string `gorm:"column:name;not null"`
+	ContentType string `gorm:"column:content_type;not null"`
+	ContentID   string `gorm:"column:content_id;not null;default:''"`
+	Content     []byte `gorm:"column:content;not null"`
+}
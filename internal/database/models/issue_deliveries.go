@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// IssueDelivery is the outcome of sending an issue to one recipient.
+type IssueDelivery struct {
+	ID                string `gorm:"column:delivery_id;not null;primaryKey;type:uuid"`
+	NewsletterIssueID string `gorm:"column:newsletter_issue_id;not null;type:uuid;index:idx_issue_deliveries_issue_status"`
+	SubscriptionID    string `gorm:"column:subscription_id;type:uuid;default:null"`
+	Email             string `gorm:"column:email;not null;index"`
+	Status            string `gorm:"column:status;not null;index:idx_issue_deliveries_issue_status"`
+	Error             string `gorm:"column:error;not null;default:''"`
+	// MessageID is the ID the provider gave the email, its webhooks refer to it
+	MessageID string    `gorm:"column:message_id;not null;default:'';index"`
+	CreatedAt time.Time `gorm:"column:created_at;not null"`
+	UpdatedAt time.Time `gorm:"column:updated_at;not null"`
+}
+
+const (
+	DeliveryStatusSent      = "sent"
+	DeliveryStatusDelivered = "delivered"
+	DeliveryStatusFailed    = "failed"
+	DeliveryStatusBounced   = "bounced"
+)
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+type IssueDeliveryTask struct {
+	NewsletterIssueID string    `gorm:"column:newsletter_issue_id;not null;primaryKey;type:uuid"`
+	SubscriberEmail   string    `gorm:"column:subscriber_email;not null;primaryKey"`
+	ExecuteAfter      time.Time `gorm:"column:execute_after;not null;index"`
+	NRetries          int       `gorm:"column:n_retries;not null;default:0"`
+}
+
+func (IssueDeliveryTask) TableName() string {
+	return "issue_delivery_queue"
+}
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+type ListSubscription struct {
+	SubscriptionID string     `gorm:"column:subscription_id;not null;primaryKey;type:uuid"`
+	ListID         string     `gorm:"column:list_id;not null;primaryKey;type:uuid;index:idx_list_subscriptions_list_status"`
+	Status         string     `gorm:"column:status;not null;index:idx_list_subscriptions_list_status"`
+	SubscribedAt   time.Time  `gorm:"column:subscribed_at;not null"`
+	ConfirmedAt    *time.Time `gorm:"column:confirmed_at"`
+}
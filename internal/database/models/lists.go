@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+type List struct {
+	ID          string    `gorm:"column:list_id;not null;primaryKey;type:uuid"`
+	Slug        string    `gorm:"column:slug;not null;uniqueIndex"`
+	Name        string    `gorm:"column:name;not null"`
+	Description string    `gorm:"column:description;not null;default:''"`
+	CreatedAt   time.Time `gorm:"column:created_at;not null"`
+}
+
+// DefaultListSlug identifies the list used when a request names no list.
+const DefaultListSlug = "newsletter"
@@ -0,0 +1,6 @@
+package models
+
+type NewsletterIssueList struct {
+	NewsletterIssueID string `gorm:"column:newsletter_issue_id;not null;primaryKey;type:uuid"`
+	ListID            string `gorm:"column:list_id;not null;primaryKey;type:uuid"`
+}
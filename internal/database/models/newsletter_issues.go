@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+type NewsletterIssue struct {
+	ID                string     `gorm:"column:newsletter_issue_id;not null;primaryKey;type:uuid"`
+	Title             string     `gorm:"column:title;not null"`
+	Slug              string     `gorm:"column:slug;uniqueIndex"`
+	TextContent       string     `gorm:"column:text_content;not null"`
+	HtmlContent       string     `gorm:"column:html_content;not null"`
+	Status            string     `gorm:"column:status;not null;index"`
+	TimeZone          string     `gorm:"column:time_zone;not null;default:UTC"`
+	RecipientTimeZone bool       `gorm:"column:recipient_time_zone;not null;default:false"`
+	SendAt            *time.Time `gorm:"column:send_at"`
+	StartsAt          *time.Time `gorm:"column:starts_at;index"`
+	CreatedAt         time.Time  `gorm:"column:created_at;not null"`
+	PublishedAt       *time.Time `gorm:"column:published_at"`
+	Tracking          bool       `gorm:"column:tracking;not null;default:false"`
+	// Templated issues personalize their title and content with template
+	// actions like {{.Name}}, the others are sent as they are written
+	Templated bool `gorm:"column:templated;not null;default:false"`
+}
+
+const (
+	IssueStatusScheduled = "scheduled"
+	IssueStatusSending   = "sending"
+	IssueStatusSent      = "sent"
+	IssueStatusCancelled = "cancelled"
+	IssueStatusFailed    = "failed"
+)
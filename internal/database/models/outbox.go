@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// OutboxMessage is a transactional email stored in the same transaction as
+// the change it tells about, and sent once that is committed. It stays until
+// the email provider accepted it, ExecuteAfter is when to try next.
+type OutboxMessage struct {
+	ID           string    `gorm:"column:outbox_message_id;not null;primaryKey;type:uuid"`
+	Recipient    string    `gorm:"column:recipient;not null"`
+	Subject      string    `gorm:"column:subject;not null"`
+	HtmlBody     string    `gorm:"column:html_body;not null"`
+	TextBody     string    `gorm:"column:text_body;not null"`
+	CreatedAt    time.Time `gorm:"column:created_at;not null"`
+	ExecuteAfter time.Time `gorm:"column:execute_after;not null;index"`
+	NRetries     int       `gorm:"column:n_retries;not null;default:0"`
+}
+
+func (OutboxMessage) TableName() string {
+	return "outbox"
+}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// SubscriptionAuditEntry records one change a subscriber made, or that was
+// made on their behalf.
+type SubscriptionAuditEntry struct {
+	ID             string    `gorm:"column:audit_entry_id;not null;primaryKey;type:uuid"`
+	SubscriptionID string    `gorm:"column:subscription_id;not null;type:uuid;index"`
+	Action         string    `gorm:"column:action;not null"`
+	OldValue       string    `gorm:"column:old_value;not null"`
+	NewValue       string    `gorm:"column:new_value;not null"`
+	Source         string    `gorm:"column:source;not null"`
+	CreatedAt      time.Time `gorm:"column:created_at;not null"`
+	// NewsletterIssueID is the issue whose preferences link led to the
+	// change, if any.
+	NewsletterIssueID string `gorm:"column:newsletter_issue_id;type:uuid;default:null;index"`
+}
+
+func (SubscriptionAuditEntry) TableName() string {
+	return "subscription_audit_log"
+}
+
+const (
+	AuditActionNameChanged      = "name_changed"
+	AuditActionListSubscribed   = "list_subscribed"
+	AuditActionListUnsubscribed = "list_unsubscribed"
+	AuditActionFrequencyChanged = "frequency_changed"
+	AuditActionPaused           = "paused"
+	AuditActionResumed          = "resumed"
+	AuditActionUnsubscribedAll  = "unsubscribed_all"
+	AuditActionBounced          = "bounced"
+	AuditActionComplained       = "complained"
+	AuditActionReactivated      = "reactivated"
+	AuditActionTrackingChanged  = "tracking_changed"
+)
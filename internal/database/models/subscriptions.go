@@ -7,10 +7,29 @@ type Subscription struct {
 	Email        string    `gorm:"column:email;not null;unique" form:"email"`
 	Name         string    `gorm:"column:name;not null" form:"name"`
 	SubscribedAt time.Time `gorm:"column:subscribed_at;not null"`
-	Status       string    `gorm:"column:status"`
+	// Status is the state of the email address rather than of a
+	// subscription: pending until the address is verified by confirming any
+	// list, confirmed once it is, unsubscribed once it left every list, or
+	// bounced or complained. Whether a list is sent to is up to the status of
+	// its ListSubscription.
+	Status           string     `gorm:"column:status"`
+	TimeZone         string     `gorm:"column:time_zone" form:"time_zone"`
+	PreferencesToken string     `gorm:"column:preferences_token;uniqueIndex;default:null"`
+	Frequency        string     `gorm:"column:frequency;not null;default:instant"`
+	PausedUntil      *time.Time `gorm:"column:paused_until"`
+	LastDigestAt     *time.Time `gorm:"column:last_digest_at"`
+	NextDigestAt     *time.Time `gorm:"column:next_digest_at;index"`
+	TrackingOptOut   bool       `gorm:"column:tracking_opt_out;not null;default:false"`
 }
 
 const (
+	// SubscriptionStatusConfirmed marks a confirmed list subscription, or an
+	// email address that was verified.
 	SubscriptionStatusConfirmed = "confirmed"
 	SubscriptionStatusPending   = "pending_confirmation"
+	// SubscriptionStatusUnsubscribed marks a subscriber who left every list,
+	// or a single list subscription that was cancelled.
+	SubscriptionStatusUnsubscribed = "unsubscribed"
+	SubscriptionStatusBounced      = "bounced"
+	SubscriptionStatusComplained   = "complained"
 )
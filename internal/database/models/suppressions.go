@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// Suppression blocks every email to an address.
+type Suppression struct {
+	Email     string    `gorm:"column:email;not null;primaryKey"`
+	Reason    string    `gorm:"column:reason;not null"`
+	Source    string    `gorm:"column:source;not null"`
+	CreatedAt time.Time `gorm:"column:created_at;not null"`
+}
+
+const (
+	SuppressionReasonHardBounce    = "hard_bounce"
+	SuppressionReasonSpamComplaint = "spam_complaint"
+	SuppressionReasonUnsubscribed  = "unsubscribed"
+	SuppressionReasonManual        = "manual"
+
+	SuppressionSourcePostmark = "postmark"
+	SuppressionSourceAdmin    = "admin"
+	SuppressionSourceImport   = "import"
+)
+
+// SuppressionReasons are the reasons an address can be suppressed for.
+var SuppressionReasons = []string{
+	SuppressionReasonHardBounce,
+	SuppressionReasonSpamComplaint,
+	SuppressionReasonUnsubscribed,
+	SuppressionReasonManual,
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// TrackingEvent is an open or a click of a tracked issue by a subscriber.
+type TrackingEvent struct {
+	ID                string    `gorm:"column:tracking_event_id;not null;primaryKey;type:uuid"`
+	NewsletterIssueID string    `gorm:"column:newsletter_issue_id;not null;type:uuid;index:idx_tracking_events_issue_kind"`
+	SubscriptionID    string    `gorm:"column:subscription_id;not null;type:uuid;index"`
+	Kind              string    `gorm:"column:kind;not null;index:idx_tracking_events_issue_kind"`
+	URL               string    `gorm:"column:url;not null;default:''"`
+	CreatedAt         time.Time `gorm:"column:created_at;not null"`
+}
+
+const (
+	TrackingEventOpen  = "open"
+	TrackingEventClick = "click"
+)
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultReplicaCheckInterval = 5 * time.Second
+	replicaCheckTimeout         = 2 * time.Second
+)
+
+// Replicas routes heavy read-only queries, like the archive and the stats,
+// to read replicas of the primary database, taking turns between the healthy
+// ones. Reads go to the primary while no replica is healthy, or if there are
+// none.
+type Replicas struct {
+	primary  *gorm.DB
+	replicas []*replica
+	next     atomic.Uint64
+}
+
+type replica struct {
+	// number names the replica in logs, its URL has the password
+	number  int
+	db      *gorm.DB
+	healthy atomic.Bool
+}
+
+// NewReplicas routes reads to the replicas, or to the primary without them.
+// The replicas count as unhealthy until Check finds them healthy.
+func NewReplicas(primary *gorm.DB, replicas ...*gorm.DB) *Replicas {
+	r := &Replicas{primary: primary}
+	for i, db := range replicas {
+		r.replicas = append(r.replicas, &replica{number: i + 1, db: db})
+	}
+	return r
+}
+
+// SetupReplicas connects to the read replicas of the settings and checks
+// their health. Replicas that can't be reached don't fail the setup, they
+// are skipped until they can.
+func SetupReplicas(settings *internal.Settings, primary *gorm.DB) (*Replicas, error) {
+	var dbs []*gorm.DB
+	for _, dsn := range settings.Database.ReplicaDSNs() {
+		db, err := open(dsn, false)
+		if err != nil {
+			return nil, err
+		}
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		configurePool(sqlDB, settings.Database)
+		dbs = append(dbs, db)
+	}
+	replicas := NewReplicas(primary, dbs...)
+	replicas.Check(context.Background())
+	return replicas, nil
+}
+
+// Reader is the database for a read-only query: the next healthy replica, or
+// the primary. Replicas lag behind the primary, so reads of what a request
+// just wrote, writes, and transactions have to use the primary.
+func (r *Replicas) Reader(ctx context.Context) *gorm.DB {
+	n := uint64(len(r.replicas))
+	start := r.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		if replica := r.replicas[(start+i)%n]; replica.healthy.Load() {
+			return replica.db.WithContext(ctx)
+		}
+	}
+	return r.primary.WithContext(ctx)
+}
+
+// Check pings every replica and marks it healthy if it answers in time.
+func (r *Replicas) Check(ctx context.Context) {
+	log := internal.Logger()
+	for _, replica := range r.replicas {
+		err := replica.ping(ctx)
+		healthy := err == nil
+		if replica.healthy.Swap(healthy) == healthy {
+			continue
+		}
+		if healthy {
+			log.Warn().Int("replica", replica.number).Msg("read replica is healthy, sending reads to it")
+		} else {
+			log.Warn().Err(err).Int("replica", replica.number).Msg("read replica is unhealthy, sending its reads elsewhere")
+		}
+	}
+}
+
+// Run checks the replicas every interval, or every 5 seconds if it is zero,
+// until ctx is done.
+func (r *Replicas) Run(ctx context.Context, interval time.Duration) {
+	if len(r.replicas) == 0 {
+		return
+	}
+	if interval <= 0 {
+		interval = defaultReplicaCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Check(ctx)
+		}
+	}
+}
+
+func (r *replica) ping(ctx context.Context) error {
+	sqlDB, err := r.db.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, replicaCheckTimeout)
+	defer cancel()
+	return sqlDB.PingContext(ctx)
+}
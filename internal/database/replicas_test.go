@@ -0,0 +1,38 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// unreachable is a database nothing listens for.
+func unreachable(t *testing.T) *gorm.DB {
+	db, err := open("host=127.0.0.1 port=1 user=app password=secret dbname=newsletter sslmode=disable connect_timeout=1", false)
+	require.Nil(t, err)
+	return db
+}
+
+func TestReadsGoToThePrimaryWithoutReplicas(t *testing.T) {
+	primary := unreachable(t)
+	replicas := NewReplicas(primary)
+
+	replicas.Check(context.Background())
+
+	assert.Same(t, primary.ConnPool, replicas.Reader(context.Background()).ConnPool)
+}
+
+func TestReadsFailOverToThePrimaryWhileNoReplicaIsHealthy(t *testing.T) {
+	primary, down := unreachable(t), unreachable(t)
+	replicas := NewReplicas(primary, down)
+
+	replicas.Check(context.Background())
+	assert.Same(t, primary.ConnPool, replicas.Reader(context.Background()).ConnPool)
+
+	// a healthy replica takes the reads
+	replicas.replicas[0].healthy.Store(true)
+	assert.Same(t, down.ConnPool, replicas.Reader(context.Background()).ConnPool)
+}
@@ -2,35 +2,142 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/guuzaa/email-newsletter/internal"
 	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/domain"
 	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// SetupDB connects to the database of the settings, Postgres or SQLite, and
+// migrates it.
 func SetupDB(settings *internal.Settings) (*gorm.DB, error) {
-	db, err := gorm.Open(postgres.New(postgres.Config{
-		DSN:                  settings.PostgresSQLDSN(), // data source name, refer https://github.com/jackc/pgx
-		PreferSimpleProtocol: true,                      // disables implicit prepared statement usage. By default pgx automatically uses the extended protocol
-	}), &gorm.Config{
+	var db *gorm.DB
+	var err error
+	if path, ok := settings.Database.SQLite(); ok {
+		db, err = openSQLite(path)
+	} else {
+		db, err = open(settings.PostgresSQLDSN(), true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Migrate(db); err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	configurePool(sqlDB, settings.Database)
+	return db, err
+}
+
+// open connects to the Postgres database of the DSN, pinging it unless ping
+// is false.
+func open(dsn string, ping bool) (*gorm.DB, error) {
+	return openDialector(postgres.New(postgres.Config{
+		DSN:                  dsn,  // data source name, refer https://github.com/jackc/pgx
+		PreferSimpleProtocol: true, // disables implicit prepared statement usage. By default pgx automatically uses the extended protocol
+	}), ping)
+}
+
+// openSQLite opens the SQLite database at the path, creating it if needed.
+// SQLite has no row locks, so its transactions take the write lock as they
+// begin: claims that use SKIP LOCKED on Postgres run one at a time instead.
+// Writers wait for each other rather than fail, and readers don't wait for
+// writers. That makes SQLite fit for development with a single instance
+// only; nothing sends email inside a claiming transaction, or the write lock
+// would be held for the request to the provider. The migrations folder is
+// written for Postgres, SQLite databases get their tables from Migrate.
+func openSQLite(path string) (*gorm.DB, error) {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return openDialector(sqlite.Open(path+separator+"_txlock=immediate&_busy_timeout=5000&_journal_mode=WAL"), true)
+}
+
+// Claim locks the rows the query finds for the transaction, skipping those
+// another transaction holds, so concurrent workers, like the newsletter
+// scheduler, don't take the same work. SQLite has no row locks; its
+// transactions begin holding the write lock instead, see openSQLite, so a
+// claiming transaction runs alone.
+func Claim(tx *gorm.DB) *gorm.DB {
+	if tx.Dialector.Name() == "sqlite" {
+		return tx
+	}
+	return tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate, Options: clause.LockingOptionsSkipLocked})
+}
+
+func openDialector(dialector gorm.Dialector, ping bool) (*gorm.DB, error) {
+	db, err := gorm.Open(dialector, &gorm.Config{
 		Logger: &internal.GormLogger{
 			FieldsExclude: []string{internal.FileFieldName},
 		},
+		DisableAutomaticPing: !ping,
+		// unique violations become gorm.ErrDuplicatedKey on every database
+		TranslateError: true,
 	})
 	if err != nil {
 		return nil, err
 	}
-	db = db.WithContext(internal.Logger().WithContext(context.Background()))
+	return db.WithContext(internal.Logger().WithContext(context.Background())), nil
+}
 
-	db.AutoMigrate(&models.Subscription{}, &models.SubscriptionTokens{}, &models.User{})
-	sqlDB, err := db.DB()
+// configurePool sizes the connection pool and bounds how long connections
+// live, see DatabaseSettings.
+func configurePool(sqlDB *sql.DB, settings internal.DatabaseSettings) {
+	sqlDB.SetMaxOpenConns(settings.MaxOpenConnections)
+	if settings.MaxIdleConnections > 0 {
+		sqlDB.SetMaxIdleConns(settings.MaxIdleConnections)
+	}
+	sqlDB.SetConnMaxLifetime(settings.ConnMaxLifetime())
+	sqlDB.SetConnMaxIdleTime(settings.ConnMaxIdleTime())
+}
+
+// Migrate creates the tables of all models, seeds the default list and hands
+// out preferences tokens to subscribers who have none yet. It is all the
+// schema SQLite databases get; Postgres ones are also migrated by the SQL
+// files in the migrations folder.
+func Migrate(db *gorm.DB) error {
+	err := db.AutoMigrate(
+		&models.Subscription{}, &models.SubscriptionTokens{}, &models.User{},
+		&models.NewsletterIssue{}, &models.IssueDeliveryTask{},
+		&models.List{}, &models.ListSubscription{}, &models.NewsletterIssueList{},
+		&models.SubscriptionAuditEntry{}, &models.Suppression{}, &models.TrackingEvent{}, &models.IssueDelivery{},
+		&models.IssueAttachment{}, &models.OutboxMessage{},
+	)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	sqlDB.SetMaxIdleConns(10)
-	sqlDB.SetConnMaxIdleTime(100)
-	sqlDB.SetConnMaxLifetime(30 * time.Minute)
-	return db, err
+
+	defaultList := models.List{
+		ID:        uuid.NewString(),
+		Slug:      models.DefaultListSlug,
+		Name:      "Newsletter",
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := db.Where(models.List{Slug: models.DefaultListSlug}).FirstOrCreate(&defaultList).Error; err != nil {
+		return err
+	}
+
+	var subscriptionIDs []string
+	if err := db.Model(&models.Subscription{}).Where("preferences_token IS NULL").Pluck("id", &subscriptionIDs).Error; err != nil {
+		return err
+	}
+	for _, id := range subscriptionIDs {
+		if err := db.Model(&models.Subscription{}).Where("id = ?", id).Update("preferences_token", domain.NewPreferencesToken()).Error; err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,23 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateFailsIfATableCantBeCreated(t *testing.T) {
+	db, err := openSQLite(filepath.Join(t.TempDir(), "newsletter.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	// a view takes the name of the outbox table
+	require.Nil(t, db.Exec("CREATE VIEW outbox AS SELECT 1 AS one").Error)
+
+	assert.Error(t, Migrate(db))
+}
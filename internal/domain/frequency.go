@@ -0,0 +1,25 @@
+package domain
+
+import "fmt"
+
+// Frequency is how often a subscriber receives issues: as soon as they are
+// sent, or bundled in a weekly digest.
+type Frequency string
+
+const (
+	FrequencyInstant Frequency = "instant"
+	FrequencyWeekly  Frequency = "weekly"
+)
+
+func (f Frequency) String() string {
+	return string(f)
+}
+
+func FrequencyFrom(s string) (Frequency, error) {
+	switch f := Frequency(s); f {
+	case FrequencyInstant, FrequencyWeekly:
+		return f, nil
+	default:
+		return "", fmt.Errorf("invalid frequency %q", s)
+	}
+}
@@ -0,0 +1,33 @@
+package domain_test
+
+import (
+	"testing"
+
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrequencyFrom(t *testing.T) {
+	testCases := []struct {
+		name    string
+		isError bool
+	}{
+		{name: "instant", isError: false},
+		{name: "weekly", isError: false},
+		{name: "", isError: true},
+		{name: "daily", isError: true},
+		{name: "Weekly", isError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			frequency, err := domain.FrequencyFrom(tc.name)
+			if tc.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.name, frequency.String())
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package domain
 
 type NewSubscriber struct {
-	Email SubscriberEmail
-	Name  SubscriberName
+	Email    SubscriberEmail
+	Name     SubscriberName
+	TimeZone TimeZone
 }
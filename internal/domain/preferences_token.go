@@ -0,0 +1,16 @@
+package domain
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// NewPreferencesToken returns a token for the preferences link of a
+// subscriber. The link manages the subscription without logging in, so the
+// token holds 128 random bits from crypto/rand, hex encoded.
+func NewPreferencesToken() string {
+	token := make([]byte, 16)
+	// Read never fails since Go 1.24
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
@@ -0,0 +1,18 @@
+package domain_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPreferencesToken(t *testing.T) {
+	token := domain.NewPreferencesToken()
+	decoded, err := hex.DecodeString(token)
+	assert.NoError(t, err)
+	assert.Len(t, decoded, 16)
+	assert.True(t, domain.ValidSubscriberToken(token))
+	assert.NotEqual(t, token, domain.NewPreferencesToken())
+}
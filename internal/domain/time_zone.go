@@ -0,0 +1,35 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+type TimeZone string
+
+func (tz TimeZone) String() string {
+	return string(tz)
+}
+
+// Location returns the IANA location of the time zone, falling back to UTC
+// for an empty or unknown zone.
+func (tz TimeZone) Location() *time.Location {
+	if tz == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(string(tz))
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func TimeZoneFrom(name string) (TimeZone, error) {
+	if name == "" || name == "Local" {
+		return "", errors.New("invalid time zone")
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return "", err
+	}
+	return TimeZone(name), nil
+}
@@ -0,0 +1,41 @@
+package domain_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeZoneFrom(t *testing.T) {
+	testCases := []struct {
+		name    string
+		isError bool
+	}{
+		{name: "UTC", isError: false},
+		{name: "Europe/Berlin", isError: false},
+		{name: "America/New_York", isError: false},
+		{name: "", isError: true},
+		{name: "Local", isError: true},
+		{name: "Mars/Olympus_Mons", isError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tz, err := domain.TimeZoneFrom(tc.name)
+			if tc.isError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.name, tz.String())
+			}
+		})
+	}
+}
+
+func TestTimeZoneLocationFallsBackToUTC(t *testing.T) {
+	assert.Equal(t, time.UTC, domain.TimeZone("").Location())
+	assert.Equal(t, time.UTC, domain.TimeZone("Mars/Olympus_Mons").Location())
+	assert.Equal(t, "Asia/Tokyo", domain.TimeZone("Asia/Tokyo").Location().String())
+}
@@ -1,75 +1,489 @@
 package internal
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/guuzaa/email-newsletter/internal/domain"
 )
 
+// ErrRecipientSuppressed is returned for emails the recipient guard refuses.
+var ErrRecipientSuppressed = errors.New("recipient is suppressed")
+
+// RecipientGuard decides which recipients may receive email, all of a batch
+// at once. It returns an error by recipient, ErrRecipientSuppressed possibly
+// wrapped to refuse one and nil to let it through.
+type RecipientGuard func(recipients []domain.SubscriberEmail) []error
+
+// The failures the provider reports, matched with errors.Is. Rate limits and
+// server errors are transient, the others are permanent.
+var (
+	ErrInactiveRecipient = errors.New("inactive recipient")
+	ErrInvalidAddress    = errors.New("invalid email address")
+	ErrRateLimited       = errors.New("rate limited")
+	ErrServerError       = errors.New("email provider server error")
+)
+
+// Postmark error codes, https://postmarkapp.com/developer/api/overview#error-codes
+const (
+	postmarkInvalidEmailRequest = 300
+	postmarkInactiveRecipient   = 406
+)
+
+// classify maps an HTTP status and Postmark error code to the failure they
+// stand for, nil if it is none of them.
+func classify(statusCode, errorCode int) error {
+	switch {
+	case errorCode == postmarkInactiveRecipient:
+		return ErrInactiveRecipient
+	case errorCode == postmarkInvalidEmailRequest:
+		return ErrInvalidAddress
+	case statusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case statusCode >= http.StatusInternalServerError:
+		return ErrServerError
+	}
+	return nil
+}
+
+// IsTransient reports whether sending may succeed if tried again: the
+// provider was rate limiting or failing, it couldn't be connected to, or it
+// didn't answer in time. After a server error or a timeout the email may have
+// gone out, sending it again is safe because it carries the same idempotency
+// key, see IdempotencyKey.
+func IsTransient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrRateLimited) || errors.Is(err, ErrServerError) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// StatusError is returned when the provider answers with anything but 200 OK.
+// ErrorCode and Message are taken from Postmark's error body.
+type StatusError struct {
+	StatusCode int
+	ErrorCode  int
+	Message    string
+	// RetryAfter is the delay the provider asked for, zero if it didn't
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status code: %d: postmark error %d: %s", e.StatusCode, e.ErrorCode, e.Message)
+}
+
+func (e *StatusError) Is(target error) bool {
+	return target == classify(e.StatusCode, e.ErrorCode)
+}
+
+// Throttled reports whether the provider is rate limiting or overloaded, so
+// sending should slow down and retry.
+func (e *StatusError) Throttled() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
 type EmailClient struct {
 	httpClient         *http.Client
 	baseUrl            string
-	sender             domain.SubscriberEmail
 	authorizationToken string
+	reloadable         *reloadableSettings
+	guard              RecipientGuard
+	// streams maps each Stream to its Postmark message stream ID
+	streams map[Stream]string
+}
+
+// reloadableSettings are the settings that can change while the client is in
+// use. Copies of the client share them.
+type reloadableSettings struct {
+	mu      sync.RWMutex
+	sender  domain.SubscriberEmail
+	timeout time.Duration
 }
 
 func NewEmailClient(baseUrl string, sender domain.SubscriberEmail, authorizationToken string, timeout time.Duration) EmailClient {
 	return EmailClient{
 		httpClient: &http.Client{
-			Timeout: timeout,
+			// the timeout is applied to each call instead, for it to be reloadable
 			Transport: &http.Transport{
-				MaxIdleConns:    100, // Connection pool size
-				IdleConnTimeout: 30 * time.Second,
+				MaxIdleConns: 100, // Connection pool size
+				// every request goes to the same host, the default of 2 idle
+				// connections per host makes concurrent senders reconnect
+				MaxIdleConnsPerHost: 100,
+				IdleConnTimeout:     30 * time.Second,
 			},
 		},
 		baseUrl:            baseUrl,
-		sender:             sender,
 		authorizationToken: authorizationToken,
+		reloadable:         &reloadableSettings{sender: sender, timeout: timeout},
 	}
 }
 
+// maxErrorBodySize bounds how much of an error response is read.
+const maxErrorBodySize = 64 << 10
+
+// MaxBatchSize is the most messages Postmark accepts in one batch call.
+const MaxBatchSize = 500
+
+// maxBatchBytes bounds the payload of a batch call, Postmark accepts up to
+// 50 MB.
+const maxBatchBytes = 48 << 20
+
+// Stream is the kind of email a message is. Postmark sends each kind through
+// its own message stream, so bulk email can't hurt the reputation of
+// transactional email.
+type Stream int
+
+const (
+	// StreamTransactional is for emails a subscriber triggered, like the
+	// confirmation email
+	StreamTransactional Stream = iota
+	// StreamBroadcast is for newsletters and digests
+	StreamBroadcast
+)
+
+// The link tracking settings Postmark accepts, an empty one uses the
+// server's default.
+const (
+	TrackLinksNone        = "None"
+	TrackLinksHtmlAndText = "HtmlAndText"
+	TrackLinksHtmlOnly    = "HtmlOnly"
+	TrackLinksTextOnly    = "TextOnly"
+)
+
+// IdempotencyKey is the metadata key of the ID that stays the same across
+// every attempt to send a message, so the provider can tell an email sent
+// again after a failure from a new one.
+const IdempotencyKey = "idempotency_key"
+
+// Message is an email to send.
+type Message struct {
+	To       domain.SubscriberEmail
+	Subject  string
+	HtmlBody string
+	TextBody string
+	MessageOptions
+}
+
+// MessageOptions are the optional parts of a message.
+type MessageOptions struct {
+	Stream  Stream
+	ReplyTo string
+	// Cc and Bcc are for internal copies of a message
+	Cc      []string
+	Bcc     []string
+	Headers []Header
+	// Tag groups messages in Postmark's statistics
+	Tag string
+	// Metadata is returned by Postmark's webhooks of the message
+	Metadata    map[string]string
+	TrackOpens  bool
+	TrackLinks  string
+	Attachments []Attachment
+}
+
+// Header is a custom header of a message.
+type Header struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+// BatchFailure is a message of a batch that wasn't sent.
+type BatchFailure struct {
+	// Index is the position of the message in the batch
+	Index     int
+	Recipient domain.SubscriberEmail
+	Err       error
+}
+
+// PostmarkError is the error Postmark reported for a single message.
+type PostmarkError struct {
+	ErrorCode int
+	Message   string
+}
+
+func (e *PostmarkError) Error() string {
+	return fmt.Sprintf("postmark error %d: %s", e.ErrorCode, e.Message)
+}
+
+func (e *PostmarkError) Is(target error) bool {
+	return target == classify(0, e.ErrorCode)
+}
+
+// sendResult is Postmark's result for a message. The results of a batch are
+// in the order the messages were sent.
+type sendResult struct {
+	ErrorCode int    `json:"ErrorCode"`
+	Message   string `json:"Message"`
+	MessageID string `json:"MessageID"`
+	To        string `json:"To"`
+}
+
 type SendEmailRequest struct {
-	From     string `json:"From"`
-	To       string `json:"To"`
-	Subject  string `json:"Subject"`
-	HtmlBody string `json:"HtmlBody"`
-	TextBody string `json:"TextBody"`
+	From          string              `json:"From"`
+	To            string              `json:"To"`
+	Cc            string              `json:"Cc,omitempty"`
+	Bcc           string              `json:"Bcc,omitempty"`
+	ReplyTo       string              `json:"ReplyTo,omitempty"`
+	Subject       string              `json:"Subject"`
+	HtmlBody      string              `json:"HtmlBody"`
+	TextBody      string              `json:"TextBody"`
+	Headers       []Header            `json:"Headers,omitempty"`
+	Tag           string              `json:"Tag,omitempty"`
+	Metadata      map[string]string   `json:"Metadata,omitempty"`
+	MessageStream string              `json:"MessageStream,omitempty"`
+	TrackOpens    bool                `json:"TrackOpens,omitempty"`
+	TrackLinks    string              `json:"TrackLinks,omitempty"`
+	Attachments   []AttachmentRequest `json:"Attachments,omitempty"`
+}
+
+// UseStreams sends transactional and broadcast messages through the message
+// streams with these IDs. An empty ID uses the server's default stream.
+func (ec *EmailClient) UseStreams(transactional, broadcast string) {
+	ec.streams = map[Stream]string{StreamTransactional: transactional, StreamBroadcast: broadcast}
+}
+
+// UseRecipientGuard makes every email go through the guard before it is sent.
+func (ec *EmailClient) UseRecipientGuard(guard RecipientGuard) {
+	ec.guard = guard
+}
+
+// SetSender changes the address emails are sent from, for the emails sent
+// from then on.
+func (ec *EmailClient) SetSender(sender domain.SubscriberEmail) {
+	ec.reloadable.mu.Lock()
+	defer ec.reloadable.mu.Unlock()
+	ec.reloadable.sender = sender
+}
+
+// SetTimeout changes how long each call to the provider may take. Zero means
+// no timeout.
+func (ec *EmailClient) SetTimeout(timeout time.Duration) {
+	ec.reloadable.mu.Lock()
+	defer ec.reloadable.mu.Unlock()
+	ec.reloadable.timeout = timeout
+}
+
+func (ec *EmailClient) settings() (domain.SubscriberEmail, time.Duration) {
+	ec.reloadable.mu.RLock()
+	defer ec.reloadable.mu.RUnlock()
+	return ec.reloadable.sender, ec.reloadable.timeout
 }
 
 func (ec *EmailClient) SendEmail(recipient domain.SubscriberEmail, subject, htmlContent, textContent string) error {
-	url := fmt.Sprintf("%s/email", ec.baseUrl)
-	request := SendEmailRequest{
-		From:     ec.sender.String(),
-		To:       recipient.String(),
-		Subject:  subject,
-		HtmlBody: htmlContent,
-		TextBody: textContent,
+	return ec.SendEmailContext(context.Background(), recipient, subject, htmlContent, textContent)
+}
+
+// SendEmailContext is SendEmail, giving up once ctx is done.
+func (ec *EmailClient) SendEmailContext(ctx context.Context, recipient domain.SubscriberEmail, subject, htmlContent, textContent string) error {
+	_, err := ec.Send(ctx, Message{To: recipient, Subject: subject, HtmlBody: htmlContent, TextBody: textContent})
+	return err
+}
+
+// Send sends a message and returns the ID Postmark gave it. Messages whose
+// attachments don't pass ValidateAttachments aren't sent.
+func (ec *EmailClient) Send(ctx context.Context, message Message) (string, error) {
+	if err := ec.check([]Message{message})[0]; err != nil {
+		return "", err
 	}
+	body, err := ec.post(ctx, "/email", ec.request(message))
+	if err != nil {
+		return "", err
+	}
+	// the message was accepted, a response without its ID is no reason to
+	// send it again
+	var result sendResult
+	_ = json.Unmarshal(body, &result)
+	return result.MessageID, nil
+}
+
+// SendBatch sends the messages through Postmark's batch endpoint, in calls of
+// at most MaxBatchSize messages. It returns the IDs Postmark gave the messages
+// by index, and separately the messages that weren't sent. The messages of a
+// call that failed as a whole all carry its error.
+func (ec *EmailClient) SendBatch(ctx context.Context, messages []Message) ([]string, []BatchFailure) {
+	ids := make([]string, len(messages))
+	var failures []BatchFailure
+	indexes := make([]int, 0, len(messages))
+	for i, err := range ec.check(messages) {
+		if err != nil {
+			failures = append(failures, BatchFailure{Index: i, Recipient: messages[i].To, Err: err})
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+
+	requests := make([]SendEmailRequest, len(messages))
+	for _, i := range indexes {
+		requests[i] = ec.request(messages[i])
+	}
+	for _, chunk := range batches(indexes, requests) {
+		calls := make([]SendEmailRequest, len(chunk))
+		for j, i := range chunk {
+			calls[j] = requests[i]
+		}
+		var results []sendResult
+		body, err := ec.post(ctx, "/email/batch", calls)
+		if err == nil {
+			err = json.Unmarshal(body, &results)
+		}
+		if err == nil && len(results) != len(chunk) {
+			err = fmt.Errorf("batch response has %d results for %d messages", len(results), len(chunk))
+		}
+		for j, i := range chunk {
+			switch {
+			case err != nil:
+				failures = append(failures, BatchFailure{Index: i, Recipient: messages[i].To, Err: err})
+			case results[j].ErrorCode != 0:
+				failures = append(failures, BatchFailure{Index: i, Recipient: messages[i].To, Err: &PostmarkError{ErrorCode: results[j].ErrorCode, Message: results[j].Message}})
+			default:
+				ids[i] = results[j].MessageID
+			}
+		}
+	}
+	return ids, failures
+}
+
+// batches splits the indexes of the requests into the calls of a batch, each
+// within Postmark's limits on messages and payload.
+func batches(indexes []int, requests []SendEmailRequest) [][]int {
+	var chunks [][]int
+	var chunk []int
+	size := 0
+	for _, i := range indexes {
+		n := requestSize(requests[i])
+		if len(chunk) == MaxBatchSize || (len(chunk) > 0 && size+n > maxBatchBytes) {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, i)
+		size += n
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// requestSize estimates the encoded size of a request, which the bodies and
+// attachments make up almost entirely.
+func requestSize(request SendEmailRequest) int {
+	n := len(request.HtmlBody) + len(request.TextBody) + len(request.Subject)
+	for _, attachment := range request.Attachments {
+		n += len(attachment.Content)
+	}
+	return n
+}
+
+// check refuses messages the guard rejects or whose attachments are invalid,
+// it returns an error by message.
+func (ec *EmailClient) check(messages []Message) []error {
+	errs := make([]error, len(messages))
+	if ec.guard != nil {
+		recipients := make([]domain.SubscriberEmail, len(messages))
+		for i, message := range messages {
+			recipients[i] = message.To
+		}
+		copy(errs, ec.guard(recipients))
+	}
+	for i, message := range messages {
+		if errs[i] == nil {
+			errs[i] = ValidateAttachments(message.Attachments)
+		}
+	}
+	return errs
+}
+
+func (ec *EmailClient) request(message Message) SendEmailRequest {
+	sender, _ := ec.settings()
+	return SendEmailRequest{
+		From:          sender.String(),
+		To:            message.To.String(),
+		Cc:            strings.Join(message.Cc, ","),
+		Bcc:           strings.Join(message.Bcc, ","),
+		ReplyTo:       message.ReplyTo,
+		Subject:       message.Subject,
+		HtmlBody:      message.HtmlBody,
+		TextBody:      message.TextBody,
+		Headers:       message.Headers,
+		Tag:           message.Tag,
+		Metadata:      message.Metadata,
+		MessageStream: ec.streams[message.Stream],
+		TrackOpens:    message.TrackOpens,
+		TrackLinks:    message.TrackLinks,
+		Attachments:   attachmentRequests(message.Attachments),
+	}
+}
+
+// post sends the request as JSON to the path of the provider's API and returns
+// the body of its response. It calls the provider once, failures are left to
+// the caller to retry, see IsTransient.
+func (ec *EmailClient) post(ctx context.Context, path string, request any) ([]byte, error) {
 	payload, err := json.Marshal(request)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	req, err := http.NewRequest("POST", url, strings.NewReader(string(payload)))
+	if _, timeout := ec.settings(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", ec.baseUrl+path, bytes.NewReader(payload))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Set("X-Postmark-Server-Token", ec.authorizationToken)
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
 
 	resp, err := ec.httpClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		statusErr := &StatusError{StatusCode: resp.StatusCode, RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+		// the error body is best effort, the status tells enough without it
+		var body struct {
+			ErrorCode int    `json:"ErrorCode"`
+			Message   string `json:"Message"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, maxErrorBodySize)).Decode(&body) == nil {
+			statusErr.ErrorCode, statusErr.Message = body.ErrorCode, body.Message
+		}
+		return nil, statusErr
 	}
-	return nil
+	return io.ReadAll(resp.Body)
+}
+
+// retryAfter parses a Retry-After header given in seconds.
+func retryAfter(header string) time.Duration {
+	seconds, err := strconv.Atoi(header)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
 }
 
 func (ec *EmailClient) Client() *http.Client {
@@ -1,11 +1,15 @@
 package internal
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -13,6 +17,7 @@ import (
 	"github.com/guuzaa/email-newsletter/internal/domain"
 	"github.com/jaswdr/faker"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func subject() string {
@@ -124,3 +129,369 @@ func TestSendEmailTimesoutIfTheServerTakesTooLong(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Equal(t, uint32(1), atomic.LoadUint32(&reqCnt))
 }
+
+func TestSendEmailRefusesRecipientsTheGuardRejects(t *testing.T) {
+	reqCnt := uint32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&reqCnt, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	emailClient := emailClient(server.URL)
+	suppressed, _ := domain.SubscriberEmailFrom("suppressed@example.com")
+	allowed, _ := domain.SubscriberEmailFrom("allowed@example.com")
+	emailClient.UseRecipientGuard(func(recipients []domain.SubscriberEmail) []error {
+		errs := make([]error, len(recipients))
+		for i, recipient := range recipients {
+			if recipient == suppressed {
+				errs[i] = ErrRecipientSuppressed
+			}
+		}
+		return errs
+	})
+	content := content()
+	err := emailClient.SendEmail(suppressed, subject(), content, content)
+	assert.ErrorIs(t, err, ErrRecipientSuppressed)
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&reqCnt))
+
+	err = emailClient.SendEmail(allowed, subject(), content, content)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&reqCnt))
+}
+
+func batchServer(t *testing.T, respond func(requests []SendEmailRequest) (int, []sendResult)) (*httptest.Server, *[][]SendEmailRequest) {
+	var mu sync.Mutex
+	var calls [][]SendEmailRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/email/batch", r.URL.Path)
+		var requests []SendEmailRequest
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&requests))
+		mu.Lock()
+		calls = append(calls, requests)
+		mu.Unlock()
+		status, results := respond(requests)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(results)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func messages(n int) []Message {
+	result := make([]Message, n)
+	for i := range result {
+		to, _ := domain.SubscriberEmailFrom(fmt.Sprintf("reader%d@example.com", i))
+		result[i] = Message{To: to, Subject: "subject", HtmlBody: "html", TextBody: "text"}
+	}
+	return result
+}
+
+func okResults(requests []SendEmailRequest) []sendResult {
+	results := make([]sendResult, len(requests))
+	for i, request := range requests {
+		results[i] = sendResult{Message: "OK", MessageID: "id-" + request.To, To: request.To}
+	}
+	return results
+}
+
+func TestSendBatchSendsMessagesInChunks(t *testing.T) {
+	server, calls := batchServer(t, func(requests []SendEmailRequest) (int, []sendResult) {
+		return http.StatusOK, okResults(requests)
+	})
+
+	ids, failures := emailClient(server.URL).SendBatch(context.Background(), messages(MaxBatchSize*2+1))
+
+	assert.Empty(t, failures)
+	require.Len(t, ids, MaxBatchSize*2+1)
+	assert.Equal(t, "id-reader0@example.com", ids[0])
+	assert.Equal(t, "id-reader1000@example.com", ids[1000])
+	require.Len(t, *calls, 3)
+	assert.Len(t, (*calls)[0], MaxBatchSize)
+	assert.Len(t, (*calls)[1], MaxBatchSize)
+	assert.Len(t, (*calls)[2], 1)
+	assert.Equal(t, "reader1000@example.com", (*calls)[2][0].To)
+}
+
+func TestSendBatchReportsFailedRecipients(t *testing.T) {
+	server, _ := batchServer(t, func(requests []SendEmailRequest) (int, []sendResult) {
+		results := okResults(requests)
+		results[1] = sendResult{ErrorCode: 406, Message: "You tried to send to a recipient that has been marked as inactive."}
+		return http.StatusOK, results
+	})
+
+	ids, failures := emailClient(server.URL).SendBatch(context.Background(), messages(3))
+
+	assert.Equal(t, []string{"id-reader0@example.com", "", "id-reader2@example.com"}, ids)
+	require.Len(t, failures, 1)
+	assert.Equal(t, 1, failures[0].Index)
+	assert.Equal(t, "reader1@example.com", failures[0].Recipient.String())
+	var postmarkErr *PostmarkError
+	require.ErrorAs(t, failures[0].Err, &postmarkErr)
+	assert.Equal(t, 406, postmarkErr.ErrorCode)
+}
+
+func TestSendBatchFailsEveryMessageOfAFailedCall(t *testing.T) {
+	server, _ := batchServer(t, func(requests []SendEmailRequest) (int, []sendResult) {
+		return http.StatusTooManyRequests, nil
+	})
+
+	_, failures := emailClient(server.URL).SendBatch(context.Background(), messages(2))
+
+	require.Len(t, failures, 2)
+	for i, failure := range failures {
+		assert.Equal(t, i, failure.Index)
+		var statusErr *StatusError
+		require.ErrorAs(t, failure.Err, &statusErr)
+		assert.True(t, statusErr.Throttled())
+	}
+}
+
+func TestSendBatchSkipsRecipientsTheGuardRejects(t *testing.T) {
+	server, calls := batchServer(t, func(requests []SendEmailRequest) (int, []sendResult) {
+		return http.StatusOK, okResults(requests)
+	})
+	client := emailClient(server.URL)
+	var guarded [][]domain.SubscriberEmail
+	client.UseRecipientGuard(func(recipients []domain.SubscriberEmail) []error {
+		guarded = append(guarded, recipients)
+		errs := make([]error, len(recipients))
+		for i, recipient := range recipients {
+			if recipient.String() == "reader0@example.com" {
+				errs[i] = ErrRecipientSuppressed
+			}
+		}
+		return errs
+	})
+
+	_, failures := client.SendBatch(context.Background(), messages(2))
+
+	require.Len(t, guarded, 1, "the guard checks the whole batch at once")
+	assert.Len(t, guarded[0], 2)
+	require.Len(t, failures, 1)
+	assert.Equal(t, 0, failures[0].Index)
+	assert.ErrorIs(t, failures[0].Err, ErrRecipientSuppressed)
+	require.Len(t, *calls, 1)
+	require.Len(t, (*calls)[0], 1)
+	assert.Equal(t, "reader1@example.com", (*calls)[0][0].To)
+}
+
+func TestSendEmailParsesPostmarkErrors(t *testing.T) {
+	reqCnt := uint32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&reqCnt, 1)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"ErrorCode": 406, "Message": "You tried to send to a recipient that has been marked as inactive."}`))
+	}))
+	defer server.Close()
+
+	emailClient := emailClient(server.URL)
+	content := content()
+	err := emailClient.SendEmail(email(), subject(), content, content)
+
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, 406, statusErr.ErrorCode)
+	assert.Contains(t, statusErr.Message, "inactive")
+	assert.ErrorIs(t, err, ErrInactiveRecipient)
+	assert.False(t, IsTransient(err))
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&reqCnt))
+}
+
+func TestFailuresAreClassified(t *testing.T) {
+	testCases := []struct {
+		err       error
+		failure   error
+		transient bool
+	}{
+		{&StatusError{StatusCode: http.StatusUnprocessableEntity, ErrorCode: 300}, ErrInvalidAddress, false},
+		{&PostmarkError{ErrorCode: 406}, ErrInactiveRecipient, false},
+		{&StatusError{StatusCode: http.StatusTooManyRequests}, ErrRateLimited, true},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable}, ErrServerError, true},
+		{fmt.Errorf("sending: %w", &StatusError{StatusCode: http.StatusInternalServerError}), ErrServerError, true},
+	}
+	for _, tc := range testCases {
+		assert.ErrorIs(t, tc.err, tc.failure, tc.err.Error())
+		assert.Equal(t, tc.transient, IsTransient(tc.err), tc.err.Error())
+	}
+	assert.False(t, IsTransient(&StatusError{StatusCode: http.StatusUnauthorized}))
+	assert.False(t, IsTransient(context.Canceled))
+}
+
+func TestSendEmailCallsTheProviderOnce(t *testing.T) {
+	reqCnt := uint32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&reqCnt, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	emailClient := emailClient(server.URL)
+	content := content()
+	err := emailClient.SendEmail(email(), subject(), content, content)
+	assert.ErrorIs(t, err, ErrServerError)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&reqCnt))
+}
+
+func TestTimeoutsAndFailuresToConnectAreTransient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	content := content()
+
+	client := emailClient(server.URL)
+	client.SetTimeout(10 * time.Millisecond)
+	err := client.SendEmail(email(), subject(), content, content)
+	require.Error(t, err)
+	assert.True(t, IsTransient(err), err.Error())
+
+	// nothing listens at a closed server's address, the request never left
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	err = emailClient(closed.URL).SendEmail(email(), subject(), content, content)
+	require.Error(t, err)
+	assert.True(t, IsTransient(err), err.Error())
+}
+
+func TestSendCarriesTheMessageOptions(t *testing.T) {
+	requests := make(chan SendEmailRequest, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request SendEmailRequest
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&request))
+		requests <- request
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"To": "reader@example.com", "ErrorCode": 0, "Message": "OK", "MessageID": "b7bc2f4a-e38e-4336-af7d-e6c392c2f817"}`))
+	}))
+	defer server.Close()
+
+	emailClient := emailClient(server.URL)
+	emailClient.UseStreams("outbound", "broadcast")
+	to, _ := domain.SubscriberEmailFrom("reader@example.com")
+	id, err := emailClient.Send(context.Background(), Message{
+		To:       to,
+		Subject:  "subject",
+		HtmlBody: "html",
+		TextBody: "text",
+		MessageOptions: MessageOptions{
+			Stream:     StreamBroadcast,
+			ReplyTo:    "editor@example.com",
+			Cc:         []string{"archive@example.com"},
+			Bcc:        []string{"audit@example.com", "legal@example.com"},
+			Headers:    []Header{{Name: "X-Issue", Value: "42"}},
+			Tag:        "newsletter",
+			Metadata:   map[string]string{"issue_id": "42"},
+			TrackOpens: true,
+			TrackLinks: TrackLinksHtmlOnly,
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "b7bc2f4a-e38e-4336-af7d-e6c392c2f817", id)
+
+	request := <-requests
+	assert.Equal(t, "broadcast", request.MessageStream)
+	assert.Equal(t, "editor@example.com", request.ReplyTo)
+	assert.Equal(t, "archive@example.com", request.Cc)
+	assert.Equal(t, "audit@example.com,legal@example.com", request.Bcc)
+	assert.Equal(t, []Header{{Name: "X-Issue", Value: "42"}}, request.Headers)
+	assert.Equal(t, "newsletter", request.Tag)
+	assert.Equal(t, map[string]string{"issue_id": "42"}, request.Metadata)
+	assert.True(t, request.TrackOpens)
+	assert.Equal(t, TrackLinksHtmlOnly, request.TrackLinks)
+
+	// plain emails are transactional
+	content := content()
+	require.Nil(t, emailClient.SendEmail(to, subject(), content, content))
+	request = <-requests
+	assert.Equal(t, "outbound", request.MessageStream)
+	assert.Empty(t, request.Tag)
+}
+
+// png is enough of a PNG image to be recognized as one.
+var png = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestSendCarriesAttachments(t *testing.T) {
+	requests := make(chan SendEmailRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request SendEmailRequest
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&request))
+		requests <- request
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	_, err := emailClient(server.URL).Send(context.Background(), Message{
+		To:       email(),
+		Subject:  "subject",
+		HtmlBody: `<img src="cid:logo">`,
+		TextBody: "text",
+		MessageOptions: MessageOptions{Attachments: []Attachment{
+			{Name: "logo.png", ContentType: "image/png", ContentID: "logo", Content: png},
+			{Name: "notes.txt", ContentType: "text/plain", Content: []byte("notes")},
+		}},
+	})
+	require.Nil(t, err)
+
+	request := <-requests
+	assert.Equal(t, []AttachmentRequest{
+		{Name: "logo.png", Content: base64.StdEncoding.EncodeToString(png), ContentType: "image/png", ContentID: "cid:logo"},
+		{Name: "notes.txt", Content: "bm90ZXM=", ContentType: "text/plain"},
+	}, request.Attachments)
+}
+
+func TestInvalidAttachmentsAreNotSent(t *testing.T) {
+	reqCnt := uint32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&reqCnt, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	client := emailClient(server.URL)
+
+	for name, test := range map[string]struct {
+		attachment Attachment
+		err        error
+	}{
+		"unknown type":        {Attachment{Name: "a.zip", ContentType: "application/zip", Content: []byte("PK")}, ErrInvalidAttachment},
+		"forbidden extension": {Attachment{Name: "setup.EXE", ContentType: "text/plain", Content: []byte("MZ")}, ErrInvalidAttachment},
+		"mismatched content":  {Attachment{Name: "a.png", ContentType: "image/png", Content: []byte("<html>")}, ErrInvalidAttachment},
+		"empty":               {Attachment{Name: "a.txt", ContentType: "text/plain"}, ErrInvalidAttachment},
+		"path in name":        {Attachment{Name: "../a.txt", ContentType: "text/plain", Content: []byte("a")}, ErrInvalidAttachment},
+		"inline text":         {Attachment{Name: "a.txt", ContentType: "text/plain", ContentID: "a", Content: []byte("a")}, ErrInvalidAttachment},
+		"too large":           {Attachment{Name: "a.txt", ContentType: "text/plain", Content: make([]byte, MaxAttachmentsSize+1)}, ErrAttachmentsTooLarge},
+		"invalid content ID":  {Attachment{Name: "a.png", ContentType: "image/png", ContentID: "<a>", Content: png}, ErrInvalidAttachment},
+	} {
+		message := Message{To: email(), MessageOptions: MessageOptions{Attachments: []Attachment{test.attachment}}}
+		_, err := client.Send(context.Background(), message)
+		assert.ErrorIs(t, err, test.err, name)
+
+		_, failures := client.SendBatch(context.Background(), []Message{message})
+		require.Len(t, failures, 1, name)
+		assert.ErrorIs(t, failures[0].Err, test.err, name)
+	}
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&reqCnt))
+}
+
+func TestSenderAndTimeoutCanChangeWhileInUse(t *testing.T) {
+	var from atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload SendEmailRequest
+		json.NewDecoder(r.Body).Decode(&payload)
+		from.Store(payload.From)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	emailClient := emailClient(server.URL)
+	// copies of the client see the changes too
+	copied := *emailClient
+
+	sender := email()
+	emailClient.SetSender(sender)
+	require.Nil(t, copied.SendEmail(email(), subject(), content(), content()))
+	assert.Equal(t, sender.String(), from.Load())
+
+	emailClient.SetTimeout(10 * time.Millisecond)
+	assert.NotNil(t, copied.SendEmail(email(), subject(), content(), content()))
+}
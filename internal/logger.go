@@ -51,8 +51,9 @@ func Logger() zerolog.Logger {
 			}
 		}
 
+		// the level is global, for SetLogLevel to change it on every logger
+		zerolog.SetGlobalLevel(logLevel)
 		log = zerolog.New(output).
-			Level(zerolog.Level(logLevel)).
 			With().
 			Timestamp().
 			Str("gitRevision", gitRevision).
@@ -62,6 +63,16 @@ func Logger() zerolog.Logger {
 	return log
 }
 
+// SetLogLevel changes the level of the logs, given by name like LOG_LEVEL.
+func SetLogLevel(level string) error {
+	logLevel, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	zerolog.SetGlobalLevel(logLevel)
+	return nil
+}
+
 // GetContextLogger returns a logger with request ID from context
 func GetContextLogger(c *gin.Context) zerolog.Logger {
 	logger := Logger()
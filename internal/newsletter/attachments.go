@@ -0,0 +1,45 @@
+package newsletter
+
+import (
+	"context"
+	"errors"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"gorm.io/gorm"
+)
+
+// ErrUnknownAsset is returned by an AssetSource for keys it has no asset of.
+var ErrUnknownAsset = errors.New("unknown asset")
+
+// AssetSource looks up the stored assets attachments can refer to instead of
+// carrying their content.
+type AssetSource interface {
+	Asset(ctx context.Context, key string) (content []byte, contentType string, err error)
+}
+
+// Attachments are the attachments of an issue as they are sent.
+func Attachments(records []models.IssueAttachment) []internal.Attachment {
+	if len(records) == 0 {
+		return nil
+	}
+	attachments := make([]internal.Attachment, len(records))
+	for i, record := range records {
+		attachments[i] = internal.Attachment{
+			Name:        record.Name,
+			ContentType: record.ContentType,
+			ContentID:   record.ContentID,
+			Content:     record.Content,
+		}
+	}
+	return attachments
+}
+
+// IssueAttachments loads the attachments of an issue in their order.
+func IssueAttachments(db *gorm.DB, issueID string) ([]internal.Attachment, error) {
+	var records []models.IssueAttachment
+	if err := db.Where("newsletter_issue_id = ?", issueID).Order("position").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	return Attachments(records), nil
+}
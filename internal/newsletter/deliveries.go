@@ -0,0 +1,81 @@
+package newsletter
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"gorm.io/gorm"
+)
+
+// IssueTag tags the emails of newsletter issues at the provider.
+const IssueTag = "newsletter"
+
+// IssueDelivery is the delivery of an issue and its attachments to a
+// recipient, sent through the broadcast stream and tagged with the issue for
+// the provider's webhooks.
+func IssueDelivery(renderer *Renderer, issue models.NewsletterIssue, attachments []internal.Attachment, to domain.SubscriberEmail, recipient Recipient) Delivery {
+	// the issue goes to each address once, sending it again after the
+	// scheduler lost track of a send keeps the key
+	metadata := map[string]string{"issue_id": issue.ID, internal.IdempotencyKey: issue.ID + "/" + to.String()}
+	if recipient.SubscriptionID != "" {
+		metadata["subscription_id"] = recipient.SubscriptionID
+	}
+	return Delivery{
+		To: to,
+		Render: func() (RenderedIssue, error) {
+			return renderer.Render(issue, recipient)
+		},
+		Options: internal.MessageOptions{
+			Stream:      internal.StreamBroadcast,
+			Tag:         IssueTag,
+			Metadata:    metadata,
+			Attachments: attachments,
+		},
+	}
+}
+
+// RecordDelivery stores the outcome of sending an issue to a recipient, a nil
+// sendErr records it as sent with the ID the provider gave the email.
+func RecordDelivery(db *gorm.DB, issueID string, recipient Recipient, messageID string, sendErr error) error {
+	now := time.Now().UTC()
+	delivery := models.IssueDelivery{
+		ID:                uuid.NewString(),
+		NewsletterIssueID: issueID,
+		SubscriptionID:    recipient.SubscriptionID,
+		Email:             recipient.Email,
+		Status:            models.DeliveryStatusSent,
+		MessageID:         messageID,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	if sendErr != nil {
+		delivery.Status = models.DeliveryStatusFailed
+		delivery.Error = sendErr.Error()
+	}
+	return db.Create(&delivery).Error
+}
+
+// UpdateLatestDelivery moves a delivery that is in one of the from statuses
+// to status: the one of the provider's message ID, or the most recent to the
+// email for events without a message ID. An event about a message that isn't
+// a delivery, like a confirmation email, updates nothing. It reports whether
+// there was one.
+func UpdateLatestDelivery(db *gorm.DB, messageID string, email string, from []string, status string) (bool, error) {
+	var delivery models.IssueDelivery
+	query := db.Where("message_id = ? AND status IN ?", messageID, from)
+	if messageID == "" {
+		query = db.Where("email = ? AND status IN ?", email, from).Order("created_at DESC")
+	}
+	result := query.Limit(1).Find(&delivery)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	err := db.Model(&delivery).Updates(map[string]interface{}{
+		"status":     status,
+		"updated_at": time.Now().UTC(),
+	}).Error
+	return err == nil, err
+}
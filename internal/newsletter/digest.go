@@ -0,0 +1,140 @@
+package newsletter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"gorm.io/gorm"
+)
+
+const (
+	DigestInterval   = 7 * 24 * time.Hour
+	digestRetryDelay = time.Hour
+	digestSubject    = "Your weekly digest"
+	// DigestTag tags digest emails at the provider.
+	DigestTag = "digest"
+)
+
+// RenderDigest bundles the issues a weekly subscriber missed into one email.
+func (r *Renderer) RenderDigest(issues []models.NewsletterIssue, recipient Recipient) (RenderedIssue, error) {
+	var html, text strings.Builder
+	preferencesURL := r.PreferencesURL(recipient)
+	for i, issue := range issues {
+		data := templateData{Recipient: recipient, ViewInBrowserURL: r.ArchiveURL(issue), PreferencesURL: preferencesURL}
+		rendered, err := render(issue, data)
+		if err != nil {
+			return RenderedIssue{}, err
+		}
+		if i > 0 {
+			html.WriteString("<hr>")
+			text.WriteString("\n\n---\n\n")
+		}
+		fmt.Fprintf(&html, "<h2>%s</h2>%s", htmltemplate.HTMLEscapeString(rendered.Subject), rendered.Html)
+		fmt.Fprintf(&text, "%s\n\n%s", rendered.Subject, rendered.Text)
+		if data.ViewInBrowserURL != "" {
+			fmt.Fprintf(&html, `<p><a href="%s">View this issue in your browser</a></p>`, htmltemplate.HTMLEscapeString(data.ViewInBrowserURL))
+			fmt.Fprintf(&text, "\n\nView this issue in your browser: %s", data.ViewInBrowserURL)
+		}
+	}
+	rendered := RenderedIssue{Subject: digestSubject, Html: html.String(), Text: text.String()}
+	r.addPreferencesFooter(&rendered, preferencesURL)
+	return rendered, nil
+}
+
+// sendNextDigest sends one due weekly digest. It reports whether a weekly
+// subscriber was due. The subscriber is claimed by pushing their next digest
+// back by the delivery lease, so the digest is sent outside any transaction.
+func (s *Scheduler) sendNextDigest(db *gorm.DB, now time.Time) (bool, error) {
+	// the outcome of a digest that went out must be stored even while shutting down
+	db = db.WithContext(context.WithoutCancel(db.Statement.Context))
+	found := false
+	var subscription models.Subscription
+	var issues []models.NewsletterIssue
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := database.Claim(tx).
+			Where("frequency = ? AND next_digest_at <= ?", domain.FrequencyWeekly, now).
+			Where("paused_until IS NULL OR paused_until <= ?", now).
+			Where(notSuppressed).
+			Order("next_digest_at").Limit(1).Find(&subscription)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		found = true
+
+		since := now.Add(-DigestInterval)
+		if subscription.LastDigestAt != nil {
+			since = *subscription.LastDigestAt
+		}
+		if subscription.PausedUntil != nil && subscription.PausedUntil.After(since) {
+			since = *subscription.PausedUntil
+		}
+		err := tx.Where("status = ? AND published_at > ? AND published_at <= ?", models.IssueStatusSent, since, now).
+			Where("newsletter_issue_id IN (?)", tx.Model(&models.NewsletterIssueList{}).
+				Select("newsletter_issue_lists.newsletter_issue_id").
+				Joins("JOIN list_subscriptions ON list_subscriptions.list_id = newsletter_issue_lists.list_id").
+				Where("list_subscriptions.subscription_id = ? AND list_subscriptions.status = ?", subscription.ID, models.SubscriptionStatusConfirmed)).
+			Order("published_at").Find(&issues).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&models.Subscription{}).Where("id = ?", subscription.ID).
+			Update("next_digest_at", now.Add(deliveryLease).UTC()).Error
+	})
+	if err != nil || !found {
+		return found, err
+	}
+
+	if len(issues) > 0 {
+		err := s.sendDigest(subscription, issues)
+		switch {
+		case errors.Is(err, internal.ErrRecipientSuppressed):
+			logger.Debug().Str("email", subscription.Email).Msg("skipping digest for suppressed subscriber")
+		case internal.IsTransient(err):
+			logger.Warn().Err(err).Str("email", subscription.Email).Msg("failed to send digest, retrying later")
+			return found, db.Model(&subscription).Update("next_digest_at", now.Add(digestRetryDelay).UTC()).Error
+		case err != nil:
+			// rejected or not renderable, sending it again won't help
+			logger.Error().Err(err).Str("email", subscription.Email).Msg("giving up on digest")
+		default:
+			logger.Trace().Int("issues", len(issues)).Msgf("sending digest to %s", subscription.Email)
+		}
+	}
+	return found, db.Model(&subscription).Updates(map[string]interface{}{
+		"last_digest_at": now.UTC(),
+		"next_digest_at": now.Add(DigestInterval).UTC(),
+	}).Error
+}
+
+func (s *Scheduler) sendDigest(subscription models.Subscription, issues []models.NewsletterIssue) error {
+	email, err := domain.SubscriberEmailFrom(subscription.Email)
+	if err != nil {
+		return err
+	}
+	recipient := Recipient{Name: subscription.Name, Email: email.String(), PreferencesToken: subscription.PreferencesToken}
+	rendered, err := s.renderer.RenderDigest(issues, recipient)
+	if err != nil {
+		return err
+	}
+	_, err = s.engine.Send(context.Background(), internal.Message{
+		To:       email,
+		Subject:  rendered.Subject,
+		HtmlBody: rendered.Html,
+		TextBody: rendered.Text,
+		MessageOptions: internal.MessageOptions{
+			Stream: internal.StreamBroadcast,
+			Tag:    DigestTag,
+		},
+	})
+	return err
+}
@@ -0,0 +1,427 @@
+package newsletter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/domain"
+)
+
+const (
+	defaultWorkers     = 8
+	defaultMaxAttempts = 3
+	defaultMinBackoff  = 500 * time.Millisecond
+	defaultMaxBackoff  = 30 * time.Second
+)
+
+// Sender sends a single email and returns the ID the provider gave it,
+// *internal.EmailClient is one.
+type Sender interface {
+	Send(ctx context.Context, message internal.Message) (string, error)
+}
+
+// BatchSender sends many emails in one call, *internal.EmailClient is one.
+// The engine hands it batches instead of single emails.
+type BatchSender interface {
+	Sender
+	SendBatch(ctx context.Context, messages []internal.Message) ([]string, []internal.BatchFailure)
+}
+
+// Delivery is one email for the engine to send. Render builds it once a worker
+// picks it up, so a large list is never rendered into memory at once.
+type Delivery struct {
+	To      domain.SubscriberEmail
+	Render  func() (RenderedIssue, error)
+	Options internal.MessageOptions
+}
+
+// Result is the outcome of a delivery: the ID the provider gave the email if
+// it was sent, the error if it wasn't.
+type Result struct {
+	MessageID string
+	Err       error
+}
+
+// RenderError wraps a failure to render a delivery, nothing was sent.
+type RenderError struct {
+	Err error
+}
+
+func (e *RenderError) Error() string {
+	return "failed to render email: " + e.Err.Error()
+}
+
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// Engine sends deliveries with a bounded number of workers, no faster than
+// the provider's rate limit, in batches if the sender supports them. Transient
+// failures, see internal.IsTransient, are tried again with the same
+// idempotency key, up to the max attempts and until the retry deadline.
+// Retries and throttled sends (429 and 5xx) pause every worker for a jittered
+// backoff, which grows while the provider keeps failing and shrinks again as
+// sends succeed.
+type Engine struct {
+	sender        Sender
+	workers       int
+	maxAttempts   int
+	retryDeadline time.Duration
+	limiter       *tokenBucket
+	backoff       *adaptiveBackoff
+}
+
+func NewEngine(sender Sender, settings internal.DeliverySettings) *Engine {
+	workers := settings.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	maxAttempts := settings.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	minBackoff, maxBackoff := settings.MinBackoff(), settings.MaxBackoff()
+	if minBackoff <= 0 {
+		minBackoff = defaultMinBackoff
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = max(defaultMaxBackoff, minBackoff)
+	}
+	return &Engine{
+		sender:      sender,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		limiter:     newTokenBucket(settings.RatePerSecond, settings.Burst),
+		backoff:     &adaptiveBackoff{min: minBackoff, max: maxBackoff},
+	}
+}
+
+// UseRetryDeadline stops retrying the messages of a send once the deadline
+// has passed since their first attempt. Zero retries up to the max attempts
+// however long they take.
+func (e *Engine) UseRetryDeadline(deadline time.Duration) {
+	e.retryDeadline = deadline
+}
+
+// SetRate changes the rate limit of the sends to come, see DeliverySettings.
+// Sends already waiting keep their turn.
+func (e *Engine) SetRate(ratePerSecond float64, burst int) {
+	e.limiter.mu.Lock()
+	defer e.limiter.mu.Unlock()
+	e.limiter.set(ratePerSecond, burst)
+}
+
+// Deliver sends every delivery and returns their results by index. Deliveries
+// not sent when ctx is done fail with its error.
+func (e *Engine) Deliver(ctx context.Context, deliveries []Delivery) []Result {
+	results := make([]Result, len(deliveries))
+	chunks := e.chunk(len(deliveries))
+	next := make(chan []int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(e.workers, len(chunks)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range next {
+				e.deliver(ctx, deliveries, chunk, results)
+			}
+		}()
+	}
+	for _, chunk := range chunks {
+		if ctx.Err() == nil {
+			select {
+			case next <- chunk:
+				continue
+			case <-ctx.Done():
+			}
+		}
+		for _, i := range chunk {
+			results[i].Err = ctx.Err()
+		}
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// chunk splits n deliveries into the chunks workers send together: batches
+// spread over the workers if the sender can send batches, single deliveries
+// otherwise.
+func (e *Engine) chunk(n int) [][]int {
+	size := 1
+	if _, ok := e.sender.(BatchSender); ok {
+		size = min(internal.MaxBatchSize, max(1, (n+e.workers-1)/e.workers))
+	}
+	var chunks [][]int
+	for start := 0; start < n; start += size {
+		chunk := make([]int, 0, size)
+		for i := start; i < min(start+size, n); i++ {
+			chunk = append(chunk, i)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// Send sends a single message that isn't part of a delivery, like a
+// confirmation email or a digest, under the same rate limit and backoff as
+// deliveries. It is tried once, the caller decides whether to try again, see
+// internal.IsTransient.
+func (e *Engine) Send(ctx context.Context, message internal.Message) (string, error) {
+	result := e.sendMessages(ctx, []internal.Message{message}, false, 1)[0]
+	return result.MessageID, result.Err
+}
+
+// deliver renders and sends the deliveries of a chunk, storing their results
+// in results.
+func (e *Engine) deliver(ctx context.Context, deliveries []Delivery, chunk []int, results []Result) {
+	pending := make([]int, 0, len(chunk))
+	messages := make([]internal.Message, 0, len(chunk))
+	for _, i := range chunk {
+		rendered, err := deliveries[i].Render()
+		if err != nil {
+			results[i].Err = &RenderError{Err: err}
+			continue
+		}
+		pending = append(pending, i)
+		messages = append(messages, internal.Message{
+			To:             deliveries[i].To,
+			Subject:        rendered.Subject,
+			HtmlBody:       rendered.Html,
+			TextBody:       rendered.Text,
+			MessageOptions: deliveries[i].Options,
+		})
+	}
+	if len(messages) == 0 {
+		return
+	}
+	_, batch := e.sender.(BatchSender)
+	for j, result := range e.sendMessages(ctx, messages, batch, e.maxAttempts) {
+		results[pending[j]] = result
+	}
+}
+
+// sendMessages sends the messages, in one batch if batch is true, and returns
+// their results by index. Transient failures are retried until they run out
+// of attempts or the retry deadline passes.
+func (e *Engine) sendMessages(ctx context.Context, messages []internal.Message, batch bool, maxAttempts int) []Result {
+	results := make([]Result, len(messages))
+	pending := make([]int, len(messages))
+	for j := range messages {
+		pending[j] = j
+		messages[j].Metadata = withIdempotencyKey(messages[j].Metadata)
+	}
+	var deadline time.Time
+	if e.retryDeadline > 0 {
+		deadline = time.Now().Add(e.retryDeadline)
+	}
+
+	for attempt := 1; len(pending) > 0; attempt++ {
+		waitUntil := time.Time{}
+		if attempt > 1 {
+			waitUntil = deadline
+		}
+		if err := e.wait(ctx, len(messages), waitUntil); err != nil {
+			if ctx.Err() != nil {
+				for _, i := range pending {
+					results[i].Err = err
+				}
+			}
+			// past the deadline, the messages keep the error of their last
+			// attempt
+			return results
+		}
+
+		var retry []int
+		var retryMessages []internal.Message
+		var slowedBy error
+		var retryAfter time.Duration
+		ids, failed := e.send(ctx, messages, batch)
+		for j, i := range pending {
+			err, ok := failed[j]
+			results[i] = Result{MessageID: ids[j], Err: err}
+			if !ok {
+				continue
+			}
+			transient := internal.IsTransient(err)
+			if transient && attempt < maxAttempts && (deadline.IsZero() || time.Now().Before(deadline)) {
+				retry = append(retry, i)
+				retryMessages = append(retryMessages, messages[j])
+			}
+			var statusErr *internal.StatusError
+			if errors.As(err, &statusErr) && statusErr.Throttled() {
+				slowedBy, retryAfter = err, statusErr.RetryAfter
+			} else if transient {
+				slowedBy = err
+			}
+		}
+		if slowedBy == nil {
+			if len(failed) < len(pending) {
+				e.backoff.succeeded()
+			}
+		} else {
+			e.backoff.throttled(retryAfter)
+		}
+		if len(retry) == 0 {
+			return results
+		}
+		logger.Debug().Err(slowedBy).Int("messages", len(retry)).Int("attempt", attempt).Msg("provider throttled, backing off")
+		pending, messages = retry, retryMessages
+	}
+	return results
+}
+
+// wait waits for the backoff to be over and for the rate limit to allow n
+// messages, giving up at the deadline unless it is zero.
+func (e *Engine) wait(ctx context.Context, n int, deadline time.Time) error {
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	if err := e.backoff.wait(ctx); err != nil {
+		return err
+	}
+	// every message counts against the rate, batched or not
+	return e.limiter.wait(ctx, n)
+}
+
+// withIdempotencyKey is the metadata with an idempotency key added, unless it
+// has one. The metadata passed in isn't changed, deliveries may share it.
+func withIdempotencyKey(metadata map[string]string) map[string]string {
+	if _, ok := metadata[internal.IdempotencyKey]; ok {
+		return metadata
+	}
+	keyed := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		keyed[k] = v
+	}
+	keyed[internal.IdempotencyKey] = uuid.NewString()
+	return keyed
+}
+
+// send sends the messages, one call for all of them if batch is true and the
+// sender can send batches. It returns the IDs of the messages, and the errors
+// of the ones that failed, by index.
+func (e *Engine) send(ctx context.Context, messages []internal.Message, batch bool) ([]string, map[int]error) {
+	failed := map[int]error{}
+	if sender, ok := e.sender.(BatchSender); ok && batch {
+		ids, failures := sender.SendBatch(ctx, messages)
+		for _, failure := range failures {
+			failed[failure.Index] = failure.Err
+		}
+		return ids, failed
+	}
+	ids := make([]string, len(messages))
+	for j, m := range messages {
+		id, err := e.sender.Send(ctx, m)
+		if err != nil {
+			failed[j] = err
+		}
+		ids[j] = id
+	}
+	return ids, failed
+}
+
+// tokenBucket allows rate events per second on average and bursts of up to
+// burst events. A zero rate allows everything.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := &tokenBucket{last: time.Now()}
+	b.set(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+// set changes the rate and burst. A zero burst is the rate rounded up.
+func (b *tokenBucket) set(rate float64, burst int) {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	b.rate = rate
+	b.burst = float64(burst)
+	b.tokens = math.Min(b.tokens, b.burst)
+}
+
+// wait takes n tokens, waiting for them if the bucket runs out.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	// taking the tokens up front reserves them, later callers queue behind
+	b.tokens -= float64(n)
+	delay := time.Duration(0)
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	return sleep(ctx, delay)
+}
+
+// adaptiveBackoff pauses every worker after the provider throttled a send.
+// The pause doubles with each throttled send and halves with each success,
+// and is jittered so workers and other instances don't retry in step.
+type adaptiveBackoff struct {
+	mu         sync.Mutex
+	min, max   time.Duration
+	delay      time.Duration
+	pauseUntil time.Time
+}
+
+func (b *adaptiveBackoff) wait(ctx context.Context) error {
+	b.mu.Lock()
+	delay := time.Until(b.pauseUntil)
+	b.mu.Unlock()
+	return sleep(ctx, delay)
+}
+
+func (b *adaptiveBackoff) throttled(retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.delay = min(max(b.delay*2, b.min), b.max)
+	pause := max(b.delay/2+rand.N(b.delay/2+1), retryAfter)
+	if until := time.Now().Add(pause); until.After(b.pauseUntil) {
+		b.pauseUntil = until
+	}
+}
+
+func (b *adaptiveBackoff) succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.delay /= 2
+	if b.delay < b.min {
+		b.delay = 0
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
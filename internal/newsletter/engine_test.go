@@ -0,0 +1,319 @@
+package newsletter_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSender records sends and their idempotency keys, failing each one with
+// respond's error.
+type fakeSender struct {
+	mu          sync.Mutex
+	calls       map[string]int
+	keys        []string
+	inFlight    int
+	maxInFlight int
+	delay       time.Duration
+	respond     func(to string, call int) error
+}
+
+func (f *fakeSender) Send(ctx context.Context, message internal.Message) (string, error) {
+	recipient := message.To
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = map[string]int{}
+	}
+	f.calls[recipient.String()]++
+	call := f.calls[recipient.String()]
+	f.keys = append(f.keys, message.Metadata[internal.IdempotencyKey])
+	f.inFlight++
+	f.maxInFlight = max(f.maxInFlight, f.inFlight)
+	f.mu.Unlock()
+
+	time.Sleep(f.delay)
+
+	f.mu.Lock()
+	f.inFlight--
+	f.mu.Unlock()
+	if f.respond != nil {
+		if err := f.respond(recipient.String(), call); err != nil {
+			return "", err
+		}
+	}
+	return "id-" + recipient.String(), nil
+}
+
+func deliveries(t *testing.T, n int) []newsletter.Delivery {
+	result := make([]newsletter.Delivery, n)
+	for i := range result {
+		email, err := domain.SubscriberEmailFrom(fmt.Sprintf("reader%d@example.com", i))
+		require.NoError(t, err)
+		result[i] = newsletter.Delivery{
+			To: email,
+			Render: func() (newsletter.RenderedIssue, error) {
+				return newsletter.RenderedIssue{Subject: "subject", Html: "html", Text: "text"}, nil
+			},
+		}
+	}
+	return result
+}
+
+func TestEngineBoundsConcurrentSends(t *testing.T) {
+	sender := &fakeSender{delay: 5 * time.Millisecond}
+	engine := newsletter.NewEngine(sender, internal.DeliverySettings{Workers: 3})
+
+	results := engine.Deliver(context.Background(), deliveries(t, 20))
+
+	for _, result := range results {
+		assert.NoError(t, result.Err)
+	}
+	assert.Len(t, sender.calls, 20)
+	assert.Equal(t, "id-reader7@example.com", results[7].MessageID)
+	assert.LessOrEqual(t, sender.maxInFlight, 3)
+	assert.Greater(t, sender.maxInFlight, 1)
+}
+
+func TestEngineKeepsToTheRateLimit(t *testing.T) {
+	sender := &fakeSender{}
+	engine := newsletter.NewEngine(sender, internal.DeliverySettings{Workers: 8, RatePerSecond: 100, Burst: 1})
+
+	start := time.Now()
+	engine.Deliver(context.Background(), deliveries(t, 11))
+
+	// the first send uses the burst, the other ten wait 10ms each
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	assert.Len(t, sender.calls, 11)
+}
+
+func TestEngineRetriesThrottledSends(t *testing.T) {
+	sender := &fakeSender{respond: func(to string, call int) error {
+		if call == 1 {
+			return &internal.StatusError{StatusCode: http.StatusTooManyRequests}
+		}
+		return nil
+	}}
+	engine := newsletter.NewEngine(sender, internal.DeliverySettings{MaxAttempts: 3, MinBackoffMilliseconds: 1, MaxBackoffMilliseconds: 5})
+
+	results := engine.Deliver(context.Background(), deliveries(t, 5))
+
+	for _, result := range results {
+		assert.NoError(t, result.Err)
+	}
+	for to, calls := range sender.calls {
+		assert.Equal(t, 2, calls, to)
+	}
+}
+
+func TestEngineGivesUpAfterMaxAttempts(t *testing.T) {
+	sender := &fakeSender{respond: func(string, int) error {
+		return &internal.StatusError{StatusCode: http.StatusTooManyRequests}
+	}}
+	engine := newsletter.NewEngine(sender, internal.DeliverySettings{MaxAttempts: 2, MinBackoffMilliseconds: 1, MaxBackoffMilliseconds: 2})
+
+	results := engine.Deliver(context.Background(), deliveries(t, 1))
+
+	var statusErr *internal.StatusError
+	require.ErrorAs(t, results[0].Err, &statusErr)
+	assert.Equal(t, http.StatusTooManyRequests, statusErr.StatusCode)
+	assert.Equal(t, 2, sender.calls["reader0@example.com"])
+}
+
+func TestEngineRetriesServerErrorsWithTheSameIdempotencyKey(t *testing.T) {
+	sender := &fakeSender{respond: func(to string, call int) error {
+		if call == 1 {
+			return &internal.StatusError{StatusCode: http.StatusServiceUnavailable}
+		}
+		return nil
+	}}
+	engine := newsletter.NewEngine(sender, internal.DeliverySettings{MaxAttempts: 3, MinBackoffMilliseconds: 1, MaxBackoffMilliseconds: 2})
+
+	results := engine.Deliver(context.Background(), deliveries(t, 1))
+
+	assert.NoError(t, results[0].Err)
+	assert.Equal(t, 2, sender.calls["reader0@example.com"])
+	require.Len(t, sender.keys, 2)
+	assert.NotEmpty(t, sender.keys[0])
+	assert.Equal(t, sender.keys[0], sender.keys[1])
+}
+
+func TestEngineStopsRetryingAtTheDeadline(t *testing.T) {
+	sender := &fakeSender{respond: func(string, int) error {
+		return &internal.StatusError{StatusCode: http.StatusServiceUnavailable}
+	}}
+	engine := newsletter.NewEngine(sender, internal.DeliverySettings{MaxAttempts: 100, MinBackoffMilliseconds: 20, MaxBackoffMilliseconds: 20})
+	engine.UseRetryDeadline(50 * time.Millisecond)
+
+	start := time.Now()
+	results := engine.Deliver(context.Background(), deliveries(t, 1))
+
+	assert.ErrorIs(t, results[0].Err, internal.ErrServerError)
+	assert.Less(t, sender.calls["reader0@example.com"], 10)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestEngineDoesNotRetryOtherErrors(t *testing.T) {
+	sender := &fakeSender{respond: func(string, int) error {
+		return &internal.StatusError{StatusCode: http.StatusUnprocessableEntity}
+	}}
+	engine := newsletter.NewEngine(sender, internal.DeliverySettings{MaxAttempts: 3})
+
+	results := engine.Deliver(context.Background(), deliveries(t, 1))
+
+	var statusErr *internal.StatusError
+	require.ErrorAs(t, results[0].Err, &statusErr)
+	assert.Equal(t, http.StatusUnprocessableEntity, statusErr.StatusCode)
+	assert.Equal(t, 1, sender.calls["reader0@example.com"])
+}
+
+func TestEngineReportsRenderErrors(t *testing.T) {
+	sender := &fakeSender{}
+	engine := newsletter.NewEngine(sender, internal.DeliverySettings{})
+	pending := deliveries(t, 2)
+	pending[1].Render = func() (newsletter.RenderedIssue, error) {
+		return newsletter.RenderedIssue{}, errors.New("broken template")
+	}
+
+	results := engine.Deliver(context.Background(), pending)
+
+	assert.NoError(t, results[0].Err)
+	var renderErr *newsletter.RenderError
+	assert.ErrorAs(t, results[1].Err, &renderErr)
+	assert.Len(t, sender.calls, 1)
+}
+
+func TestEngineStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sender := &fakeSender{respond: func(string, int) error {
+		cancel()
+		return nil
+	}}
+	engine := newsletter.NewEngine(sender, internal.DeliverySettings{Workers: 1})
+
+	results := engine.Deliver(ctx, deliveries(t, 10))
+
+	assert.NoError(t, results[0].Err)
+	for _, result := range results[1:] {
+		assert.ErrorIs(t, result.Err, context.Canceled)
+	}
+	assert.Len(t, sender.calls, 1)
+}
+
+// fakeBatchSender records the batches it is handed, failing the messages
+// respond returns an error for.
+type fakeBatchSender struct {
+	fakeSender
+	batches [][]internal.Message
+	respond func(to string, call int) error
+}
+
+func (f *fakeBatchSender) SendBatch(ctx context.Context, messages []internal.Message) ([]string, []internal.BatchFailure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.calls == nil {
+		f.calls = map[string]int{}
+	}
+	f.batches = append(f.batches, messages)
+	ids := make([]string, len(messages))
+	var failures []internal.BatchFailure
+	for i, m := range messages {
+		f.calls[m.To.String()]++
+		if f.respond != nil {
+			if err := f.respond(m.To.String(), f.calls[m.To.String()]); err != nil {
+				failures = append(failures, internal.BatchFailure{Index: i, Recipient: m.To, Err: err})
+				continue
+			}
+		}
+		ids[i] = "id-" + m.To.String()
+	}
+	return ids, failures
+}
+
+func TestEngineSendsBatchesSpreadOverTheWorkers(t *testing.T) {
+	sender := &fakeBatchSender{}
+	engine := newsletter.NewEngine(sender, internal.DeliverySettings{Workers: 4})
+	pending := deliveries(t, 10)
+	for i := range pending {
+		pending[i].Options = internal.MessageOptions{Stream: internal.StreamBroadcast, Tag: newsletter.IssueTag}
+	}
+
+	results := engine.Deliver(context.Background(), pending)
+
+	for i, result := range results {
+		assert.NoError(t, result.Err)
+		assert.Equal(t, fmt.Sprintf("id-reader%d@example.com", i), result.MessageID)
+	}
+	assert.Len(t, sender.calls, 10)
+	require.Len(t, sender.batches, 4)
+	for _, batch := range sender.batches {
+		for _, message := range batch {
+			assert.Equal(t, internal.StreamBroadcast, message.Stream)
+			assert.Equal(t, newsletter.IssueTag, message.Tag)
+		}
+	}
+}
+
+func TestEngineRetriesOnlyTheThrottledMessagesOfABatch(t *testing.T) {
+	rejected := errors.New("inactive recipient")
+	sender := &fakeBatchSender{respond: func(to string, call int) error {
+		switch {
+		case to == "reader0@example.com":
+			return rejected
+		case to == "reader1@example.com" && call == 1:
+			return &internal.StatusError{StatusCode: http.StatusTooManyRequests}
+		}
+		return nil
+	}}
+	engine := newsletter.NewEngine(sender, internal.DeliverySettings{Workers: 1, MaxAttempts: 3, MinBackoffMilliseconds: 1, MaxBackoffMilliseconds: 5})
+
+	results := engine.Deliver(context.Background(), deliveries(t, 3))
+
+	assert.ErrorIs(t, results[0].Err, rejected)
+	assert.NoError(t, results[1].Err)
+	assert.NoError(t, results[2].Err)
+	require.Len(t, sender.batches, 2)
+	require.Len(t, sender.batches[1], 1)
+	assert.Equal(t, "reader1@example.com", sender.batches[1][0].To.String())
+}
+
+func TestEngineChargesTheRateForEveryMessageOfABatch(t *testing.T) {
+	sender := &fakeBatchSender{}
+	engine := newsletter.NewEngine(sender, internal.DeliverySettings{Workers: 1, RatePerSecond: 100, Burst: 1})
+
+	start := time.Now()
+	engine.Deliver(context.Background(), deliveries(t, 11))
+	engine.Deliver(context.Background(), deliveries(t, 1))
+
+	// the batch of eleven takes ten tokens more than the burst, the next
+	// send waits for them
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Len(t, sender.batches, 2)
+}
+
+func TestEngineSendsSingleMessagesUnderTheRateLimit(t *testing.T) {
+	sender := &fakeBatchSender{}
+	engine := newsletter.NewEngine(sender, internal.DeliverySettings{RatePerSecond: 100, Burst: 1})
+	email, err := domain.SubscriberEmailFrom("reader@example.com")
+	require.NoError(t, err)
+
+	start := time.Now()
+	for range 3 {
+		id, err := engine.Send(context.Background(), internal.Message{To: email, Subject: "Welcome!"})
+		require.NoError(t, err)
+		assert.Equal(t, "id-reader@example.com", id)
+	}
+
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.Equal(t, 3, sender.calls["reader@example.com"])
+	assert.Empty(t, sender.batches)
+}
@@ -0,0 +1,208 @@
+package newsletter
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"net/url"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+)
+
+// Recipient is the data the title and content of a templated issue can refer
+// to, e.g. "Hi {{.Name}}".
+type Recipient struct {
+	Name  string
+	Email string
+	// PreferencesToken links the email to the subscriber's preference center,
+	// it is empty for anyone but a subscriber receiving an issue.
+	PreferencesToken string
+	// SubscriptionID identifies the subscriber in tracking links, tracking
+	// is off without one or when the subscriber opted out.
+	SubscriptionID string
+	TrackingOptOut bool
+}
+
+// SampleRecipient stands in for a subscriber when previewing an issue.
+var SampleRecipient = Recipient{
+	Name:  "Sample Subscriber",
+	Email: "subscriber@example.com",
+}
+
+// ArchiveRecipient stands in for the anonymous reader of the public archive.
+var ArchiveRecipient = Recipient{
+	Name: "Reader",
+}
+
+type RenderedIssue struct {
+	Subject string
+	Html    string
+	Text    string
+}
+
+type templateData struct {
+	Recipient
+	ViewInBrowserURL string
+	PreferencesURL   string
+}
+
+type Renderer struct {
+	baseURL string
+	tracker *Tracker
+}
+
+func NewRenderer(baseURL string) *Renderer {
+	return &Renderer{baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// UseTracker tracks opens and clicks of issues with tracking turned on, a nil
+// tracker turns tracking off.
+func (r *Renderer) UseTracker(tracker *Tracker) {
+	r.tracker = tracker
+}
+
+// ArchiveURL is the public web address of an issue, empty for issues that
+// were never stored.
+func (r *Renderer) ArchiveURL(issue models.NewsletterIssue) string {
+	if issue.Slug == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/archive/%s", r.baseURL, issue.Slug)
+}
+
+// PreferencesURL is the address of the recipient's preference center, empty
+// for recipients without a preferences token.
+func (r *Renderer) PreferencesURL(recipient Recipient) string {
+	if recipient.PreferencesToken == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/preferences?token=%s", r.baseURL, url.QueryEscape(recipient.PreferencesToken))
+}
+
+// IssuePreferencesURL is the preferences link of an issue. It names the issue
+// so unsubscribes can be attributed to it.
+func (r *Renderer) IssuePreferencesURL(issue models.NewsletterIssue, recipient Recipient) string {
+	preferencesURL := r.PreferencesURL(recipient)
+	if preferencesURL == "" || issue.ID == "" {
+		return preferencesURL
+	}
+	return fmt.Sprintf("%s&issue=%s", preferencesURL, url.QueryEscape(issue.ID))
+}
+
+// Validate checks that the title and content of a templated issue are valid
+// templates. Other issues are always valid.
+func Validate(issue models.NewsletterIssue) error {
+	_, err := NewRenderer("").Render(issue, SampleRecipient)
+	return err
+}
+
+// Render renders an issue exactly as the recipient receives it, including the
+// "view in browser" and preferences footers and any tracking.
+func (r *Renderer) Render(issue models.NewsletterIssue, recipient Recipient) (RenderedIssue, error) {
+	data := templateData{Recipient: recipient, ViewInBrowserURL: r.ArchiveURL(issue), PreferencesURL: r.IssuePreferencesURL(issue, recipient)}
+	rendered, err := render(issue, data)
+	if err != nil {
+		return RenderedIssue{}, err
+	}
+	if data.ViewInBrowserURL != "" {
+		rendered.Html += fmt.Sprintf(`<p><a href="%s">View this issue in your browser</a></p>`, htmltemplate.HTMLEscapeString(data.ViewInBrowserURL))
+		rendered.Text += fmt.Sprintf("\n\nView this issue in your browser: %s", data.ViewInBrowserURL)
+	}
+	r.addPreferencesFooter(&rendered, data.PreferencesURL)
+	if r.tracks(issue, recipient) {
+		// the preferences link keeps working for subscribers who block tracking
+		rendered = r.tracker.Track(rendered, issue.ID, recipient.SubscriptionID, data.PreferencesURL)
+	}
+	return rendered, nil
+}
+
+func (r *Renderer) tracks(issue models.NewsletterIssue, recipient Recipient) bool {
+	return r.tracker != nil && issue.Tracking && issue.ID != "" && recipient.SubscriptionID != "" && !recipient.TrackingOptOut
+}
+
+func (r *Renderer) addPreferencesFooter(rendered *RenderedIssue, preferencesURL string) {
+	if preferencesURL == "" {
+		return
+	}
+	rendered.Html += fmt.Sprintf(`<p><a href="%s">Manage your preferences or unsubscribe</a></p>`, htmltemplate.HTMLEscapeString(preferencesURL))
+	rendered.Text += fmt.Sprintf("\n\nManage your preferences or unsubscribe: %s", preferencesURL)
+}
+
+// RenderArchive renders an issue for the public archive and feeds.
+func (r *Renderer) RenderArchive(issue models.NewsletterIssue) (RenderedIssue, error) {
+	return render(issue, templateData{Recipient: ArchiveRecipient, ViewInBrowserURL: r.ArchiveURL(issue)})
+}
+
+// render executes the title and content templates of a templated issue. The
+// HTML body is rendered with html/template so recipient data is escaped.
+// Issues that aren't templated are taken as they are, so content like code
+// samples can contain {{ without being mistaken for a template.
+func render(issue models.NewsletterIssue, data templateData) (RenderedIssue, error) {
+	if !issue.Templated {
+		return RenderedIssue{Subject: issue.Title, Html: issue.HtmlContent, Text: issue.TextContent}, nil
+	}
+	subject, err := renderText("subject", issue.Title, data)
+	if err != nil {
+		return RenderedIssue{}, err
+	}
+	text, err := renderText("text", issue.TextContent, data)
+	if err != nil {
+		return RenderedIssue{}, err
+	}
+	html, err := renderHtml("html", issue.HtmlContent, data)
+	if err != nil {
+		return RenderedIssue{}, err
+	}
+	return RenderedIssue{Subject: subject, Html: html, Text: text}, nil
+}
+
+var (
+	templateActions = regexp.MustCompile(`{{.*?}}`)
+	nonSlugChars    = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+const maxSlugLength = 60
+
+// Slug builds the archive slug of an issue from its title and ID.
+func Slug(title, id string) string {
+	slug := templateActions.ReplaceAllString(strings.ToLower(title), "")
+	slug = strings.Trim(nonSlugChars.ReplaceAllString(slug, "-"), "-")
+	if len(slug) > maxSlugLength {
+		slug = strings.TrimRight(slug[:maxSlugLength], "-")
+	}
+	if slug == "" {
+		slug = "issue"
+	}
+	suffix := strings.ReplaceAll(id, "-", "")
+	if len(suffix) > 8 {
+		suffix = suffix[:8]
+	}
+	return fmt.Sprintf("%s-%s", slug, suffix)
+}
+
+func renderText(name, content string, data any) (string, error) {
+	tmpl, err := texttemplate.New(name).Option("missingkey=error").Parse(content)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func renderHtml(name, content string, data any) (string, error) {
+	tmpl, err := htmltemplate.New(name).Option("missingkey=error").Parse(content)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,94 @@
+package newsletter_test
+
+import (
+	"testing"
+
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderPersonalizesTheIssue(t *testing.T) {
+	issue := models.NewsletterIssue{
+		Title:       "Hello {{.Name}}",
+		HtmlContent: "<p>Hi {{.Name}} ({{.Email}})</p>",
+		TextContent: "Hi {{.Name}}",
+		Templated:   true,
+	}
+	rendered, err := newsletter.NewRenderer("http://127.0.0.1").Render(issue, newsletter.Recipient{Name: "le guin", Email: "ursula@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "Hello le guin", rendered.Subject)
+	assert.Equal(t, "<p>Hi le guin (ursula@example.com)</p>", rendered.Html)
+	assert.Equal(t, "Hi le guin", rendered.Text)
+}
+
+func TestRenderEscapesRecipientDataInHtml(t *testing.T) {
+	issue := models.NewsletterIssue{Title: "t", HtmlContent: "<p>{{.Name}}</p>", TextContent: "{{.Name}}", Templated: true}
+	rendered, err := newsletter.NewRenderer("http://127.0.0.1").Render(issue, newsletter.Recipient{Name: "<script>"})
+	require.NoError(t, err)
+	assert.Equal(t, "<p>&lt;script&gt;</p>", rendered.Html)
+	assert.Equal(t, "<script>", rendered.Text)
+}
+
+func TestValidateRejectsBrokenTemplates(t *testing.T) {
+	assert.Error(t, newsletter.Validate(models.NewsletterIssue{Title: "{{.Name", HtmlContent: "h", TextContent: "t", Templated: true}))
+	assert.Error(t, newsletter.Validate(models.NewsletterIssue{Title: "t", HtmlContent: "{{.Unknown}}", TextContent: "t", Templated: true}))
+	assert.NoError(t, newsletter.Validate(models.NewsletterIssue{Title: "t", HtmlContent: "<p>h</p>", TextContent: "t", Templated: true}))
+}
+
+func TestIssuesThatArentTemplatedAreSentAsWritten(t *testing.T) {
+	issue := models.NewsletterIssue{Title: "Go {{generics", HtmlContent: "<p>{{.Name}} and {{</p>", TextContent: "{{.Unknown}}"}
+	assert.NoError(t, newsletter.Validate(issue))
+	rendered, err := newsletter.NewRenderer("http://127.0.0.1").Render(issue, newsletter.Recipient{Name: "le guin"})
+	require.NoError(t, err)
+	assert.Equal(t, "Go {{generics", rendered.Subject)
+	assert.Equal(t, "<p>{{.Name}} and {{</p>", rendered.Html)
+	assert.Equal(t, "{{.Unknown}}", rendered.Text)
+}
+
+func TestRenderAddsAViewInBrowserLinkForStoredIssues(t *testing.T) {
+	issue := models.NewsletterIssue{Title: "t", Slug: "t-1234abcd", HtmlContent: "<p>h</p>", TextContent: "t"}
+	rendered, err := newsletter.NewRenderer("https://example.com/").Render(issue, newsletter.SampleRecipient)
+	require.NoError(t, err)
+	assert.Equal(t, `<p>h</p><p><a href="https://example.com/archive/t-1234abcd">View this issue in your browser</a></p>`, rendered.Html)
+	assert.Equal(t, "t\n\nView this issue in your browser: https://example.com/archive/t-1234abcd", rendered.Text)
+}
+
+func TestSlug(t *testing.T) {
+	id := "0b76904a-5b1c-4f3e-9d2a-1c2b3d4e5f60"
+	assert.Equal(t, "hello-world-0b76904a", newsletter.Slug("Hello, World!", id))
+	assert.Equal(t, "news-for-0b76904a", newsletter.Slug("News for {{.Name}}", id))
+	assert.Equal(t, "issue-0b76904a", newsletter.Slug("{{.Name}}", id))
+	assert.Equal(t, "a-very-long-title-that-keeps-going-and-going-and-going-past-0b76904a",
+		newsletter.Slug("A very long title that keeps going and going and going past the limit", id))
+}
+
+func TestRenderAddsAPreferencesLinkForSubscribers(t *testing.T) {
+	issue := models.NewsletterIssue{Title: "t", HtmlContent: "<p>h</p>", TextContent: "t"}
+	recipient := newsletter.Recipient{Name: "le guin", Email: "ursula@example.com", PreferencesToken: "abc"}
+	rendered, err := newsletter.NewRenderer("https://example.com").Render(issue, recipient)
+	require.NoError(t, err)
+	assert.Equal(t, `<p>h</p><p><a href="https://example.com/preferences?token=abc">Manage your preferences or unsubscribe</a></p>`, rendered.Html)
+	assert.Equal(t, "t\n\nManage your preferences or unsubscribe: https://example.com/preferences?token=abc", rendered.Text)
+
+	issue.ID = "issue"
+	rendered, err = newsletter.NewRenderer("https://example.com").Render(issue, recipient)
+	require.NoError(t, err)
+	assert.Contains(t, rendered.Text, "https://example.com/preferences?token=abc&issue=issue")
+}
+
+func TestRenderDigestBundlesIssues(t *testing.T) {
+	issues := []models.NewsletterIssue{
+		{Title: "First for {{.Name}}", HtmlContent: "<p>one</p>", TextContent: "one", Templated: true},
+		{Title: "Second", HtmlContent: "<p>two</p>", TextContent: "two"},
+	}
+	recipient := newsletter.Recipient{Name: "le guin", PreferencesToken: "abc"}
+	rendered, err := newsletter.NewRenderer("https://example.com").RenderDigest(issues, recipient)
+	require.NoError(t, err)
+	assert.Equal(t, "Your weekly digest", rendered.Subject)
+	assert.Equal(t, `<h2>First for le guin</h2><p>one</p><hr><h2>Second</h2><p>two</p>`+
+		`<p><a href="https://example.com/preferences?token=abc">Manage your preferences or unsubscribe</a></p>`, rendered.Html)
+	assert.Equal(t, "First for le guin\n\none\n\n---\n\nSecond\n\ntwo"+
+		"\n\nManage your preferences or unsubscribe: https://example.com/preferences?token=abc", rendered.Text)
+}
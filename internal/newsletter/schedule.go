@@ -0,0 +1,100 @@
+package newsletter
+
+import (
+	"errors"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/domain"
+)
+
+// sendAtLayouts are the accepted send_at formats without an explicit offset,
+// they are read as wall-clock time in the issue's time zone.
+var sendAtLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+}
+
+// earliestZone is the first time zone to reach any given wall-clock time.
+var earliestZone = time.FixedZone("UTC+14", 14*60*60)
+
+// Schedule describes when an issue goes out. With RecipientTimeZone set, the
+// wall-clock time of SendAt in TimeZone is used in each recipient's own zone,
+// recipients without a known zone fall back to TimeZone.
+type Schedule struct {
+	SendAt            time.Time
+	TimeZone          domain.TimeZone
+	RecipientTimeZone bool
+}
+
+func ParseSchedule(sendAt, timeZone string, recipientTimeZone bool) (Schedule, error) {
+	tz := domain.TimeZone("UTC")
+	if timeZone != "" {
+		parsed, err := domain.TimeZoneFrom(timeZone)
+		if err != nil {
+			return Schedule{}, err
+		}
+		tz = parsed
+	}
+
+	at, err := parseSendAt(sendAt, tz.Location())
+	if err != nil {
+		return Schedule{}, err
+	}
+	return Schedule{SendAt: at, TimeZone: tz, RecipientTimeZone: recipientTimeZone}, nil
+}
+
+func parseSendAt(sendAt string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, sendAt); err == nil {
+		return t, nil
+	}
+	for _, layout := range sendAtLayouts {
+		if t, err := time.ParseInLocation(layout, sendAt, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("invalid send_at")
+}
+
+// ScheduleOf rebuilds the schedule stored on an issue.
+func ScheduleOf(issue models.NewsletterIssue) Schedule {
+	schedule := Schedule{
+		TimeZone:          domain.TimeZone(issue.TimeZone),
+		RecipientTimeZone: issue.RecipientTimeZone,
+	}
+	if issue.SendAt != nil {
+		schedule.SendAt = *issue.SendAt
+	}
+	return schedule
+}
+
+// StartsAt is the moment the first recipient of the issue is due.
+func (s Schedule) StartsAt() time.Time {
+	if !s.RecipientTimeZone {
+		return s.SendAt
+	}
+	return wallClockIn(s.SendAt.In(s.TimeZone.Location()), earliestZone)
+}
+
+// DeliverAt is the moment the issue is due for a recipient in the given zone.
+func (s Schedule) DeliverAt(recipient domain.TimeZone) time.Time {
+	if !s.RecipientTimeZone || recipient == "" {
+		return s.SendAt
+	}
+	return wallClockIn(s.SendAt.In(s.TimeZone.Location()), recipient.Location())
+}
+
+// Apply stores the schedule on the issue.
+func (s Schedule) Apply(issue *models.NewsletterIssue) {
+	sendAt := s.SendAt.UTC()
+	startsAt := s.StartsAt().UTC()
+	issue.SendAt = &sendAt
+	issue.StartsAt = &startsAt
+	issue.TimeZone = s.TimeZone.String()
+	issue.RecipientTimeZone = s.RecipientTimeZone
+}
+
+func wallClockIn(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
@@ -0,0 +1,45 @@
+package newsletter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScheduleReadsWallClockTimeInTheTimeZone(t *testing.T) {
+	schedule, err := newsletter.ParseSchedule("2030-06-03T09:00", "Europe/Berlin", false)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2030, 6, 3, 7, 0, 0, 0, time.UTC), schedule.SendAt.UTC())
+	assert.Equal(t, schedule.SendAt, schedule.StartsAt())
+	assert.Equal(t, schedule.SendAt, schedule.DeliverAt("America/New_York"))
+}
+
+func TestParseScheduleAcceptsRFC3339(t *testing.T) {
+	schedule, err := newsletter.ParseSchedule("2030-06-03T09:00:00Z", "", false)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2030, 6, 3, 9, 0, 0, 0, time.UTC), schedule.SendAt.UTC())
+	assert.Equal(t, domain.TimeZone("UTC"), schedule.TimeZone)
+}
+
+func TestParseScheduleRejectsInvalidInput(t *testing.T) {
+	_, err := newsletter.ParseSchedule("monday morning", "UTC", false)
+	assert.Error(t, err)
+	_, err = newsletter.ParseSchedule("2030-06-03T09:00", "Mars/Olympus_Mons", false)
+	assert.Error(t, err)
+}
+
+func TestRecipientTimeZoneSchedules(t *testing.T) {
+	schedule, err := newsletter.ParseSchedule("2030-06-03T09:00", "Europe/London", true)
+	require.NoError(t, err)
+
+	// The first recipients are in UTC+14.
+	assert.Equal(t, time.Date(2030, 6, 2, 19, 0, 0, 0, time.UTC), schedule.StartsAt().UTC())
+	assert.Equal(t, time.Date(2030, 6, 3, 0, 0, 0, 0, time.UTC), schedule.DeliverAt("Asia/Tokyo").UTC())
+	assert.Equal(t, time.Date(2030, 6, 3, 13, 0, 0, 0, time.UTC), schedule.DeliverAt("America/New_York").UTC())
+	// Recipients without a time zone fall back to the issue's time zone.
+	assert.Equal(t, time.Date(2030, 6, 3, 8, 0, 0, 0, time.UTC), schedule.DeliverAt("").UTC())
+}
@@ -0,0 +1,275 @@
+package newsletter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPollInterval = time.Second
+	// deliveryBatchSize is how many delivery tasks are claimed and handed to
+	// the engine at once
+	deliveryBatchSize = 100
+	// deliveryLease is how long claimed tasks are hidden from other claims
+	// while they are sent. Tasks whose outcome wasn't stored by then, because
+	// the instance sending them died, are sent again.
+	deliveryLease = 10 * time.Minute
+)
+
+var logger = internal.Logger()
+
+// Scheduler starts scheduled issues once they are due, works through the
+// issue delivery queue and sends weekly digests. All of its state lives in
+// the database, so pending issues and deliveries survive a restart.
+type Scheduler struct {
+	db       *gorm.DB
+	renderer *Renderer
+	engine   *Engine
+	interval time.Duration
+}
+
+func NewScheduler(db *gorm.DB, renderer *Renderer, engine *Engine, settings internal.SchedulerSettings) *Scheduler {
+	interval := settings.PollInterval()
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	return &Scheduler{
+		db:       db,
+		renderer: renderer,
+		engine:   engine,
+		interval: interval,
+	}
+}
+
+// Run polls the database until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	ctx = logger.WithContext(ctx)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.tick(ctx)
+		select {
+		case <-ctx.Done():
+			logger.Debug().Msg("scheduler stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) tick(ctx context.Context) {
+	db := s.db.WithContext(ctx)
+	for ctx.Err() == nil {
+		started, err := s.startDueIssue(db, time.Now())
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to start scheduled issue")
+			break
+		}
+		if !started {
+			break
+		}
+	}
+
+	for ctx.Err() == nil {
+		found, err := s.deliverDueTasks(ctx, db, time.Now())
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to process delivery task")
+			break
+		}
+		if !found {
+			break
+		}
+	}
+
+	if err := s.completeIssues(db, time.Now()); err != nil {
+		logger.Error().Err(err).Msg("failed to complete issues")
+	}
+
+	for ctx.Err() == nil {
+		found, err := s.sendNextDigest(db, time.Now())
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to send digest")
+			break
+		}
+		if !found {
+			break
+		}
+	}
+}
+
+// startDueIssue moves one due issue from scheduled to sending and enqueues a
+// delivery task for each confirmed subscriber.
+func (s *Scheduler) startDueIssue(db *gorm.DB, now time.Time) (bool, error) {
+	started := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var issue models.NewsletterIssue
+		result := database.Claim(tx).
+			Where("status = ? AND starts_at <= ?", models.IssueStatusScheduled, now).
+			Order("starts_at").Limit(1).Find(&issue)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+
+		listIDs, err := IssueListIDs(tx, issue.ID)
+		if err != nil {
+			return err
+		}
+		subscribers, err := ConfirmedSubscribers(tx, listIDs, now)
+		if err != nil {
+			return err
+		}
+		schedule := ScheduleOf(issue)
+		tasks := make([]models.IssueDeliveryTask, 0, len(subscribers))
+		for _, subscriber := range subscribers {
+			tasks = append(tasks, models.IssueDeliveryTask{
+				NewsletterIssueID: issue.ID,
+				SubscriberEmail:   subscriber.Email.String(),
+				ExecuteAfter:      schedule.DeliverAt(subscriber.TimeZone).UTC(),
+			})
+		}
+		if len(tasks) > 0 {
+			if err := tx.CreateInBatches(tasks, 500).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&issue).Update("status", models.IssueStatusSending).Error; err != nil {
+			return err
+		}
+		logger.Debug().Str("issue ID", issue.ID).Int("recipients", len(tasks)).Msg("scheduled issue started")
+		started = true
+		return nil
+	})
+	return started, err
+}
+
+// deliverDueTasks sends a batch of due delivery tasks through the engine. It
+// reports whether any task was found. The tasks are claimed with a lease in
+// one short transaction and settled in another, no transaction is open while
+// they are sent. Tasks the engine didn't get to before ctx was cancelled are
+// left for the next run.
+func (s *Scheduler) deliverDueTasks(ctx context.Context, db *gorm.DB, now time.Time) (bool, error) {
+	// the outcome of sends that went out must be stored even while shutting down
+	db = db.WithContext(context.WithoutCancel(ctx))
+	found := false
+	var pending []pendingTask
+	var deliveries []Delivery
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var tasks []models.IssueDeliveryTask
+		err := database.Claim(tx).
+			Where("execute_after <= ?", now).
+			Order("execute_after").Limit(deliveryBatchSize).Find(&tasks).Error
+		if err != nil {
+			return err
+		}
+		found = len(tasks) > 0
+
+		issues := map[string]models.NewsletterIssue{}
+		attachments := map[string][]internal.Attachment{}
+		for _, task := range tasks {
+			issue, ok := issues[task.NewsletterIssueID]
+			if !ok {
+				if err := tx.Where("newsletter_issue_id = ?", task.NewsletterIssueID).First(&issue).Error; err != nil {
+					return err
+				}
+				issues[issue.ID] = issue
+				if attachments[issue.ID], err = IssueAttachments(tx, issue.ID); err != nil {
+					return err
+				}
+			}
+			email, err := domain.SubscriberEmailFrom(task.SubscriberEmail)
+			if err != nil {
+				logger.Warn().Err(err).Str("email", task.SubscriberEmail).Msg("skipping invalid subscriber email")
+				if err := tx.Delete(&task).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			recipient, err := RecipientFor(tx, email.String())
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				recipient = Recipient{Email: email.String()}
+			} else if err != nil {
+				return err
+			}
+			leased := task
+			if err := tx.Model(&leased).Update("execute_after", now.Add(deliveryLease).UTC()).Error; err != nil {
+				return err
+			}
+			pending = append(pending, pendingTask{task: task, recipient: recipient})
+			deliveries = append(deliveries, IssueDelivery(s.renderer, issue, attachments[issue.ID], email, recipient))
+		}
+		return nil
+	})
+	if err != nil || len(pending) == 0 {
+		return found, err
+	}
+
+	results := s.engine.Deliver(ctx, deliveries)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i, result := range results {
+			if err := s.settle(tx, pending[i], result); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// pendingTask is a claimed delivery task, as it was before its lease, and the
+// recipient it goes to.
+type pendingTask struct {
+	task      models.IssueDeliveryTask
+	recipient Recipient
+}
+
+// settle records the outcome of sending a task.
+func (s *Scheduler) settle(tx *gorm.DB, p pendingTask, result Result) error {
+	sendErr := result.Err
+	var renderErr *RenderError
+	switch {
+	case errors.Is(sendErr, context.Canceled), errors.Is(sendErr, context.DeadlineExceeded):
+		// not sent, the lease is given back for the next run to send it
+		return tx.Model(&p.task).Update("execute_after", p.task.ExecuteAfter).Error
+	case errors.As(sendErr, &renderErr):
+		logger.Error().Err(sendErr).Str("issue ID", p.task.NewsletterIssueID).Msg("failed to render issue")
+		return tx.Delete(&p.task).Error
+	case errors.Is(sendErr, internal.ErrRecipientSuppressed):
+		logger.Debug().Str("issue ID", p.task.NewsletterIssueID).Str("email", p.task.SubscriberEmail).Msg("skipping suppressed subscriber")
+		return tx.Delete(&p.task).Error
+	case sendErr != nil:
+		// the engine retried what could be, the rest failed for good
+		logger.Error().Err(sendErr).Str("issue ID", p.task.NewsletterIssueID).Str("email", p.task.SubscriberEmail).Msg("giving up on delivery")
+		if err := RecordDelivery(tx, p.task.NewsletterIssueID, p.recipient, "", sendErr); err != nil {
+			return err
+		}
+		return tx.Delete(&p.task).Error
+	}
+	logger.Trace().Str("issue ID", p.task.NewsletterIssueID).Msgf("sent email to %s", p.task.SubscriberEmail)
+	if err := RecordDelivery(tx, p.task.NewsletterIssueID, p.recipient, result.MessageID, nil); err != nil {
+		return err
+	}
+	return tx.Delete(&p.task).Error
+}
+
+// completeIssues marks scheduled issues without pending delivery tasks as
+// sent. Issues sent right away have no schedule, the request sending them
+// completes them.
+func (s *Scheduler) completeIssues(db *gorm.DB, now time.Time) error {
+	return db.Model(&models.NewsletterIssue{}).
+		Where("status = ? AND starts_at IS NOT NULL", models.IssueStatusSending).
+		Where("NOT EXISTS (SELECT 1 FROM issue_delivery_queue WHERE issue_delivery_queue.newsletter_issue_id = newsletter_issues.newsletter_issue_id)").
+		Updates(map[string]interface{}{
+			"status":       models.IssueStatusSent,
+			"published_at": now.UTC(),
+		}).Error
+}
@@ -0,0 +1,160 @@
+package newsletter
+
+import (
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"gorm.io/gorm"
+)
+
+const (
+	StatsBucketSize  = time.Hour
+	StatsBuckets     = 48
+	statsTopLinksCap = 10
+)
+
+// IssueStats summarizes how an issue performed.
+type IssueStats struct {
+	IssueID      string        `json:"issue_id"`
+	Title        string        `json:"title"`
+	Status       string        `json:"status"`
+	Sent         int64         `json:"sent"`
+	Delivered    int64         `json:"delivered"`
+	Failed       int64         `json:"failed"`
+	Bounced      int64         `json:"bounced"`
+	UniqueOpens  int64         `json:"unique_opens"`
+	UniqueClicks int64         `json:"unique_clicks"`
+	TopLinks     []LinkStats   `json:"top_links"`
+	Unsubscribes int64         `json:"unsubscribes"`
+	Timeline     []StatsBucket `json:"timeline"`
+}
+
+type LinkStats struct {
+	URL          string `json:"url"`
+	Clicks       int64  `json:"clicks"`
+	UniqueClicks int64  `json:"unique_clicks"`
+}
+
+// StatsBucket counts the opens and clicks of one hour after the issue went
+// out.
+type StatsBucket struct {
+	Start  time.Time `json:"start"`
+	Opens  int64     `json:"opens"`
+	Clicks int64     `json:"clicks"`
+}
+
+// Stats computes the report of an issue from its deliveries, tracking events
+// and the unsubscribes its preferences links led to.
+func Stats(db *gorm.DB, issue models.NewsletterIssue) (IssueStats, error) {
+	stats := IssueStats{IssueID: issue.ID, Title: issue.Title, Status: issue.Status, TopLinks: []LinkStats{}}
+
+	var statuses []struct {
+		Status string
+		Count  int64
+	}
+	err := db.Model(&models.IssueDelivery{}).Select("status, COUNT(*) AS count").
+		Where("newsletter_issue_id = ?", issue.ID).Group("status").Scan(&statuses).Error
+	if err != nil {
+		return IssueStats{}, err
+	}
+	for _, s := range statuses {
+		switch s.Status {
+		case models.DeliveryStatusDelivered:
+			stats.Delivered += s.Count
+		case models.DeliveryStatusBounced:
+			stats.Bounced += s.Count
+		case models.DeliveryStatusFailed:
+			stats.Failed += s.Count
+			continue
+		}
+		// every delivery that left for the provider counts as sent
+		stats.Sent += s.Count
+	}
+
+	if stats.UniqueOpens, err = uniqueSubscribers(db, issue.ID, models.TrackingEventOpen); err != nil {
+		return IssueStats{}, err
+	}
+	if stats.UniqueClicks, err = uniqueSubscribers(db, issue.ID, models.TrackingEventClick); err != nil {
+		return IssueStats{}, err
+	}
+	err = db.Model(&models.TrackingEvent{}).
+		Select("url, COUNT(*) AS clicks, COUNT(DISTINCT subscription_id) AS unique_clicks").
+		Where("newsletter_issue_id = ? AND kind = ?", issue.ID, models.TrackingEventClick).
+		Group("url").Order("clicks DESC").Order("url").Limit(statsTopLinksCap).
+		Scan(&stats.TopLinks).Error
+	if err != nil {
+		return IssueStats{}, err
+	}
+
+	err = db.Model(&models.SubscriptionAuditEntry{}).Distinct("subscription_id").
+		Where("newsletter_issue_id = ? AND action IN ?", issue.ID, []string{models.AuditActionUnsubscribedAll, models.AuditActionListUnsubscribed}).
+		Count(&stats.Unsubscribes).Error
+	if err != nil {
+		return IssueStats{}, err
+	}
+
+	stats.Timeline, err = timeline(db, issue)
+	if err != nil {
+		return IssueStats{}, err
+	}
+	return stats, nil
+}
+
+func uniqueSubscribers(db *gorm.DB, issueID, kind string) (int64, error) {
+	var count int64
+	err := db.Model(&models.TrackingEvent{}).Distinct("subscription_id").
+		Where("newsletter_issue_id = ? AND kind = ?", issueID, kind).Count(&count).Error
+	return count, err
+}
+
+// timeline buckets the events of the first StatsBuckets hours after the first
+// delivery of the issue.
+func timeline(db *gorm.DB, issue models.NewsletterIssue) ([]StatsBucket, error) {
+	start, err := issueStart(db, issue)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]StatsBucket, StatsBuckets)
+	for i := range buckets {
+		buckets[i].Start = start.Add(time.Duration(i) * StatsBucketSize)
+	}
+
+	var events []models.TrackingEvent
+	err = db.Select("kind", "created_at").
+		Where("newsletter_issue_id = ? AND created_at >= ? AND created_at < ?", issue.ID, start, start.Add(StatsBuckets*StatsBucketSize)).
+		Find(&events).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		i := int(event.CreatedAt.Sub(start) / StatsBucketSize)
+		if i < 0 || i >= len(buckets) {
+			continue
+		}
+		switch event.Kind {
+		case models.TrackingEventOpen:
+			buckets[i].Opens++
+		case models.TrackingEventClick:
+			buckets[i].Clicks++
+		}
+	}
+	return buckets, nil
+}
+
+// issueStart is when the issue went out: its first delivery, or when it was
+// published or created if nothing was delivered.
+func issueStart(db *gorm.DB, issue models.NewsletterIssue) (time.Time, error) {
+	var first models.IssueDelivery
+	result := db.Select("created_at").Where("newsletter_issue_id = ?", issue.ID).Order("created_at").Limit(1).Find(&first)
+	if result.Error != nil {
+		return time.Time{}, result.Error
+	}
+	start := issue.CreatedAt
+	switch {
+	case result.RowsAffected > 0:
+		start = first.CreatedAt
+	case issue.PublishedAt != nil:
+		start = *issue.PublishedAt
+	}
+	return start.UTC(), nil
+}
@@ -0,0 +1,102 @@
+package newsletter
+
+import (
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"gorm.io/gorm"
+)
+
+// notSuppressed excludes subscriptions whose email is on the suppression list.
+// Suppressed addresses are stored lowercased.
+const notSuppressed = "NOT EXISTS (SELECT 1 FROM suppressions WHERE suppressions.email = LOWER(subscriptions.email))"
+
+type ConfirmedSubscriber struct {
+	ID               string
+	Email            domain.SubscriberEmail
+	Name             string
+	TimeZone         domain.TimeZone
+	PreferencesToken string
+	TrackingOptOut   bool
+}
+
+func (s ConfirmedSubscriber) Recipient() Recipient {
+	return Recipient{
+		Name:             s.Name,
+		Email:            s.Email.String(),
+		PreferencesToken: s.PreferencesToken,
+		SubscriptionID:   s.ID,
+		TrackingOptOut:   s.TrackingOptOut,
+	}
+}
+
+// ConfirmedSubscribers returns every subscriber with a valid email who has
+// confirmed any of the given lists and wants issues as soon as they are sent,
+// invalid rows are skipped. Subscribers of several of the lists are returned
+// once, paused and suppressed subscribers not at all.
+func ConfirmedSubscribers(db *gorm.DB, listIDs []string, now time.Time) ([]ConfirmedSubscriber, error) {
+	var confirmedSubscribers []ConfirmedSubscriber
+	var subscriptions []models.Subscription
+	err := db.Distinct("subscriptions.id", "subscriptions.email", "subscriptions.name", "subscriptions.time_zone", "subscriptions.preferences_token", "subscriptions.tracking_opt_out").
+		Joins("JOIN list_subscriptions ON list_subscriptions.subscription_id = subscriptions.id").
+		Where("list_subscriptions.status = ? AND list_subscriptions.list_id IN ?", models.SubscriptionStatusConfirmed, listIDs).
+		Where("subscriptions.frequency = ?", domain.FrequencyInstant).
+		Where("subscriptions.paused_until IS NULL OR subscriptions.paused_until <= ?", now.UTC()).
+		Where(notSuppressed).
+		Find(&subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, subscription := range subscriptions {
+		email, err := domain.SubscriberEmailFrom(subscription.Email)
+		if err != nil {
+			continue
+		}
+		timeZone, err := domain.TimeZoneFrom(subscription.TimeZone)
+		if err != nil {
+			timeZone = ""
+		}
+		confirmedSubscribers = append(confirmedSubscribers, ConfirmedSubscriber{
+			ID:               subscription.ID,
+			Email:            email,
+			Name:             subscription.Name,
+			TimeZone:         timeZone,
+			PreferencesToken: subscription.PreferencesToken,
+			TrackingOptOut:   subscription.TrackingOptOut,
+		})
+	}
+	return confirmedSubscribers, nil
+}
+
+// IssueListIDs returns the lists the issue is sent to. Issues created before
+// lists existed go to the default list.
+func IssueListIDs(db *gorm.DB, issueID string) ([]string, error) {
+	var listIDs []string
+	if err := db.Model(&models.NewsletterIssueList{}).Where("newsletter_issue_id = ?", issueID).Pluck("list_id", &listIDs).Error; err != nil {
+		return nil, err
+	}
+	if len(listIDs) > 0 {
+		return listIDs, nil
+	}
+	if err := db.Model(&models.List{}).Where("slug = ?", models.DefaultListSlug).Pluck("list_id", &listIDs).Error; err != nil {
+		return nil, err
+	}
+	return listIDs, nil
+}
+
+// RecipientFor looks up the subscriber with the given email, it returns
+// gorm.ErrRecordNotFound for unknown emails.
+func RecipientFor(db *gorm.DB, email string) (Recipient, error) {
+	var subscription models.Subscription
+	if err := db.Select("id", "email", "name", "preferences_token", "tracking_opt_out").Where("email = ?", email).First(&subscription).Error; err != nil {
+		return Recipient{}, err
+	}
+	return Recipient{
+		Name:             subscription.Name,
+		Email:            subscription.Email,
+		PreferencesToken: subscription.PreferencesToken,
+		SubscriptionID:   subscription.ID,
+		TrackingOptOut:   subscription.TrackingOptOut,
+	}, nil
+}
@@ -0,0 +1,132 @@
+package newsletter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+)
+
+var ErrInvalidTrackingToken = errors.New("invalid tracking token")
+
+var (
+	htmlLinks = regexp.MustCompile(`(?i)(<a\s[^>]*?href=")([^"]*)(")`)
+	textLinks = regexp.MustCompile(`https?://[^\s<>"]+`)
+)
+
+// trailingPunctuation ends a sentence rather than the URL before it.
+const trailingPunctuation = ".,;:!?)]'"
+
+// TrackingToken identifies an open or a click of an issue by a subscriber,
+// URL is the target of a click.
+type TrackingToken struct {
+	Kind           string `json:"k"`
+	IssueID        string `json:"i"`
+	SubscriptionID string `json:"s"`
+	URL            string `json:"u,omitempty"`
+}
+
+// Tracker rewrites links to signed redirects and adds an open pixel.
+type Tracker struct {
+	baseURL string
+	secret  []byte
+}
+
+// NewTracker returns nil, which turns tracking off, without a secret.
+func NewTracker(baseURL, secret string) *Tracker {
+	if secret == "" {
+		return nil
+	}
+	return &Tracker{baseURL: strings.TrimSuffix(baseURL, "/"), secret: []byte(secret)}
+}
+
+// Sign encodes the token as payload.signature, both base64url encoded.
+func (t *Tracker) Sign(token TrackingToken) string {
+	payload, _ := json.Marshal(token)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(t.signature(encoded))
+}
+
+// Verify decodes a signed token, it returns ErrInvalidTrackingToken for
+// malformed and forged tokens.
+func (t *Tracker) Verify(signed string) (TrackingToken, error) {
+	encoded, signature, ok := strings.Cut(signed, ".")
+	if !ok {
+		return TrackingToken{}, ErrInvalidTrackingToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, t.signature(encoded)) {
+		return TrackingToken{}, ErrInvalidTrackingToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return TrackingToken{}, ErrInvalidTrackingToken
+	}
+	var token TrackingToken
+	if err := json.Unmarshal(payload, &token); err != nil {
+		return TrackingToken{}, ErrInvalidTrackingToken
+	}
+	return token, nil
+}
+
+func (t *Tracker) signature(encoded string) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// OpenURL is the address of the open pixel.
+func (t *Tracker) OpenURL(issueID, subscriptionID string) string {
+	token := t.Sign(TrackingToken{Kind: models.TrackingEventOpen, IssueID: issueID, SubscriptionID: subscriptionID})
+	return fmt.Sprintf("%s/t/o/%s.gif", t.baseURL, token)
+}
+
+// ClickURL is the address redirecting to target.
+func (t *Tracker) ClickURL(issueID, subscriptionID, target string) string {
+	token := t.Sign(TrackingToken{Kind: models.TrackingEventClick, IssueID: issueID, SubscriptionID: subscriptionID, URL: target})
+	return fmt.Sprintf("%s/t/c/%s", t.baseURL, token)
+}
+
+// Track wraps the http(s) links of both bodies in click redirects and adds the
+// open pixel to the HTML body. Links to untracked URLs are left alone. The
+// plain-text body changes only where a link is wrapped.
+func (t *Tracker) Track(rendered RenderedIssue, issueID, subscriptionID string, untracked ...string) RenderedIssue {
+	skip := make(map[string]bool, len(untracked))
+	for _, u := range untracked {
+		skip[u] = true
+	}
+	wrap := func(target string) (string, bool) {
+		lower := strings.ToLower(target)
+		if skip[target] || !(strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")) {
+			return "", false
+		}
+		return t.ClickURL(issueID, subscriptionID, target), true
+	}
+
+	rendered.Html = htmlLinks.ReplaceAllStringFunc(rendered.Html, func(link string) string {
+		parts := htmlLinks.FindStringSubmatch(link)
+		wrapped, ok := wrap(html.UnescapeString(parts[2]))
+		if !ok {
+			return link
+		}
+		return parts[1] + html.EscapeString(wrapped) + parts[3]
+	})
+	rendered.Html += fmt.Sprintf(`<img src="%s" width="1" height="1" alt="">`, html.EscapeString(t.OpenURL(issueID, subscriptionID)))
+
+	rendered.Text = textLinks.ReplaceAllStringFunc(rendered.Text, func(link string) string {
+		target := strings.TrimRight(link, trailingPunctuation)
+		wrapped, ok := wrap(target)
+		if !ok {
+			return link
+		}
+		return wrapped + link[len(target):]
+	})
+	return rendered
+}
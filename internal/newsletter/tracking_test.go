@@ -0,0 +1,90 @@
+package newsletter_test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var trackedLink = regexp.MustCompile(`https://example\.com/t/c/([A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+)`)
+
+func TestTrackingTokensRoundTrip(t *testing.T) {
+	tracker := newsletter.NewTracker("https://example.com", "secret")
+	token := newsletter.TrackingToken{Kind: models.TrackingEventClick, IssueID: "issue", SubscriptionID: "subscriber", URL: "https://go.dev/?a=1&b=2"}
+
+	verified, err := tracker.Verify(tracker.Sign(token))
+	require.NoError(t, err)
+	assert.Equal(t, token, verified)
+}
+
+func TestForgedTrackingTokensAreRejected(t *testing.T) {
+	tracker := newsletter.NewTracker("https://example.com", "secret")
+	signed := newsletter.NewTracker("https://example.com", "other secret").Sign(newsletter.TrackingToken{Kind: models.TrackingEventOpen})
+
+	for _, token := range []string{signed, "", "garbage", "a.b"} {
+		_, err := tracker.Verify(token)
+		assert.ErrorIs(t, err, newsletter.ErrInvalidTrackingToken, "token %q", token)
+	}
+}
+
+func TestTrackingIsOffWithoutASecret(t *testing.T) {
+	assert.Nil(t, newsletter.NewTracker("https://example.com", ""))
+}
+
+func TestTrackedIssuesWrapLinksAndAddAPixel(t *testing.T) {
+	tracker := newsletter.NewTracker("https://example.com", "secret")
+	renderer := newsletter.NewRenderer("https://example.com")
+	renderer.UseTracker(tracker)
+	issue := models.NewsletterIssue{
+		ID:          "issue",
+		Title:       "t",
+		Tracking:    true,
+		HtmlContent: `<p>Read <a href="https://go.dev/?a=1&amp;b=2">this</a> and <a href="mailto:me@example.com">write</a></p>`,
+		TextContent: "Read https://go.dev/blog. Then relax.",
+	}
+	recipient := newsletter.Recipient{Name: "le guin", PreferencesToken: "token", SubscriptionID: "subscriber"}
+
+	rendered, err := renderer.Render(issue, recipient)
+	require.NoError(t, err)
+
+	assert.Contains(t, rendered.Html, `href="mailto:me@example.com"`)
+	assert.Contains(t, rendered.Html, `<a href="https://example.com/preferences?token=token&amp;issue=issue">`)
+	assert.Regexp(t, `<img src="https://example.com/t/o/[A-Za-z0-9_\-.]+\.gif" width="1" height="1" alt="">$`, rendered.Html)
+	matches := trackedLink.FindStringSubmatch(rendered.Html)
+	require.Len(t, matches, 2)
+	token, err := tracker.Verify(matches[1])
+	require.NoError(t, err)
+	assert.Equal(t, newsletter.TrackingToken{Kind: models.TrackingEventClick, IssueID: "issue", SubscriptionID: "subscriber", URL: "https://go.dev/?a=1&b=2"}, token)
+
+	// the plain text body only changes where links are wrapped
+	untracked, err := newsletter.NewRenderer("https://example.com").Render(issue, recipient)
+	require.NoError(t, err)
+	assert.Equal(t, untracked.Text, trackedLink.ReplaceAllStringFunc(rendered.Text, func(link string) string {
+		token, err := tracker.Verify(strings.TrimPrefix(link, "https://example.com/t/c/"))
+		require.NoError(t, err)
+		return token.URL
+	}))
+	assert.Contains(t, rendered.Text, ". Then relax.")
+	assert.Contains(t, rendered.Text, "Manage your preferences or unsubscribe: https://example.com/preferences?token=token&issue=issue")
+}
+
+func TestIssuesAreNotTrackedForSubscribersWhoOptedOut(t *testing.T) {
+	renderer := newsletter.NewRenderer("https://example.com")
+	renderer.UseTracker(newsletter.NewTracker("https://example.com", "secret"))
+	issue := models.NewsletterIssue{ID: "issue", Title: "t", Tracking: true, HtmlContent: `<a href="https://go.dev">go</a>`, TextContent: "https://go.dev"}
+
+	rendered, err := renderer.Render(issue, newsletter.Recipient{SubscriptionID: "subscriber", TrackingOptOut: true})
+	require.NoError(t, err)
+	assert.Equal(t, `<a href="https://go.dev">go</a>`, rendered.Html)
+	assert.Equal(t, "https://go.dev", rendered.Text)
+
+	issue.Tracking = false
+	rendered, err = renderer.Render(issue, newsletter.Recipient{SubscriptionID: "subscriber"})
+	require.NoError(t, err)
+	assert.Equal(t, `<a href="https://go.dev">go</a>`, rendered.Html)
+}
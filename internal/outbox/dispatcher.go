@@ -0,0 +1,239 @@
+// Package outbox sends the transactional emails stored in the outbox table.
+// Handlers add a message in the same transaction as the change it tells
+// about, so the email goes out if and only if the change is committed, and
+// a failure to send doesn't fail the request: the dispatcher retries it.
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPollInterval = time.Second
+	defaultMaxBackoff   = time.Hour
+	// batchSize is how many due messages are claimed and sent at once
+	batchSize = 50
+	// lease is how long claimed messages are hidden from other claims while
+	// they are sent. Messages whose outcome wasn't stored by then, because
+	// the instance sending them died, are sent again.
+	lease = 10 * time.Minute
+)
+
+var logger = internal.Logger()
+
+// errInvalidRecipient is the failure of a message to an address that isn't
+// one.
+var errInvalidRecipient = errors.New("invalid recipient")
+
+// NewMessage is an email to the recipient, to send right away.
+func NewMessage(recipient domain.SubscriberEmail, subject, htmlContent, textContent string) models.OutboxMessage {
+	now := time.Now().UTC()
+	return models.OutboxMessage{
+		ID:           uuid.NewString(),
+		Recipient:    recipient.String(),
+		Subject:      subject,
+		HtmlBody:     htmlContent,
+		TextBody:     textContent,
+		CreatedAt:    now,
+		ExecuteAfter: now,
+	}
+}
+
+// Dispatcher sends the messages of the outbox, and retries those that failed
+// until they are sent. Only a message the provider rejects for good, or whose
+// recipient is suppressed, is dropped.
+type Dispatcher struct {
+	db         *gorm.DB
+	sender     newsletter.Sender
+	interval   time.Duration
+	maxBackoff time.Duration
+	wake       chan struct{}
+}
+
+// NewDispatcher is a dispatcher sending through the sender, the delivery
+// engine for the emails to keep to the provider's rate limit.
+func NewDispatcher(db *gorm.DB, sender newsletter.Sender, settings internal.OutboxSettings) *Dispatcher {
+	interval := settings.PollInterval()
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	maxBackoff := settings.MaxBackoff()
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	return &Dispatcher{db: db, sender: sender, interval: interval, maxBackoff: maxBackoff, wake: make(chan struct{}, 1)}
+}
+
+// Run polls the outbox for due messages until ctx is cancelled, and right
+// away when woken.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ctx = logger.WithContext(ctx)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil {
+			found, err := d.dispatchDue(ctx, time.Now())
+			if err != nil {
+				logger.Error().Err(err).Msg("failed to dispatch outbox messages")
+				break
+			}
+			if !found {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			logger.Debug().Msg("outbox dispatcher stopped")
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// Wake has the running dispatcher poll now rather than at the next tick, so
+// a message just added goes out without holding up the request that added
+// it. It doesn't block.
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchDue sends a batch of due messages, it reports whether any message
+// was due. The messages are claimed and their outcomes stored in two short
+// transactions, none is open while they are sent.
+func (d *Dispatcher) dispatchDue(ctx context.Context, now time.Time) (bool, error) {
+	// the outcome of sends that went out must be stored even while shutting down
+	db := d.db.WithContext(context.WithoutCancel(ctx))
+	// most polls find nothing due, they don't need the write lock SQLite
+	// transactions take
+	var due []string
+	if err := db.Model(&models.OutboxMessage{}).Where("execute_after <= ?", now).Limit(1).Pluck("outbox_message_id", &due).Error; err != nil || len(due) == 0 {
+		return false, err
+	}
+
+	messages, err := d.claim(db, now)
+	if err != nil || len(messages) == 0 {
+		return false, err
+	}
+	sendErrs := make([]error, len(messages))
+	for i, message := range messages {
+		if ctx.Err() != nil {
+			// the rest waits for the next start
+			sendErrs[i] = ctx.Err()
+			continue
+		}
+		sendErrs[i] = d.send(ctx, message)
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i, message := range messages {
+			if err := d.settle(tx, message, sendErrs[i], now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return true, err
+}
+
+// claim leases a batch of due messages and returns them as they were before
+// their lease.
+func (d *Dispatcher) claim(db *gorm.DB, now time.Time) ([]models.OutboxMessage, error) {
+	var messages []models.OutboxMessage
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := database.Claim(tx).
+			Where("execute_after <= ?", now).
+			Order("execute_after").Limit(batchSize).Find(&messages).Error
+		if err != nil || len(messages) == 0 {
+			return err
+		}
+		ids := make([]string, len(messages))
+		for i, message := range messages {
+			ids[i] = message.ID
+		}
+		return tx.Model(&models.OutboxMessage{}).Where("outbox_message_id IN ?", ids).
+			Update("execute_after", now.Add(lease).UTC()).Error
+	})
+	return messages, err
+}
+
+// send sends a claimed message.
+func (d *Dispatcher) send(ctx context.Context, message models.OutboxMessage) error {
+	recipient, err := domain.SubscriberEmailFrom(message.Recipient)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidRecipient, err)
+	}
+	_, err = d.sender.Send(ctx, internal.Message{
+		To:       recipient,
+		Subject:  message.Subject,
+		HtmlBody: message.HtmlBody,
+		TextBody: message.TextBody,
+		// every attempt, from any poll, is the same email
+		MessageOptions: internal.MessageOptions{Metadata: map[string]string{internal.IdempotencyKey: message.ID}},
+	})
+	return err
+}
+
+// settle records the outcome of sending a claimed message: sent and dropped
+// messages leave the outbox, any other failure is retried later.
+func (d *Dispatcher) settle(tx *gorm.DB, message models.OutboxMessage, sendErr error, now time.Time) error {
+	log := logger.With().Str("outbox message ID", message.ID).Str("email", message.Recipient).Logger()
+	switch {
+	case sendErr == nil:
+		log.Trace().Msg("sent outbox message")
+		return tx.Delete(&message).Error
+	case errors.Is(sendErr, context.Canceled):
+		// cancelled before the provider answered, the lease is given back
+		// for the next start to send it
+		return tx.Model(&message).Update("execute_after", message.ExecuteAfter).Error
+	case errors.Is(sendErr, internal.ErrRecipientSuppressed):
+		log.Info().Msg("not sending outbox message to suppressed address")
+		return tx.Delete(&message).Error
+	case errors.Is(sendErr, errInvalidRecipient):
+		log.Warn().Err(sendErr).Msg("dropping outbox message to invalid email")
+		return tx.Delete(&message).Error
+	case rejected(sendErr):
+		log.Error().Err(sendErr).Msg("giving up on outbox message")
+		return tx.Delete(&message).Error
+	}
+	retries := message.NRetries + 1
+	log.Warn().Err(sendErr).Int("retries", retries).Msg("failed to send outbox message, retrying later")
+	return tx.Model(&message).Updates(map[string]interface{}{
+		"n_retries":     retries,
+		"execute_after": now.Add(d.backoff(retries)).UTC(),
+	}).Error
+}
+
+// rejected reports whether the provider refused the message for good: the
+// recipient is inactive, or the address or the message is invalid. Sending
+// it again would fail the same way.
+func rejected(err error) bool {
+	if errors.Is(err, internal.ErrInactiveRecipient) || errors.Is(err, internal.ErrInvalidAddress) {
+		return true
+	}
+	var statusErr *internal.StatusError
+	return errors.As(err, &statusErr) &&
+		(statusErr.StatusCode == http.StatusNotAcceptable || statusErr.StatusCode == http.StatusUnprocessableEntity)
+}
+
+// backoff doubles from a second with every retry, up to the max backoff.
+func (d *Dispatcher) backoff(retries int) time.Duration {
+	if retries > 30 {
+		return d.maxBackoff
+	}
+	return min(time.Duration(1<<retries)*time.Second, d.maxBackoff)
+}
@@ -0,0 +1,210 @@
+package outbox
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// setup is a dispatcher with a SQLite outbox, sending through an engine to a
+// provider that answers with the statuses in turn, then 200 OK. It returns
+// the number of emails the provider received.
+func setup(t *testing.T, statuses ...int) (*Dispatcher, *gorm.DB, *atomic.Int32) {
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := int(received.Add(1)); n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		w.Write([]byte(`{"MessageID": "message-1"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	var settings internal.Settings
+	settings.Database.URL = "sqlite://" + filepath.Join(t.TempDir(), "outbox.db")
+	db, err := database.SetupDB(&settings)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	sender, err := domain.SubscriberEmailFrom("newsletter@example.com")
+	require.Nil(t, err)
+	emailClient := internal.NewEmailClient(server.URL, sender, "token", time.Second)
+	return NewDispatcher(db, engine(&emailClient), internal.OutboxSettings{}), db, &received
+}
+
+// engine sends through the email client, backing off for no longer than a
+// millisecond after throttled sends.
+func engine(emailClient *internal.EmailClient) *newsletter.Engine {
+	return newsletter.NewEngine(emailClient, internal.DeliverySettings{MinBackoffMilliseconds: 1, MaxBackoffMilliseconds: 1})
+}
+
+func addMessage(t *testing.T, db *gorm.DB) models.OutboxMessage {
+	recipient, err := domain.SubscriberEmailFrom("ursula@example.com")
+	require.Nil(t, err)
+	message := NewMessage(recipient, "Welcome!", "<p>Welcome!</p>", "Welcome!")
+	require.Nil(t, db.Create(&message).Error)
+	return message
+}
+
+func outbox(t *testing.T, db *gorm.DB) []models.OutboxMessage {
+	var messages []models.OutboxMessage
+	require.Nil(t, db.Find(&messages).Error)
+	return messages
+}
+
+func TestFailedMessagesAreRetriedUntilSent(t *testing.T) {
+	dispatcher, db, received := setup(t, http.StatusTooManyRequests, http.StatusTooManyRequests)
+	addMessage(t, db)
+	ctx := context.Background()
+	now := time.Now()
+
+	found, err := dispatcher.dispatchDue(ctx, now)
+	require.Nil(t, err)
+	assert.True(t, found)
+	messages := outbox(t, db)
+	require.Len(t, messages, 1)
+	assert.Equal(t, 1, messages[0].NRetries)
+	assert.True(t, messages[0].ExecuteAfter.After(now))
+
+	// not due before the backoff is over
+	found, err = dispatcher.dispatchDue(ctx, now)
+	require.Nil(t, err)
+	assert.False(t, found)
+
+	found, err = dispatcher.dispatchDue(ctx, now.Add(time.Hour))
+	require.Nil(t, err)
+	assert.True(t, found)
+	require.Len(t, outbox(t, db), 1)
+	assert.Equal(t, 2, outbox(t, db)[0].NRetries)
+
+	found, err = dispatcher.dispatchDue(ctx, now.Add(2*time.Hour))
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Empty(t, outbox(t, db))
+	assert.Equal(t, int32(3), received.Load())
+}
+
+func TestRejectedMessagesAreDropped(t *testing.T) {
+	for _, status := range []int{http.StatusNotAcceptable, http.StatusUnprocessableEntity} {
+		dispatcher, db, received := setup(t, status)
+		addMessage(t, db)
+
+		_, err := dispatcher.dispatchDue(context.Background(), time.Now())
+		require.Nil(t, err)
+
+		assert.Empty(t, outbox(t, db), status)
+		assert.Equal(t, int32(1), received.Load(), status)
+	}
+}
+
+func TestOtherFailuresAreRetried(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusInternalServerError} {
+		dispatcher, db, received := setup(t, status)
+		addMessage(t, db)
+
+		_, err := dispatcher.dispatchDue(context.Background(), time.Now())
+		require.Nil(t, err)
+
+		messages := outbox(t, db)
+		require.Len(t, messages, 1, status)
+		assert.Equal(t, 1, messages[0].NRetries, status)
+		assert.Equal(t, int32(1), received.Load(), status)
+	}
+}
+
+func TestMessagesAreSentOnce(t *testing.T) {
+	dispatcher, db, received := setup(t)
+	addMessage(t, db)
+	ctx := context.Background()
+
+	found, err := dispatcher.dispatchDue(ctx, time.Now())
+	require.Nil(t, err)
+	assert.True(t, found)
+	found, err = dispatcher.dispatchDue(ctx, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+
+	assert.False(t, found)
+	assert.Empty(t, outbox(t, db))
+	assert.Equal(t, int32(1), received.Load())
+}
+
+func TestMessagesBeingSentAreLeased(t *testing.T) {
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(sending)
+		<-release
+		w.Write([]byte(`{"MessageID": "message-1"}`))
+	}))
+	t.Cleanup(server.Close)
+	dispatcher, db, _ := setup(t)
+	sender, err := domain.SubscriberEmailFrom("newsletter@example.com")
+	require.Nil(t, err)
+	emailClient := internal.NewEmailClient(server.URL, sender, "token", time.Second)
+	dispatcher.sender = engine(&emailClient)
+	message := addMessage(t, db)
+	ctx := context.Background()
+	now := time.Now()
+
+	done := make(chan error)
+	go func() {
+		_, err := dispatcher.dispatchDue(ctx, now)
+		done <- err
+	}()
+	<-sending
+
+	// no transaction is open while the message is sent, and another poll
+	// doesn't take it
+	found, err := dispatcher.dispatchDue(ctx, now)
+	require.Nil(t, err)
+	assert.False(t, found)
+	messages := outbox(t, db)
+	require.Len(t, messages, 1)
+	assert.True(t, messages[0].ExecuteAfter.After(message.ExecuteAfter))
+
+	close(release)
+	require.Nil(t, <-done)
+	assert.Empty(t, outbox(t, db))
+}
+
+func TestCancelledSendsGiveTheLeaseBack(t *testing.T) {
+	dispatcher, db, received := setup(t)
+	message := addMessage(t, db)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	found, err := dispatcher.dispatchDue(ctx, time.Now())
+	require.Nil(t, err)
+	assert.True(t, found)
+
+	messages := outbox(t, db)
+	require.Len(t, messages, 1)
+	assert.True(t, messages[0].ExecuteAfter.Equal(message.ExecuteAfter))
+	assert.Zero(t, received.Load())
+}
+
+func TestBackoffDoublesUpToTheMax(t *testing.T) {
+	dispatcher := NewDispatcher(nil, nil, internal.OutboxSettings{MaxBackoffMilliseconds: 10_000})
+
+	assert.Equal(t, 2*time.Second, dispatcher.backoff(1))
+	assert.Equal(t, 8*time.Second, dispatcher.backoff(3))
+	assert.Equal(t, 10*time.Second, dispatcher.backoff(4))
+	assert.Equal(t, 10*time.Second, dispatcher.backoff(100))
+}
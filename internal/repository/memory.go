@@ -0,0 +1,232 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+)
+
+// Memory keeps the repositories in memory, for tests and tools that don't
+// need a database. Transactions run one at a time.
+type Memory struct {
+	mu   *sync.Mutex
+	data *memoryData
+	// inTransaction is set for the store of a transaction, which holds mu
+	// already
+	inTransaction bool
+}
+
+var _ Store = (*Memory)(nil)
+
+type memoryData struct {
+	subscriptions     map[string]models.Subscription
+	listSubscriptions map[[2]string]models.ListSubscription
+	tokens            map[string]models.SubscriptionTokens
+	users             map[string]models.User
+	outbox            map[string]models.OutboxMessage
+}
+
+func (d *memoryData) clone() *memoryData {
+	return &memoryData{
+		subscriptions:     maps.Clone(d.subscriptions),
+		listSubscriptions: maps.Clone(d.listSubscriptions),
+		tokens:            maps.Clone(d.tokens),
+		users:             maps.Clone(d.users),
+		outbox:            maps.Clone(d.outbox),
+	}
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		mu: &sync.Mutex{},
+		data: &memoryData{
+			subscriptions:     map[string]models.Subscription{},
+			listSubscriptions: map[[2]string]models.ListSubscription{},
+			tokens:            map[string]models.SubscriptionTokens{},
+			users:             map[string]models.User{},
+			outbox:            map[string]models.OutboxMessage{},
+		},
+	}
+}
+
+func (m *Memory) Subscriptions() SubscriptionRepository {
+	return memorySubscriptions{m}
+}
+
+func (m *Memory) Tokens() TokenRepository {
+	return memoryTokens{m}
+}
+
+func (m *Memory) Users() UserRepository {
+	return memoryUsers{m}
+}
+
+func (m *Memory) Outbox() OutboxRepository {
+	return memoryOutbox{m}
+}
+
+// Transaction runs fn on a copy of the data, which replaces the data if fn
+// returns nil.
+func (m *Memory) Transaction(ctx context.Context, fn func(Store) error) error {
+	unlock := m.lock()
+	defer unlock()
+	tx := &Memory{mu: m.mu, data: m.data.clone(), inTransaction: true}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	*m.data = *tx.data
+	return nil
+}
+
+func (m *Memory) lock() func() {
+	if m.inTransaction {
+		return func() {}
+	}
+	m.mu.Lock()
+	return m.mu.Unlock
+}
+
+type memorySubscriptions struct {
+	*Memory
+}
+
+func (r memorySubscriptions) Find(ctx context.Context, email, listID string) (Subscriber, error) {
+	defer r.lock()()
+	for _, subscription := range r.data.subscriptions {
+		if subscription.Email == email {
+			listSubscription := r.data.listSubscriptions[[2]string{subscription.ID, listID}]
+			return Subscriber{ID: subscription.ID, ListStatus: listSubscription.Status}, nil
+		}
+	}
+	return Subscriber{}, ErrNotFound
+}
+
+func (r memorySubscriptions) Add(ctx context.Context, subscription models.Subscription) error {
+	defer r.lock()()
+	for _, existing := range r.data.subscriptions {
+		if existing.ID == subscription.ID || existing.Email == subscription.Email {
+			return fmt.Errorf("%w: subscription of %s", ErrConflict, subscription.Email)
+		}
+	}
+	r.data.subscriptions[subscription.ID] = subscription
+	return nil
+}
+
+func (r memorySubscriptions) ListStatus(ctx context.Context, subscriptionID, listID string) (string, error) {
+	defer r.lock()()
+	return r.data.listSubscriptions[[2]string{subscriptionID, listID}].Status, nil
+}
+
+func (r memorySubscriptions) Subscribe(ctx context.Context, subscription models.Subscription, listID string, at time.Time) (SubscribeResult, error) {
+	defer r.lock()()
+	result := SubscribeResult{SubscriberID: subscription.ID}
+	for _, existing := range r.data.subscriptions {
+		if existing.Email == subscription.Email {
+			result.SubscriberID = existing.ID
+		}
+	}
+	if result.SubscriberID == subscription.ID {
+		r.data.subscriptions[subscription.ID] = subscription
+	}
+
+	key := [2]string{result.SubscriberID, listID}
+	listSubscription, ok := r.data.listSubscriptions[key]
+	switch {
+	case !ok:
+		result.Outcome = Subscribed
+	case listSubscription.Status == models.SubscriptionStatusPending:
+		result.Outcome = AlreadyPending
+		return result, nil
+	case listSubscription.Status == models.SubscriptionStatusConfirmed:
+		result.Outcome = AlreadyConfirmed
+		return result, nil
+	default:
+		result.Outcome = Resubscribed
+	}
+	r.data.listSubscriptions[key] = models.ListSubscription{
+		SubscriptionID: result.SubscriberID,
+		ListID:         listID,
+		Status:         models.SubscriptionStatusPending,
+		SubscribedAt:   at,
+	}
+	return result, nil
+}
+
+func (r memorySubscriptions) ConfirmList(ctx context.Context, subscriptionID, listID string, at time.Time) error {
+	defer r.lock()()
+	key := [2]string{subscriptionID, listID}
+	listSubscription, ok := r.data.listSubscriptions[key]
+	if !ok {
+		listSubscription = models.ListSubscription{SubscriptionID: subscriptionID, ListID: listID, SubscribedAt: at}
+	}
+	listSubscription.Status = models.SubscriptionStatusConfirmed
+	listSubscription.ConfirmedAt = &at
+	r.data.listSubscriptions[key] = listSubscription
+	// the email is verified
+	if subscription, ok := r.data.subscriptions[subscriptionID]; ok {
+		subscription.Status = models.SubscriptionStatusConfirmed
+		r.data.subscriptions[subscriptionID] = subscription
+	}
+	return nil
+}
+
+type memoryTokens struct {
+	*Memory
+}
+
+func (r memoryTokens) Add(ctx context.Context, token models.SubscriptionTokens) error {
+	defer r.lock()()
+	if _, ok := r.data.tokens[token.SubscriptionToken]; ok {
+		return fmt.Errorf("%w: token", ErrConflict)
+	}
+	r.data.tokens[token.SubscriptionToken] = token
+	return nil
+}
+
+func (r memoryTokens) Find(ctx context.Context, token string) (models.SubscriptionTokens, error) {
+	defer r.lock()()
+	found, ok := r.data.tokens[token]
+	if !ok {
+		return models.SubscriptionTokens{}, ErrNotFound
+	}
+	return found, nil
+}
+
+type memoryUsers struct {
+	*Memory
+}
+
+func (r memoryUsers) Add(ctx context.Context, user models.User) error {
+	defer r.lock()()
+	if _, ok := r.data.users[user.Username]; ok {
+		return fmt.Errorf("%w: user %s", ErrConflict, user.Username)
+	}
+	r.data.users[user.Username] = user
+	return nil
+}
+
+func (r memoryUsers) Find(ctx context.Context, username string) (models.User, error) {
+	defer r.lock()()
+	user, ok := r.data.users[username]
+	if !ok {
+		return models.User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+type memoryOutbox struct {
+	*Memory
+}
+
+func (r memoryOutbox) Add(ctx context.Context, message models.OutboxMessage) error {
+	defer r.lock()()
+	if _, ok := r.data.outbox[message.ID]; ok {
+		return fmt.Errorf("%w: outbox message %s", ErrConflict, message.ID)
+	}
+	r.data.outbox[message.ID] = message
+	return nil
+}
@@ -0,0 +1,219 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Postgres keeps the repositories in the database, Postgres or SQLite.
+type Postgres struct {
+	db *gorm.DB
+}
+
+var _ Store = (*Postgres)(nil)
+
+func NewPostgres(db *gorm.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+func (p *Postgres) Subscriptions() SubscriptionRepository {
+	return postgresSubscriptions{p.db}
+}
+
+func (p *Postgres) Tokens() TokenRepository {
+	return postgresTokens{p.db}
+}
+
+func (p *Postgres) Users() UserRepository {
+	return postgresUsers{p.db}
+}
+
+func (p *Postgres) Outbox() OutboxRepository {
+	return postgresOutbox{p.db}
+}
+
+func (p *Postgres) Transaction(ctx context.Context, fn func(Store) error) error {
+	return p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&Postgres{db: tx})
+	})
+}
+
+// notFound maps gorm.ErrRecordNotFound to ErrNotFound.
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// conflict maps unique constraint violations to ErrConflict, for databases
+// opened with TranslateError.
+func conflict(err error) error {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return fmt.Errorf("%w: %w", ErrConflict, err)
+	}
+	return err
+}
+
+type postgresSubscriptions struct {
+	db *gorm.DB
+}
+
+func (r postgresSubscriptions) Find(ctx context.Context, email, listID string) (Subscriber, error) {
+	var subscriber Subscriber
+	result := r.db.WithContext(ctx).Model(&models.Subscription{}).
+		Select("subscriptions.id AS id, COALESCE(list_subscriptions.status, '') AS list_status").
+		Joins("LEFT JOIN list_subscriptions ON list_subscriptions.subscription_id = subscriptions.id AND list_subscriptions.list_id = ?", listID).
+		Where("subscriptions.email = ?", email).
+		Limit(1).Scan(&subscriber)
+	if result.Error != nil {
+		return Subscriber{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return Subscriber{}, ErrNotFound
+	}
+	return subscriber, nil
+}
+
+func (r postgresSubscriptions) Add(ctx context.Context, subscription models.Subscription) error {
+	return conflict(r.db.WithContext(ctx).Create(&subscription).Error)
+}
+
+func (r postgresSubscriptions) ListStatus(ctx context.Context, subscriptionID, listID string) (string, error) {
+	var statuses []string
+	err := r.db.WithContext(ctx).Model(&models.ListSubscription{}).
+		Where("subscription_id = ? AND list_id = ?", subscriptionID, listID).
+		Limit(1).Pluck("status", &statuses).Error
+	if err != nil || len(statuses) == 0 {
+		return "", err
+	}
+	return statuses[0], nil
+}
+
+// Subscribe relies on the database to settle concurrent calls: the insert of
+// a known email does nothing, after waiting for the transaction that added it,
+// and the list subscription is only reset if it is still cancelled.
+func (r postgresSubscriptions) Subscribe(ctx context.Context, subscription models.Subscription, listID string, at time.Time) (SubscribeResult, error) {
+	var result SubscribeResult
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "email"}},
+			DoNothing: true,
+		}).Create(&subscription).Error
+		if err != nil {
+			return err
+		}
+		var ids []string
+		if err := tx.Model(&models.Subscription{}).Where("email = ?", subscription.Email).Limit(1).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("subscription of %s vanished", subscription.Email)
+		}
+		result.SubscriberID = ids[0]
+
+		listSubscription := models.ListSubscription{
+			SubscriptionID: result.SubscriberID,
+			ListID:         listID,
+			Status:         models.SubscriptionStatusPending,
+			SubscribedAt:   at,
+		}
+		created := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "subscription_id"}, {Name: "list_id"}},
+			DoNothing: true,
+		}).Create(&listSubscription)
+		if created.Error != nil {
+			return created.Error
+		}
+		if created.RowsAffected > 0 {
+			result.Outcome = Subscribed
+			return nil
+		}
+
+		resubscribed := tx.Model(&models.ListSubscription{}).
+			Where("subscription_id = ? AND list_id = ? AND status NOT IN ?", result.SubscriberID, listID,
+				[]string{models.SubscriptionStatusPending, models.SubscriptionStatusConfirmed}).
+			Updates(map[string]any{"status": models.SubscriptionStatusPending, "subscribed_at": at, "confirmed_at": nil})
+		if resubscribed.Error != nil {
+			return resubscribed.Error
+		}
+		if resubscribed.RowsAffected > 0 {
+			result.Outcome = Resubscribed
+			return nil
+		}
+
+		status, err := postgresSubscriptions{tx}.ListStatus(ctx, result.SubscriberID, listID)
+		if err != nil {
+			return err
+		}
+		result.Outcome = AlreadyPending
+		if status == models.SubscriptionStatusConfirmed {
+			result.Outcome = AlreadyConfirmed
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (r postgresSubscriptions) ConfirmList(ctx context.Context, subscriptionID, listID string, at time.Time) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		listSubscription := models.ListSubscription{
+			SubscriptionID: subscriptionID,
+			ListID:         listID,
+			Status:         models.SubscriptionStatusConfirmed,
+			SubscribedAt:   at,
+			ConfirmedAt:    &at,
+		}
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "subscription_id"}, {Name: "list_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"status", "confirmed_at"}),
+		}).Create(&listSubscription).Error
+		if err != nil {
+			return err
+		}
+		// the email is verified
+		return tx.Model(&models.Subscription{}).Where("id = ?", subscriptionID).Update("status", models.SubscriptionStatusConfirmed).Error
+	})
+}
+
+type postgresTokens struct {
+	db *gorm.DB
+}
+
+func (r postgresTokens) Add(ctx context.Context, token models.SubscriptionTokens) error {
+	return conflict(r.db.WithContext(ctx).Create(&token).Error)
+}
+
+func (r postgresTokens) Find(ctx context.Context, token string) (models.SubscriptionTokens, error) {
+	var found models.SubscriptionTokens
+	err := r.db.WithContext(ctx).Where("subscription_token = ?", token).First(&found).Error
+	return found, notFound(err)
+}
+
+type postgresUsers struct {
+	db *gorm.DB
+}
+
+func (r postgresUsers) Add(ctx context.Context, user models.User) error {
+	return conflict(r.db.WithContext(ctx).Create(&user).Error)
+}
+
+func (r postgresUsers) Find(ctx context.Context, username string) (models.User, error) {
+	var user models.User
+	err := r.db.WithContext(ctx).Where("username = ?", username).First(&user).Error
+	return user, notFound(err)
+}
+
+type postgresOutbox struct {
+	db *gorm.DB
+}
+
+func (r postgresOutbox) Add(ctx context.Context, message models.OutboxMessage) error {
+	return conflict(r.db.WithContext(ctx).Create(&message).Error)
+}
@@ -0,0 +1,109 @@
+// Package repository stores subscribers, their confirmation tokens, the users
+// and the outbox of emails to send behind interfaces, for handlers to work
+// without knowing about GORM.
+// NewPostgres keeps them in the database, NewMemory in memory.
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+)
+
+var (
+	// ErrNotFound is returned when what was looked up doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when what was added exists already, like a
+	// subscriber with the same email.
+	ErrConflict = errors.New("conflict")
+)
+
+// Subscriber is a subscriber and the status of their subscription to a list,
+// empty if they never subscribed to it.
+type Subscriber struct {
+	ID         string
+	ListStatus string
+}
+
+// SubscribeOutcome is what Subscribe did, by the status the subscription to
+// the list had before.
+type SubscribeOutcome string
+
+const (
+	// Subscribed is a new subscription to the list, pending confirmation.
+	Subscribed SubscribeOutcome = "subscribed"
+	// AlreadyPending is a subscription waiting for confirmation already, it
+	// is left as it is.
+	AlreadyPending SubscribeOutcome = "already_pending"
+	// AlreadyConfirmed is a confirmed subscription, it is left as it is.
+	AlreadyConfirmed SubscribeOutcome = "already_confirmed"
+	// Resubscribed is a cancelled subscription that is pending confirmation
+	// again.
+	Resubscribed SubscribeOutcome = "resubscribed"
+)
+
+// SubscribeResult is the subscriber Subscribe added or found, and what it did
+// to their subscription to the list.
+type SubscribeResult struct {
+	SubscriberID string
+	Outcome      SubscribeOutcome
+}
+
+// SubscriptionRepository stores subscribers and their list subscriptions.
+type SubscriptionRepository interface {
+	// Find looks up the subscriber with the email and their subscription to
+	// the list. It returns ErrNotFound for unknown emails.
+	Find(ctx context.Context, email, listID string) (Subscriber, error)
+	// Add stores a new subscriber.
+	Add(ctx context.Context, subscription models.Subscription) error
+	// ListStatus is the status of the subscriber's subscription to the list,
+	// empty if they never subscribed to it.
+	ListStatus(ctx context.Context, subscriptionID, listID string) (string, error)
+	// Subscribe adds the subscriber unless their email is known already, and
+	// subscribes them to the list pending confirmation unless they are
+	// subscribed already. It does both in one step, so concurrent calls for
+	// the same email add a single subscriber and each get a result.
+	Subscribe(ctx context.Context, subscription models.Subscription, listID string, at time.Time) (SubscribeResult, error)
+	// ConfirmList confirms the subscription to the list. Following the link
+	// verifies the subscriber's email too, so their own status becomes
+	// confirmed; their other lists keep their status.
+	ConfirmList(ctx context.Context, subscriptionID, listID string, at time.Time) error
+}
+
+// TokenRepository stores the tokens of the links subscriptions are confirmed
+// with.
+type TokenRepository interface {
+	// Add stores a token.
+	Add(ctx context.Context, token models.SubscriptionTokens) error
+	// Find looks up a token, ErrNotFound if there is none. Tokens issued
+	// before lists existed have no list ID.
+	Find(ctx context.Context, token string) (models.SubscriptionTokens, error)
+}
+
+// UserRepository stores the users who can log in and publish.
+type UserRepository interface {
+	// Add stores a user.
+	Add(ctx context.Context, user models.User) error
+	// Find looks up the user with the username, ErrNotFound if there is none.
+	Find(ctx context.Context, username string) (models.User, error)
+}
+
+// OutboxRepository stores the emails to send once the transaction they are
+// added in is committed, see package outbox.
+type OutboxRepository interface {
+	// Add stores a message.
+	Add(ctx context.Context, message models.OutboxMessage) error
+}
+
+// Store gives access to every repository.
+type Store interface {
+	Subscriptions() SubscriptionRepository
+	Tokens() TokenRepository
+	Users() UserRepository
+	Outbox() OutboxRepository
+	// Transaction runs fn with repositories whose changes are kept together
+	// if fn returns nil, and dropped together otherwise.
+	Transaction(ctx context.Context, fn func(Store) error) error
+}
@@ -0,0 +1,257 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// stores are the implementations every test runs against: in memory, in a
+// SQLite database through the same code as Postgres, and in Postgres, where
+// concurrent transactions lock rows rather than the whole database. The
+// Postgres store is skipped with TEST_DATABASE=sqlite or without a server.
+func stores() map[string]func(t *testing.T) Store {
+	return map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store {
+			return NewMemory()
+		},
+		"database": func(t *testing.T) Store {
+			var settings internal.Settings
+			settings.Database.URL = "sqlite://" + filepath.Join(t.TempDir(), "repository.db")
+			return openDatabase(t, &settings)
+		},
+		"postgres": func(t *testing.T) Store {
+			if os.Getenv("TEST_DATABASE") == "sqlite" {
+				t.Skip("TEST_DATABASE=sqlite")
+			}
+			settings := internal.Settings{
+				Database: internal.DatabaseSettings{
+					Host:               "localhost",
+					Port:               5432,
+					DatabaseName:       "postgres",
+					Username:           "postgres",
+					Password:           "password",
+					MaxOpenConnections: stressWorkers,
+				},
+			}
+			server, err := gorm.Open(postgres.Open(settings.PostgresSQLDSN()), &gorm.Config{Logger: gormlogger.Discard})
+			if err == nil {
+				var sqlDB *sql.DB
+				if sqlDB, err = server.DB(); err == nil {
+					err = sqlDB.Ping()
+					t.Cleanup(func() { sqlDB.Close() })
+				}
+			}
+			if err != nil {
+				t.Skipf("no Postgres server: %v", err)
+			}
+
+			settings.Database.DatabaseName = uuid.NewString()
+			require.Nil(t, server.Exec(fmt.Sprintf(`CREATE DATABASE "%s"`, settings.Database.DatabaseName)).Error)
+			t.Cleanup(func() {
+				server.Exec(fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, settings.Database.DatabaseName))
+			})
+			return openDatabase(t, &settings)
+		},
+	}
+}
+
+// openDatabase sets up the database of the settings for a Postgres store,
+// closing it when the test ends.
+func openDatabase(t *testing.T, settings *internal.Settings) Store {
+	db, err := database.SetupDB(settings)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return NewPostgres(db)
+}
+
+func newSubscription(email string) models.Subscription {
+	return models.Subscription{
+		ID:           uuid.NewString(),
+		Email:        email,
+		Name:         "Ursula",
+		SubscribedAt: time.Now().UTC(),
+		Status:       models.SubscriptionStatusPending,
+		Frequency:    "instant",
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	for name, open := range stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			subscriptions := open(t).Subscriptions()
+			listID := uuid.NewString()
+
+			_, err := subscriptions.Find(ctx, "ursula@example.com", listID)
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			subscription := newSubscription("ursula@example.com")
+			require.Nil(t, subscriptions.Add(ctx, subscription))
+			assert.ErrorIs(t, subscriptions.Add(ctx, newSubscription("ursula@example.com")), ErrConflict)
+
+			found, err := subscriptions.Find(ctx, "ursula@example.com", listID)
+			require.Nil(t, err)
+			assert.Equal(t, Subscriber{ID: subscription.ID}, found)
+
+			now := time.Now().UTC()
+			result, err := subscriptions.Subscribe(ctx, newSubscription("ursula@example.com"), listID, now)
+			require.Nil(t, err)
+			assert.Equal(t, SubscribeResult{SubscriberID: subscription.ID, Outcome: Subscribed}, result)
+			status, err := subscriptions.ListStatus(ctx, subscription.ID, listID)
+			require.Nil(t, err)
+			assert.Equal(t, models.SubscriptionStatusPending, status)
+
+			require.Nil(t, subscriptions.ConfirmList(ctx, subscription.ID, listID, now))
+			found, err = subscriptions.Find(ctx, "ursula@example.com", listID)
+			require.Nil(t, err)
+			assert.Equal(t, models.SubscriptionStatusConfirmed, found.ListStatus)
+
+			// other lists are untouched
+			status, err = subscriptions.ListStatus(ctx, subscription.ID, uuid.NewString())
+			require.Nil(t, err)
+			assert.Empty(t, status)
+		})
+	}
+}
+
+// unsubscribe cancels the subscription to the list, as the preferences page
+// does.
+func unsubscribe(t *testing.T, store Store, subscriptionID, listID string) {
+	switch store := store.(type) {
+	case *Memory:
+		key := [2]string{subscriptionID, listID}
+		listSubscription := store.data.listSubscriptions[key]
+		listSubscription.Status = models.SubscriptionStatusUnsubscribed
+		store.data.listSubscriptions[key] = listSubscription
+	case *Postgres:
+		require.Nil(t, store.db.Model(&models.ListSubscription{}).
+			Where("subscription_id = ? AND list_id = ?", subscriptionID, listID).
+			Update("status", models.SubscriptionStatusUnsubscribed).Error)
+	}
+}
+
+func outboxRecipients(t *testing.T, store Store) []string {
+	var recipients []string
+	switch store := store.(type) {
+	case *Memory:
+		for _, message := range store.data.outbox {
+			recipients = append(recipients, message.Recipient)
+		}
+	case *Postgres:
+		require.Nil(t, store.db.Model(&models.OutboxMessage{}).Pluck("recipient", &recipients).Error)
+	}
+	return recipients
+}
+
+func TestSubscribeOutcomes(t *testing.T) {
+	for name, open := range stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := open(t)
+			subscriptions := store.Subscriptions()
+			listID := uuid.NewString()
+			subscribe := func() SubscribeResult {
+				result, err := subscriptions.Subscribe(ctx, newSubscription("ursula@example.com"), listID, time.Now().UTC())
+				require.Nil(t, err)
+				return result
+			}
+
+			first := subscribe()
+			assert.Equal(t, Subscribed, first.Outcome)
+			assert.Equal(t, AlreadyPending, subscribe().Outcome)
+
+			require.Nil(t, subscriptions.ConfirmList(ctx, first.SubscriberID, listID, time.Now().UTC()))
+			assert.Equal(t, AlreadyConfirmed, subscribe().Outcome)
+
+			unsubscribe(t, store, first.SubscriberID, listID)
+			resubscribed := subscribe()
+			assert.Equal(t, SubscribeResult{SubscriberID: first.SubscriberID, Outcome: Resubscribed}, resubscribed)
+			status, err := subscriptions.ListStatus(ctx, first.SubscriberID, listID)
+			require.Nil(t, err)
+			assert.Equal(t, models.SubscriptionStatusPending, status)
+		})
+	}
+}
+
+func TestTokensAndUsers(t *testing.T) {
+	for name, open := range stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := open(t)
+
+			_, err := store.Tokens().Find(ctx, "missing")
+			assert.ErrorIs(t, err, ErrNotFound)
+			token := models.SubscriptionTokens{SubscriptionToken: "token", SubscriptionID: uuid.NewString()}
+			require.Nil(t, store.Tokens().Add(ctx, token))
+			assert.ErrorIs(t, store.Tokens().Add(ctx, token), ErrConflict)
+			found, err := store.Tokens().Find(ctx, "token")
+			require.Nil(t, err)
+			assert.Equal(t, token, found)
+
+			_, err = store.Users().Find(ctx, "ursula")
+			assert.ErrorIs(t, err, ErrNotFound)
+			user := models.User{ID: uuid.NewString(), Username: "ursula", Password: "hash"}
+			require.Nil(t, store.Users().Add(ctx, user))
+			assert.ErrorIs(t, store.Users().Add(ctx, models.User{ID: uuid.NewString(), Username: "ursula", Password: "hash"}), ErrConflict)
+			foundUser, err := store.Users().Find(ctx, "ursula")
+			require.Nil(t, err)
+			assert.Equal(t, user, foundUser)
+		})
+	}
+}
+
+func TestTransactionsKeepOrDropChangesTogether(t *testing.T) {
+	for name, open := range stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := open(t)
+			failed := errors.New("failed")
+
+			err := store.Transaction(ctx, func(tx Store) error {
+				require.Nil(t, tx.Subscriptions().Add(ctx, newSubscription("dropped@example.com")))
+				require.Nil(t, tx.Outbox().Add(ctx, models.OutboxMessage{ID: uuid.NewString(), Recipient: "dropped@example.com"}))
+				return failed
+			})
+			assert.ErrorIs(t, err, failed)
+			_, err = store.Subscriptions().Find(ctx, "dropped@example.com", uuid.NewString())
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			err = store.Transaction(ctx, func(tx Store) error {
+				subscription := newSubscription("kept@example.com")
+				if err := tx.Subscriptions().Add(ctx, subscription); err != nil {
+					return err
+				}
+				if err := tx.Tokens().Add(ctx, models.SubscriptionTokens{SubscriptionToken: "kept", SubscriptionID: subscription.ID}); err != nil {
+					return err
+				}
+				return tx.Outbox().Add(ctx, models.OutboxMessage{ID: uuid.NewString(), Recipient: "kept@example.com"})
+			})
+			require.Nil(t, err)
+			_, err = store.Subscriptions().Find(ctx, "kept@example.com", uuid.NewString())
+			assert.Nil(t, err)
+			_, err = store.Tokens().Find(ctx, "kept")
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"kept@example.com"}, outboxRecipients(t, store))
+		})
+	}
+}
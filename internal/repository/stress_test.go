@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The stress tests hammer the repositories from many goroutines, run them
+// with -race: make stress.
+
+const stressWorkers = 16
+
+func TestConcurrentSubscribesAddOneSubscriber(t *testing.T) {
+	for name, open := range stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := open(t)
+			listID := uuid.NewString()
+
+			outcomes := make(chan SubscribeResult, stressWorkers)
+			var wg sync.WaitGroup
+			for range stressWorkers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					result, err := store.Subscriptions().Subscribe(ctx, newSubscription("ursula@example.com"), listID, time.Now().UTC())
+					assert.Nil(t, err)
+					outcomes <- result
+				}()
+			}
+			wg.Wait()
+			close(outcomes)
+
+			counts := map[SubscribeOutcome]int{}
+			subscriberIDs := map[string]bool{}
+			for result := range outcomes {
+				counts[result.Outcome]++
+				subscriberIDs[result.SubscriberID] = true
+			}
+			assert.Equal(t, map[SubscribeOutcome]int{Subscribed: 1, AlreadyPending: stressWorkers - 1}, counts)
+			assert.Len(t, subscriberIDs, 1)
+		})
+	}
+}
+
+func TestConcurrentSubscribesAndConfirmationsSettle(t *testing.T) {
+	for name, open := range stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := open(t)
+			listID := uuid.NewString()
+			first, err := store.Subscriptions().Subscribe(ctx, newSubscription("ursula@example.com"), listID, time.Now().UTC())
+			require.Nil(t, err)
+
+			var wg sync.WaitGroup
+			for i := range stressWorkers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if i%2 == 0 {
+						assert.Nil(t, store.Subscriptions().ConfirmList(ctx, first.SubscriberID, listID, time.Now().UTC()))
+						return
+					}
+					err := store.Transaction(ctx, func(tx Store) error {
+						result, err := tx.Subscriptions().Subscribe(ctx, newSubscription("ursula@example.com"), listID, time.Now().UTC())
+						if err != nil {
+							return err
+						}
+						assert.Equal(t, first.SubscriberID, result.SubscriberID)
+						assert.Contains(t, []SubscribeOutcome{AlreadyPending, AlreadyConfirmed}, result.Outcome)
+						return tx.Tokens().Add(ctx, models.SubscriptionTokens{SubscriptionToken: uuid.NewString(), SubscriptionID: result.SubscriberID, ListID: listID})
+					})
+					assert.Nil(t, err)
+				}()
+			}
+			wg.Wait()
+
+			// subscribing again never takes back a confirmation
+			status, err := store.Subscriptions().ListStatus(ctx, first.SubscriberID, listID)
+			require.Nil(t, err)
+			assert.Equal(t, models.SubscriptionStatusConfirmed, status)
+		})
+	}
+}
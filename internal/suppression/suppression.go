@@ -0,0 +1,100 @@
+// Package suppression keeps the global list of addresses no email is sent to.
+package suppression
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/domain"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Guard refuses every recipient on the suppression list, looking up all the
+// recipients of a batch in one query.
+func Guard(db *gorm.DB) internal.RecipientGuard {
+	return func(recipients []domain.SubscriberEmail) []error {
+		emails := make([]string, len(recipients))
+		for i, recipient := range recipients {
+			emails[i] = recipient.String()
+		}
+		suppressed, err := Suppressed(db, emails)
+		errs := make([]error, len(recipients))
+		for i, recipient := range recipients {
+			switch {
+			case err != nil:
+				errs[i] = fmt.Errorf("failed to check suppression list: %w", err)
+			case suppressed[normalize(emails[i])]:
+				errs[i] = fmt.Errorf("%w: %s", internal.ErrRecipientSuppressed, recipient)
+			}
+		}
+		return errs
+	}
+}
+
+// Suppressed returns the normalized addresses among emails that are on the
+// suppression list.
+func Suppressed(db *gorm.DB, emails []string) (map[string]bool, error) {
+	if len(emails) == 0 {
+		return map[string]bool{}, nil
+	}
+	normalized := make([]string, len(emails))
+	for i, email := range emails {
+		normalized[i] = normalize(email)
+	}
+	var found []string
+	if err := db.Model(&models.Suppression{}).Where("email IN ?", normalized).Pluck("email", &found).Error; err != nil {
+		return nil, err
+	}
+	suppressed := make(map[string]bool, len(found))
+	for _, email := range found {
+		suppressed[email] = true
+	}
+	return suppressed, nil
+}
+
+// ValidReason reports whether reason is one of models.SuppressionReasons.
+func ValidReason(reason string) bool {
+	for _, valid := range models.SuppressionReasons {
+		if reason == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// Add suppresses the address, replacing the reason and source of an
+// existing entry.
+func Add(db *gorm.DB, email, reason, source string) (models.Suppression, error) {
+	suppression := models.Suppression{
+		Email:     normalize(email),
+		Reason:    reason,
+		Source:    source,
+		CreatedAt: time.Now().UTC(),
+	}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "email"}},
+		DoUpdates: clause.AssignmentColumns([]string{"reason", "source"}),
+	}).Create(&suppression).Error
+	return suppression, err
+}
+
+// Remove lifts the suppression of the address. With a non-empty source only
+// an entry from that source is removed. It reports whether there was one.
+func Remove(db *gorm.DB, email, source string) (bool, error) {
+	query := db.Where("email = ?", normalize(email))
+	if source != "" {
+		query = query.Where("source = ?", source)
+	}
+	result := query.Delete(&models.Suppression{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// normalize makes the addresses that differ only in case or surrounding
+// space the same entry, mailboxes are not told apart by case in practice.
+func normalize(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+	_ "time/tzdata" // time zones for scheduled newsletters, even without a system tz database
 
 	"github.com/guuzaa/email-newsletter/cmd"
 	"github.com/guuzaa/email-newsletter/internal"
@@ -14,16 +16,39 @@ import (
 var logger = internal.Logger()
 
 func main() {
-	config, err := internal.Configuration("configuration")
+	// `email-newsletter config [flags]` prints the settings and where they came from
+	args := os.Args[1:]
+	dump := len(args) > 0 && args[0] == "config"
+	if dump {
+		args = args[1:]
+	}
+	loaded, err := internal.LoadConfiguration("configuration", args)
+	if dump {
+		fmt.Print(loaded.Dump())
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
 	if err != nil {
 		logger.Panic().Err(err)
 	}
+	config := loaded.Settings
 
 	srv, err := cmd.Build(&config)
 	if err != nil {
 		logger.Panic().Err(err)
 	}
 
+	// ─── Reload the settings that can change on SIGHUP ──────────────────────────
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			reload(srv, args)
+		}
+	}()
+
 	// ─── Wait for interrupt (SIGINT/SIGTERM) and shut down gracefully ───────────
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
@@ -37,3 +62,16 @@ func main() {
 	}
 	logger.Warn().Msg("Server exiting")
 }
+
+// reload loads the configuration again the way it was loaded at start, and
+// applies it to the server. Invalid settings are rejected as a whole.
+func reload(srv *cmd.Server, args []string) {
+	loaded, err := internal.LoadConfiguration("configuration", args)
+	if err != nil {
+		logger.Error().Err(err).Msg("settings not reloaded, keeping the running ones")
+		return
+	}
+	if err := srv.Reload(loaded.Settings); err != nil {
+		logger.Error().Err(err).Msg("settings not reloaded, keeping the running ones")
+	}
+}
@@ -0,0 +1,17 @@
+-- Add migration script here
+CREATE TABLE newsletter_issues (
+   newsletter_issue_id uuid NOT NULL,
+   title TEXT NOT NULL,
+   text_content TEXT NOT NULL,
+   html_content TEXT NOT NULL,
+   status TEXT NOT NULL,
+   time_zone TEXT NOT NULL DEFAULT 'UTC',
+   recipient_time_zone BOOLEAN NOT NULL DEFAULT FALSE,
+   send_at timestamptz,
+   starts_at timestamptz,
+   created_at timestamptz NOT NULL,
+   published_at timestamptz,
+   PRIMARY KEY(newsletter_issue_id)
+);
+CREATE INDEX idx_newsletter_issues_status ON newsletter_issues (status);
+CREATE INDEX idx_newsletter_issues_starts_at ON newsletter_issues (starts_at);
@@ -0,0 +1,10 @@
+-- Add migration script here
+CREATE TABLE issue_delivery_queue (
+   newsletter_issue_id uuid NOT NULL
+      REFERENCES newsletter_issues (newsletter_issue_id),
+   subscriber_email TEXT NOT NULL,
+   execute_after timestamptz NOT NULL,
+   n_retries INTEGER NOT NULL DEFAULT 0,
+   PRIMARY KEY(newsletter_issue_id, subscriber_email)
+);
+CREATE INDEX idx_issue_delivery_queue_execute_after ON issue_delivery_queue (execute_after);
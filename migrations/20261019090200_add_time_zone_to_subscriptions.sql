@@ -0,0 +1,2 @@
+-- Add migration script here
+ALTER TABLE subscriptions ADD COLUMN time_zone TEXT NULL;
@@ -0,0 +1,3 @@
+-- Add migration script here
+ALTER TABLE newsletter_issues ADD COLUMN slug TEXT NULL;
+CREATE UNIQUE INDEX idx_newsletter_issues_slug ON newsletter_issues (slug);
@@ -0,0 +1,11 @@
+-- Add migration script here
+CREATE TABLE lists (
+   list_id uuid NOT NULL,
+   slug TEXT NOT NULL,
+   name TEXT NOT NULL,
+   description TEXT NOT NULL DEFAULT '',
+   created_at timestamptz NOT NULL,
+   PRIMARY KEY(list_id)
+);
+CREATE UNIQUE INDEX idx_lists_slug ON lists (slug);
+INSERT INTO lists (list_id, slug, name, created_at) VALUES (gen_random_uuid(), 'newsletter', 'Newsletter', now());
@@ -0,0 +1,16 @@
+-- Add migration script here
+BEGIN;
+ CREATE TABLE list_subscriptions (
+    subscription_id uuid NOT NULL
+       REFERENCES subscriptions (id),
+    list_id uuid NOT NULL
+       REFERENCES lists (list_id),
+    status TEXT NOT NULL,
+    subscribed_at timestamptz NOT NULL,
+    confirmed_at timestamptz,
+    PRIMARY KEY(subscription_id, list_id)
+ );
+ CREATE INDEX idx_list_subscriptions_list_status ON list_subscriptions (list_id, status);
+ INSERT INTO list_subscriptions (subscription_id, list_id, status, subscribed_at)
+    SELECT s.id, l.list_id, s.status, s.subscribed_at FROM subscriptions s, lists l WHERE l.slug = 'newsletter';
+COMMIT;
@@ -0,0 +1,2 @@
+-- Add migration script here
+ALTER TABLE subscription_tokens ADD COLUMN list_id uuid NULL REFERENCES lists (list_id);
@@ -0,0 +1,8 @@
+-- Add migration script here
+CREATE TABLE newsletter_issue_lists (
+   newsletter_issue_id uuid NOT NULL
+      REFERENCES newsletter_issues (newsletter_issue_id),
+   list_id uuid NOT NULL
+      REFERENCES lists (list_id),
+   PRIMARY KEY(newsletter_issue_id, list_id)
+);
@@ -0,0 +1,11 @@
+-- Add migration script here
+BEGIN;
+ ALTER TABLE subscriptions ADD COLUMN preferences_token TEXT NULL;
+ -- existing subscribers get their tokens from the application as it starts, see database.Migrate
+ CREATE UNIQUE INDEX idx_subscriptions_preferences_token ON subscriptions (preferences_token);
+ ALTER TABLE subscriptions ADD COLUMN frequency TEXT NOT NULL DEFAULT 'instant';
+ ALTER TABLE subscriptions ADD COLUMN paused_until timestamptz NULL;
+ ALTER TABLE subscriptions ADD COLUMN last_digest_at timestamptz NULL;
+ ALTER TABLE subscriptions ADD COLUMN next_digest_at timestamptz NULL;
+ CREATE INDEX idx_subscriptions_next_digest_at ON subscriptions (next_digest_at);
+COMMIT;
@@ -0,0 +1,13 @@
+-- Add migration script here
+CREATE TABLE subscription_audit_log (
+   audit_entry_id uuid NOT NULL,
+   subscription_id uuid NOT NULL
+      REFERENCES subscriptions (id),
+   action TEXT NOT NULL,
+   old_value TEXT NOT NULL,
+   new_value TEXT NOT NULL,
+   source TEXT NOT NULL,
+   created_at timestamptz NOT NULL,
+   PRIMARY KEY(audit_entry_id)
+);
+CREATE INDEX idx_subscription_audit_log_subscription_id ON subscription_audit_log (subscription_id);
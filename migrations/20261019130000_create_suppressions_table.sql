@@ -0,0 +1,8 @@
+-- Add migration script here
+CREATE TABLE suppressions (
+   email TEXT NOT NULL,
+   reason TEXT NOT NULL,
+   source TEXT NOT NULL,
+   created_at timestamptz NOT NULL,
+   PRIMARY KEY(email)
+);
@@ -0,0 +1,2 @@
+-- Add migration script here
+ALTER TABLE newsletter_issues ADD COLUMN tracking BOOLEAN NOT NULL DEFAULT false;
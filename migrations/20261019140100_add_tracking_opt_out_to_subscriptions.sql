@@ -0,0 +1,2 @@
+-- Add migration script here
+ALTER TABLE subscriptions ADD COLUMN tracking_opt_out BOOLEAN NOT NULL DEFAULT false;
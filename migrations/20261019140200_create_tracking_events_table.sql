@@ -0,0 +1,14 @@
+-- Add migration script here
+BEGIN;
+ CREATE TABLE tracking_events (
+    tracking_event_id uuid NOT NULL,
+    newsletter_issue_id uuid NOT NULL REFERENCES newsletter_issues (newsletter_issue_id),
+    subscription_id uuid NOT NULL REFERENCES subscriptions (id),
+    kind TEXT NOT NULL,
+    url TEXT NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL,
+    PRIMARY KEY(tracking_event_id)
+ );
+ CREATE INDEX idx_tracking_events_issue_kind ON tracking_events (newsletter_issue_id, kind);
+ CREATE INDEX idx_tracking_events_subscription_id ON tracking_events (subscription_id);
+COMMIT;
@@ -0,0 +1,16 @@
+-- Add migration script here
+BEGIN;
+ CREATE TABLE issue_deliveries (
+    delivery_id uuid NOT NULL,
+    newsletter_issue_id uuid NOT NULL REFERENCES newsletter_issues (newsletter_issue_id),
+    subscription_id uuid NULL REFERENCES subscriptions (id),
+    email TEXT NOT NULL,
+    status TEXT NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL,
+    updated_at timestamptz NOT NULL,
+    PRIMARY KEY(delivery_id)
+ );
+ CREATE INDEX idx_issue_deliveries_issue_status ON issue_deliveries (newsletter_issue_id, status);
+ CREATE INDEX idx_issue_deliveries_email ON issue_deliveries (email);
+COMMIT;
@@ -0,0 +1,5 @@
+-- Add migration script here
+BEGIN;
+ ALTER TABLE subscription_audit_log ADD COLUMN newsletter_issue_id uuid NULL REFERENCES newsletter_issues (newsletter_issue_id);
+ CREATE INDEX idx_subscription_audit_log_newsletter_issue_id ON subscription_audit_log (newsletter_issue_id);
+COMMIT;
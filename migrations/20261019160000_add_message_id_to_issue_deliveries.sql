@@ -0,0 +1,5 @@
+-- Add migration script here
+BEGIN;
+ ALTER TABLE issue_deliveries ADD COLUMN message_id TEXT NOT NULL DEFAULT '';
+ CREATE INDEX idx_issue_deliveries_message_id ON issue_deliveries (message_id);
+COMMIT;
@@ -0,0 +1,14 @@
+-- Add migration script here
+BEGIN;
+ CREATE TABLE issue_attachments (
+    attachment_id uuid NOT NULL,
+    newsletter_issue_id uuid NOT NULL REFERENCES newsletter_issues (newsletter_issue_id),
+    position INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    content_id TEXT NOT NULL DEFAULT '',
+    content BYTEA NOT NULL,
+    PRIMARY KEY(attachment_id)
+ );
+ CREATE INDEX idx_issue_attachments_newsletter_issue_id ON issue_attachments (newsletter_issue_id);
+COMMIT;
@@ -0,0 +1,13 @@
+-- Add migration script here
+CREATE TABLE outbox (
+   outbox_message_id uuid NOT NULL,
+   recipient TEXT NOT NULL,
+   subject TEXT NOT NULL,
+   html_body TEXT NOT NULL,
+   text_body TEXT NOT NULL,
+   created_at timestamptz NOT NULL,
+   execute_after timestamptz NOT NULL,
+   n_retries INTEGER NOT NULL DEFAULT 0,
+   PRIMARY KEY(outbox_message_id)
+);
+CREATE INDEX idx_outbox_execute_after ON outbox (execute_after);
@@ -0,0 +1,2 @@
+-- Add migration script here
+ALTER TABLE newsletter_issues ADD COLUMN templated BOOLEAN NOT NULL DEFAULT false;
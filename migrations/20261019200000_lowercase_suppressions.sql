@@ -0,0 +1,7 @@
+-- Add migration script here
+BEGIN;
+-- keep one entry of the addresses that differ only in case
+DELETE FROM suppressions s USING suppressions t
+WHERE LOWER(s.email) = LOWER(t.email) AND s.email > t.email;
+UPDATE suppressions SET email = LOWER(email) WHERE email <> LOWER(email);
+COMMIT;
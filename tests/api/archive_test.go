@@ -0,0 +1,214 @@
+package api
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publishNewsletter publishes the default newsletter and returns the email the
+// confirmed subscriber received.
+func publishNewsletter(t *testing.T, app *TestApp) internal.SendEmailRequest {
+	return publishIssue(t, app, requestBody)
+}
+
+func publishIssue(t *testing.T, app *TestApp, body string) internal.SendEmailRequest {
+	emails := make(chan internal.SendEmailRequest, 1)
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	RegisterEmailResponders(app, func(payload internal.SendEmailRequest) int {
+		emails <- payload
+		return http.StatusOK
+	})
+	resp, err := app.PostNewsletters(body)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return <-emails
+}
+
+func sentIssue(t *testing.T, app *TestApp) models.NewsletterIssue {
+	var issue models.NewsletterIssue
+	require.Nil(t, app.DBPool.Where("status = ?", models.IssueStatusSent).First(&issue).Error)
+	return issue
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	return string(body)
+}
+
+func TestNewslettersContainAViewInBrowserLink(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+
+	email := publishNewsletter(t, &app)
+	issue := sentIssue(t, &app)
+	archiveURL := fmt.Sprintf("http://127.0.0.1/archive/%s", issue.Slug)
+	assert.Contains(t, ExtractURLs(email.HtmlBody), archiveURL)
+	assert.Contains(t, ExtractURLs(email.TextBody), archiveURL)
+
+	link, err := SetURLPort(archiveURL, app.Port)
+	require.Nil(t, err)
+	resp, err := http.Get(link)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	page := readBody(t, resp)
+	assert.Contains(t, page, "<h1>Test Newsletter</h1>")
+	assert.Contains(t, page, "<p>Newsletter body as HTML</p>")
+}
+
+func TestArchiveListsSentIssues(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	publishNewsletter(t, &app)
+	issue := sentIssue(t, &app)
+
+	resp, err := app.Get("/archive")
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	page := readBody(t, resp)
+	assert.Contains(t, page, fmt.Sprintf(`<a href="/archive/%s">Test Newsletter</a>`, issue.Slug))
+}
+
+func TestArchiveDoesNotShowUnsentIssues(t *testing.T) {
+	app := SpawnApp()
+	resp, err := app.PostNewsletters(scheduledRequestBody("2099-01-01T09:00"))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var issue struct {
+		Slug string `json:"slug"`
+	}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&issue))
+
+	resp, err = app.Get("/archive")
+	require.Nil(t, err)
+	assert.NotContains(t, readBody(t, resp), issue.Slug)
+
+	resp, err = app.Get("/archive/" + url.PathEscape(issue.Slug))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestArchiveShowsIssuesThatFailedForSomeRecipients(t *testing.T) {
+	app := SpawnApp()
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		confirm(t, subscribeTo(t, &app, email, models.DefaultListSlug))
+	}
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	RegisterEmailResponders(&app, func(payload internal.SendEmailRequest) int {
+		if payload.To == "b@example.com" {
+			return http.StatusUnprocessableEntity
+		}
+		return http.StatusOK
+	})
+	resp, err := app.PostNewsletters(requestBody)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	var issue models.NewsletterIssue
+	require.Nil(t, app.DBPool.First(&issue).Error)
+	assert.Equal(t, models.IssueStatusFailed, issue.Status)
+	resp, err = app.Get("/archive/" + url.PathEscape(issue.Slug))
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, readBody(t, resp), "<h1>Test Newsletter</h1>")
+}
+
+func TestArchiveShowsIssuesWhileTheyAreSent(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	received := make(chan struct{})
+	release := make(chan struct{})
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	RegisterEmailResponders(&app, func(internal.SendEmailRequest) int {
+		close(received)
+		<-release
+		return http.StatusOK
+	})
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		resp, err := app.PostNewsletters(requestBody)
+		if assert.Nil(t, err) {
+			resp.Body.Close()
+		}
+	}()
+	<-received
+
+	var issue models.NewsletterIssue
+	require.Nil(t, app.DBPool.First(&issue).Error)
+	assert.Equal(t, models.IssueStatusSending, issue.Status)
+	resp, err := app.Get("/archive/" + url.PathEscape(issue.Slug))
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, readBody(t, resp), "<h1>Test Newsletter</h1>")
+	close(release)
+	<-published
+}
+
+func TestAtomFeedContainsSentIssues(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	publishNewsletter(t, &app)
+	issue := sentIssue(t, &app)
+
+	resp, err := app.Get("/feed.atom")
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/atom+xml; charset=utf-8", resp.Header.Get("Content-Type"))
+	var feed struct {
+		Entries []struct {
+			Title   string `xml:"title"`
+			ID      string `xml:"id"`
+			Content string `xml:"content"`
+		} `xml:"entry"`
+	}
+	require.Nil(t, xml.Unmarshal([]byte(readBody(t, resp)), &feed))
+	require.Len(t, feed.Entries, 1)
+	assert.Equal(t, "Test Newsletter", feed.Entries[0].Title)
+	assert.Equal(t, fmt.Sprintf("http://127.0.0.1/archive/%s", issue.Slug), feed.Entries[0].ID)
+	assert.Equal(t, "<p>Newsletter body as HTML</p>", feed.Entries[0].Content)
+}
+
+func TestRssFeedContainsSentIssues(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	publishNewsletter(t, &app)
+	issue := sentIssue(t, &app)
+
+	resp, err := app.Get("/feed.rss")
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/rss+xml; charset=utf-8", resp.Header.Get("Content-Type"))
+	var feed struct {
+		Items []struct {
+			Title       string `xml:"title"`
+			Link        string `xml:"link"`
+			Description string `xml:"description"`
+		} `xml:"channel>item"`
+	}
+	require.Nil(t, xml.Unmarshal([]byte(readBody(t, resp)), &feed))
+	require.Len(t, feed.Items, 1)
+	assert.Equal(t, "Test Newsletter", feed.Items[0].Title)
+	assert.Equal(t, fmt.Sprintf("http://127.0.0.1/archive/%s", issue.Slug), feed.Items[0].Link)
+	assert.Equal(t, "<p>Newsletter body as HTML</p>", feed.Items[0].Description)
+}
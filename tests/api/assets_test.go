@@ -0,0 +1,153 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/guuzaa/email-newsletter/internal/assets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pngImage(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	require.Nil(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func uploadAsset(t *testing.T, app *TestApp, content []byte) assets.Asset {
+	resp, err := app.PostAsset("image.png", content)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var asset assets.Asset
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&asset))
+	return asset
+}
+
+// getAsset fetches an asset by the URL the upload returned.
+func getAsset(t *testing.T, app *TestApp, url string) *http.Response {
+	path, ok := strings.CutPrefix(url, "http://127.0.0.1")
+	require.True(t, ok, url)
+	resp, err := app.Get(path)
+	require.Nil(t, err)
+	return resp
+}
+
+func TestUploadedImagesAreServedWithTheirVariants(t *testing.T) {
+	app := SpawnApp()
+	content := pngImage(t, 800, 400)
+
+	asset := uploadAsset(t, &app, content)
+
+	assert.Equal(t, "image/png", asset.ContentType)
+	assert.Equal(t, 800, asset.Width)
+	assert.Equal(t, 400, asset.Height)
+	assert.Regexp(t, `^images/[0-9a-f]{32}\.png$`, asset.Key)
+	assert.Equal(t, "http://127.0.0.1/assets/"+asset.Key, asset.URL)
+
+	resp := getAsset(t, &app, asset.URL)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "public, max-age=31536000, immutable", resp.Header.Get("Cache-Control"))
+	served, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	assert.Equal(t, content, served)
+
+	require.Len(t, asset.Variants, 2)
+	for i, width := range []int{320, 640} {
+		variant := asset.Variants[i]
+		assert.Equal(t, width, variant.Width)
+		resp := getAsset(t, &app, variant.URL)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		img, err := png.Decode(resp.Body)
+		require.Nil(t, err)
+		assert.Equal(t, image.Pt(width, width/2), img.Bounds().Size())
+	}
+}
+
+func TestAssetsAreNotModifiedForTheirETag(t *testing.T) {
+	app := SpawnApp()
+	asset := uploadAsset(t, &app, pngImage(t, 10, 10))
+	resp := getAsset(t, &app, asset.URL)
+	resp.Body.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, app.Address+"/assets/"+asset.Key, nil)
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	resp, err := app.apiClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+}
+
+func TestUploadsThatAreNotImagesAreRejected(t *testing.T) {
+	app := SpawnApp()
+	testCases := []struct {
+		content []byte
+		status  int
+		err     string
+	}{
+		{[]byte("<script>alert(1)</script>"), http.StatusUnsupportedMediaType, "html"},
+		{[]byte("\x89PNG\r\n\x1a\ngarbage"), http.StatusUnsupportedMediaType, "broken png"},
+		{append(pngImage(t, 1, 1), make([]byte, 1<<20)...), http.StatusRequestEntityTooLarge, "too large"},
+	}
+	for _, tc := range testCases {
+		resp, err := app.PostAsset("file.png", tc.content)
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, tc.status, resp.StatusCode, tc.err)
+	}
+}
+
+func TestUnknownAssetsAreNotFound(t *testing.T) {
+	app := SpawnApp()
+	for _, path := range []string{"/assets/images/unknown.png", "/assets/../configuration/base.yaml", "/assets/"} {
+		resp, err := app.Get(path)
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+}
+
+func TestUploadsRequireAuthentication(t *testing.T) {
+	app := SpawnApp()
+	app.testUser.Password = "wrong password"
+
+	resp, err := app.PostAsset("image.png", pngImage(t, 1, 1))
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestNewslettersCanAttachUploadedAssets(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	content := pngImage(t, 16, 16)
+	asset := uploadAsset(t, &app, content)
+
+	body := attachmentsRequestBody(fmt.Sprintf(`[{"name": "logo.png", "content_id": "logo", "asset": %q}]`, asset.Key))
+	emails := publishToAll(t, &app, body, http.StatusOK)
+
+	require.Len(t, emails[subscriberEmail].Attachments, 1)
+	attachment := emails[subscriberEmail].Attachments[0]
+	assert.Equal(t, "image/png", attachment.ContentType)
+	assert.Equal(t, "cid:logo", attachment.ContentID)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(content), attachment.Content)
+}
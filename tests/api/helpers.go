@@ -1,14 +1,20 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -17,6 +23,7 @@ import (
 	"github.com/guuzaa/email-newsletter/internal/authentication"
 	"github.com/guuzaa/email-newsletter/internal/database"
 	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/jarcoal/httpmock"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -37,6 +44,21 @@ func (app *TestApp) PostSubscriptions(body string) (*http.Response, error) {
 	return app.apiClient.Do(req)
 }
 
+func (app *TestApp) PostPreferences(body string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/preferences", app.Address)
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return app.apiClient.Do(req)
+}
+
+func (app *TestApp) PostPostmarkWebhook(body string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/webhooks/postmark", app.Address)
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("postmark", "webhook-password")
+	return app.apiClient.Do(req)
+}
+
 func (app *TestApp) PostNewsletters(body string) (*http.Response, error) {
 	url := fmt.Sprintf("%s/newsletters", app.Address)
 	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
@@ -45,6 +67,113 @@ func (app *TestApp) PostNewsletters(body string) (*http.Response, error) {
 	return app.apiClient.Do(req)
 }
 
+// PostAsset uploads the content as the file of a multipart form.
+func (app *TestApp) PostAsset(filename string, content []byte) (*http.Response, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, err
+	}
+	part.Write(content)
+	form.Close()
+
+	url := fmt.Sprintf("%s/assets", app.Address)
+	req, _ := http.NewRequest(http.MethodPost, url, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.SetBasicAuth(app.testUser.Username, app.testUser.Password)
+	return app.apiClient.Do(req)
+}
+
+func (app *TestApp) PostLists(body string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/lists", app.Address)
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(app.testUser.Username, app.testUser.Password)
+	return app.apiClient.Do(req)
+}
+
+func (app *TestApp) GetIssueStats(id string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/api/issues/%s/stats", app.Address, id)
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.SetBasicAuth(app.testUser.Username, app.testUser.Password)
+	return app.apiClient.Do(req)
+}
+
+func (app *TestApp) GetSuppressions(query string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/admin/suppressions%s", app.Address, query)
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.SetBasicAuth(app.testUser.Username, app.testUser.Password)
+	return app.apiClient.Do(req)
+}
+
+func (app *TestApp) PostSuppressions(body string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/admin/suppressions", app.Address)
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(app.testUser.Username, app.testUser.Password)
+	return app.apiClient.Do(req)
+}
+
+func (app *TestApp) PostSuppressionsImport(query string, body string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/admin/suppressions/import%s", app.Address, query)
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/csv")
+	req.SetBasicAuth(app.testUser.Username, app.testUser.Password)
+	return app.apiClient.Do(req)
+}
+
+func (app *TestApp) DeleteSuppression(email string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/admin/suppressions/%s", app.Address, email)
+	req, _ := http.NewRequest(http.MethodDelete, url, nil)
+	req.SetBasicAuth(app.testUser.Username, app.testUser.Password)
+	return app.apiClient.Do(req)
+}
+
+func (app *TestApp) PatchNewsletter(id string, body string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/newsletters/%s", app.Address, id)
+	req, _ := http.NewRequest(http.MethodPatch, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(app.testUser.Username, app.testUser.Password)
+	return app.apiClient.Do(req)
+}
+
+func (app *TestApp) DeleteNewsletter(id string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/newsletters/%s", app.Address, id)
+	req, _ := http.NewRequest(http.MethodDelete, url, nil)
+	req.SetBasicAuth(app.testUser.Username, app.testUser.Password)
+	return app.apiClient.Do(req)
+}
+
+func (app *TestApp) PostNewsletterTest(body string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/newsletters/test", app.Address)
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(app.testUser.Username, app.testUser.Password)
+	return app.apiClient.Do(req)
+}
+
+func (app *TestApp) PostNewsletterPreview(body string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/newsletters/preview", app.Address)
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(app.testUser.Username, app.testUser.Password)
+	return app.apiClient.Do(req)
+}
+
+func (app *TestApp) GetNewsletterPreview(id string, subscriberEmail string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/newsletters/%s/preview?subscriber_email=%s", app.Address, id, subscriberEmail)
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.SetBasicAuth(app.testUser.Username, app.testUser.Password)
+	return app.apiClient.Do(req)
+}
+
+func (app *TestApp) Get(path string) (*http.Response, error) {
+	url := fmt.Sprintf("%s%s", app.Address, path)
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	return app.apiClient.Do(req)
+}
+
 func (app *TestApp) PostLogin(body string) (*http.Response, error) {
 	url := fmt.Sprintf("%s/login", app.Address)
 	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
@@ -77,14 +206,46 @@ func SpawnApp() TestApp {
 			SenderEmail:         "test@example.com",
 			AuthorizationToken:  "test_token",
 			TimeoutMilliseconds: 1000,
+			TransactionalStream: "outbound",
+			BroadcastStream:     "broadcast",
+		},
+		Scheduler: internal.SchedulerSettings{
+			PollIntervalMilliseconds: 50,
+		},
+		Outbox: internal.OutboxSettings{
+			PollIntervalMilliseconds: 200,
+			MaxBackoffMilliseconds:   500,
+		},
+		Delivery: internal.DeliverySettings{
+			Workers:                4,
+			MaxAttempts:            2,
+			MinBackoffMilliseconds: 10,
+			MaxBackoffMilliseconds: 50,
+		},
+		Webhooks: internal.WebhookSettings{
+			Username: "postmark",
+			Password: "webhook-password",
+			Secret:   "webhook-secret",
+		},
+		Tracking: internal.TrackingSettings{
+			Secret: "tracking-secret",
+		},
+		Assets: internal.AssetsSettings{
+			MaxUploadBytes: 1 << 20,
 		},
 	}
+	assetsDirectory, err := os.MkdirTemp("", "newsletter-assets-")
+	if err != nil {
+		panic(err)
+	}
+	settings.Assets.Directory = assetsDirectory
 
 	senderEmail, err := settings.EmailClient.Sender()
 	if err != nil {
 		panic(err)
 	}
 	emailClient := internal.NewEmailClient(settings.EmailClient.BaseURL, senderEmail, settings.EmailClient.AuthorizationToken, settings.EmailClient.Timeout())
+	emailClient.UseStreams(settings.EmailClient.TransactionalStream, settings.EmailClient.BroadcastStream)
 	jar, err := cookiejar.New(nil)
 	if err != nil {
 		panic(err)
@@ -104,21 +265,9 @@ func SpawnApp() TestApp {
 			Jar: jar,
 		},
 	}
-	db, err := gorm.Open(postgres.New(postgres.Config{
-		DSN:                  settings.PostgresSQLDSN(), // data source name, refer https://github.com/jackc/pgx
-		PreferSimpleProtocol: true,                      // disables implicit prepared statement usage. By default pgx automatically uses the extended protocol
-	}), &gorm.Config{})
-	if err != nil {
-		panic(err)
-	}
-
-	settings.Database.DatabaseName = uuid.NewString()
-	createQuery := fmt.Sprintf(`CREATE DATABASE "%s"`, settings.Database.DatabaseName)
-	if result := db.Exec(createQuery); result.Error != nil {
-		panic(result.Error)
-	}
+	createDatabase(&settings)
 	app.DBPool, _ = database.SetupDB(&settings)
-	srv, err := cmd.Run(settings.Address(), app.DBPool, &emailClient, settings.Application.BaseURL)
+	srv, err := cmd.Run(&settings, app.DBPool, &emailClient)
 	if err != nil {
 		panic(err)
 	}
@@ -139,6 +288,70 @@ func SpawnApp() TestApp {
 	return app
 }
 
+// createDatabase gives the test a database of its own: a new Postgres
+// database, or a SQLite file with TEST_DATABASE=sqlite, for the tests to run
+// without a Postgres server.
+func createDatabase(settings *internal.Settings) {
+	if os.Getenv("TEST_DATABASE") == "sqlite" {
+		dir, err := os.MkdirTemp("", "newsletter-db-")
+		if err != nil {
+			panic(err)
+		}
+		settings.Database.URL = "sqlite://" + filepath.Join(dir, "newsletter.db")
+		return
+	}
+
+	db, err := gorm.Open(postgres.New(postgres.Config{
+		DSN:                  settings.PostgresSQLDSN(), // data source name, refer https://github.com/jackc/pgx
+		PreferSimpleProtocol: true,                      // disables implicit prepared statement usage. By default pgx automatically uses the extended protocol
+	}), &gorm.Config{})
+	if err != nil {
+		panic(err)
+	}
+	settings.Database.DatabaseName = uuid.NewString()
+	createQuery := fmt.Sprintf(`CREATE DATABASE "%s"`, settings.Database.DatabaseName)
+	if result := db.Exec(createQuery); result.Error != nil {
+		panic(result.Error)
+	}
+}
+
+// RegisterEmailResponders answers the email provider's single and batch send
+// endpoints, calling respond with every email sent. The status it returns
+// answers a single send, and is the error code of the message in a batch.
+// Sent emails get the message IDs message-1, message-2 and so on.
+func RegisterEmailResponders(app *TestApp, respond func(internal.SendEmailRequest) int) {
+	var sent atomic.Uint32
+	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/email", app.EmailClient.BaseURL()),
+		func(r *http.Request) (*http.Response, error) {
+			var payload internal.SendEmailRequest
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				return nil, err
+			}
+			status := respond(payload)
+			if status != http.StatusOK {
+				return httpmock.NewStringResponse(status, ""), nil
+			}
+			return httpmock.NewJsonResponse(status, map[string]any{"To": payload.To, "ErrorCode": 0, "Message": "OK", "MessageID": fmt.Sprintf("message-%d", sent.Add(1))})
+		})
+	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/email/batch", app.EmailClient.BaseURL()),
+		func(r *http.Request) (*http.Response, error) {
+			var payloads []internal.SendEmailRequest
+			if err := json.NewDecoder(r.Body).Decode(&payloads); err != nil {
+				return nil, err
+			}
+			results := make([]map[string]any, len(payloads))
+			for i, payload := range payloads {
+				results[i] = map[string]any{"To": payload.To, "ErrorCode": 0, "Message": "OK"}
+				if status := respond(payload); status != http.StatusOK {
+					results[i]["ErrorCode"], results[i]["Message"] = status, http.StatusText(status)
+					continue
+				}
+				results[i]["MessageID"] = fmt.Sprintf("message-%d", sent.Add(1))
+			}
+			return httpmock.NewJsonResponse(http.StatusOK, results)
+		})
+}
+
 func ExtractURLs(text string) []string {
 	urlPattern := `(https?://[^\s<>"]+)`
 	re := regexp.MustCompile(urlPattern)
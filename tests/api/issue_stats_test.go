@@ -0,0 +1,178 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/guuzaa/email-newsletter/internal/newsletter"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publishToAll publishes the issue and returns the emails sent, keyed by
+// recipient.
+func publishToAll(t *testing.T, app *TestApp, body string, status int) map[string]internal.SendEmailRequest {
+	var mu sync.Mutex
+	emails := map[string]internal.SendEmailRequest{}
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	RegisterEmailResponders(app, func(payload internal.SendEmailRequest) int {
+		mu.Lock()
+		emails[payload.To] = payload
+		mu.Unlock()
+		return status
+	})
+	resp, err := app.PostNewsletters(body)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return emails
+}
+
+// deliveryOf is the delivery of the issue to the email.
+func deliveryOf(t *testing.T, app *TestApp, issueID, email string) models.IssueDelivery {
+	var delivery models.IssueDelivery
+	require.Nil(t, app.DBPool.Where("newsletter_issue_id = ? AND email = ?", issueID, email).First(&delivery).Error)
+	return delivery
+}
+
+func issueStats(t *testing.T, app *TestApp, id string) newsletter.IssueStats {
+	resp, err := app.GetIssueStats(id)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var stats newsletter.IssueStats
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&stats))
+	return stats
+}
+
+func TestIssueStatsSummarizeDeliveriesAndEvents(t *testing.T) {
+	app := SpawnApp()
+	const reader, bouncer = "reader@example.com", "bouncer@example.com"
+	for _, email := range []string{reader, bouncer} {
+		confirm(t, subscribeTo(t, &app, email, models.DefaultListSlug))
+	}
+
+	emails := publishToAll(t, &app, trackedIssue, http.StatusOK)
+	require.Len(t, emails, 2)
+	issue := sentIssue(t, &app)
+
+	// the reader opens the issue twice and clicks the link
+	for i := 0; i < 2; i++ {
+		getTracked(t, &app, openPixel.FindString(emails[reader].HtmlBody)).Body.Close()
+	}
+	getTracked(t, &app, clickLinks.FindString(emails[reader].HtmlBody)).Body.Close()
+	// the provider's events refer to the emails by message ID
+	postWebhook(t, &app, fmt.Sprintf(`{"RecordType": "Delivery", "Recipient": %q, "MessageID": %q}`, reader, deliveryOf(t, &app, issue.ID, reader).MessageID))
+	postWebhook(t, &app, hardBounceOf(bouncer, deliveryOf(t, &app, issue.ID, bouncer).MessageID))
+
+	// and unsubscribes through the issue's preferences link
+	token := preferencesOf(t, &app, reader).PreferencesToken
+	savePreferences(t, &app, url.Values{"token": {token}, "issue": {issue.ID}, "action": {"unsubscribe_all"}})
+
+	stats := issueStats(t, &app, issue.ID)
+	assert.Equal(t, issue.ID, stats.IssueID)
+	assert.Equal(t, int64(2), stats.Sent)
+	assert.Equal(t, int64(1), stats.Delivered)
+	assert.Equal(t, int64(0), stats.Failed)
+	assert.Equal(t, int64(1), stats.Bounced)
+	assert.Equal(t, int64(1), stats.UniqueOpens)
+	assert.Equal(t, int64(1), stats.UniqueClicks)
+	assert.Equal(t, []newsletter.LinkStats{{URL: "https://go.dev/blog", Clicks: 1, UniqueClicks: 1}}, stats.TopLinks)
+	assert.Equal(t, int64(1), stats.Unsubscribes)
+	require.Len(t, stats.Timeline, newsletter.StatsBuckets)
+	assert.Equal(t, int64(2), stats.Timeline[0].Opens)
+	assert.Equal(t, int64(1), stats.Timeline[0].Clicks)
+}
+
+func TestDeliveriesStoreTheProviderMessageID(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+
+	emails := publishToAll(t, &app, requestBody, http.StatusOK)
+	issue := sentIssue(t, &app)
+
+	email := emails[subscriberEmail]
+	assert.Equal(t, "broadcast", email.MessageStream)
+	assert.Equal(t, newsletter.IssueTag, email.Tag)
+	assert.Equal(t, issue.ID, email.Metadata["issue_id"])
+	var delivery models.IssueDelivery
+	require.Nil(t, app.DBPool.Where("newsletter_issue_id = ?", issue.ID).First(&delivery).Error)
+	assert.Equal(t, "message-1", delivery.MessageID)
+}
+
+func TestDeliveryWebhooksUpdateTheDeliveryOfTheirMessage(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	publishToAll(t, &app, requestBody, http.StatusOK)
+	publishToAll(t, &app, requestBody, http.StatusOK)
+	var deliveries []models.IssueDelivery
+	require.Nil(t, app.DBPool.Order("created_at").Find(&deliveries).Error)
+	require.Len(t, deliveries, 2)
+
+	// the event is about the first issue, though the second one is more recent
+	postWebhook(t, &app, fmt.Sprintf(`{"RecordType": "Delivery", "Recipient": %q, "MessageID": %q}`, subscriberEmail, deliveries[0].MessageID))
+	// and this one about an email that isn't an issue, like a confirmation
+	postWebhook(t, &app, fmt.Sprintf(`{"RecordType": "Delivery", "Recipient": %q, "MessageID": "confirmation"}`, subscriberEmail))
+
+	for i, status := range []string{models.DeliveryStatusDelivered, models.DeliveryStatusSent} {
+		var delivery models.IssueDelivery
+		require.Nil(t, app.DBPool.Where("delivery_id = ?", deliveries[i].ID).First(&delivery).Error)
+		assert.Equal(t, status, delivery.Status, i)
+	}
+}
+
+func TestIssueStatsCountFailedDeliveries(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+
+	publishToAll(t, &app, requestBody, http.StatusInternalServerError)
+
+	var issue models.NewsletterIssue
+	require.Nil(t, app.DBPool.Where("status = ?", models.IssueStatusFailed).First(&issue).Error)
+	stats := issueStats(t, &app, issue.ID)
+	assert.Equal(t, int64(0), stats.Sent)
+	assert.Equal(t, int64(1), stats.Failed)
+}
+
+func TestUnsubscribesWithoutAnIssueAreNotAttributed(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	publishNewsletter(t, &app)
+	issue := sentIssue(t, &app)
+
+	token := preferencesOf(t, &app, subscriberEmail).PreferencesToken
+	savePreferences(t, &app, url.Values{"token": {token}, "issue": {uuid.NewString()}, "action": {"unsubscribe_all"}})
+
+	assert.Equal(t, int64(0), issueStats(t, &app, issue.ID).Unsubscribes)
+}
+
+func TestIssueStatsOfUnknownIssuesAreNotFound(t *testing.T) {
+	app := SpawnApp()
+	for _, id := range []string{uuid.NewString(), "not-a-uuid"} {
+		resp, err := app.GetIssueStats(id)
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, id)
+	}
+}
+
+func TestIssueStatsRequireAuthentication(t *testing.T) {
+	app := SpawnApp()
+	for _, path := range []string{"/api/issues/%s/stats", "/admin/issues/%s/stats"} {
+		resp, err := app.Get(fmt.Sprintf(path, uuid.NewString()))
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, path)
+	}
+}
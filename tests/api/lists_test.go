@@ -0,0 +1,194 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createList(t *testing.T, app *TestApp, slug string) {
+	resp, err := app.PostLists(fmt.Sprintf(`{"slug": %q, "name": "Engineering blog"}`, slug))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+// subscribeTo subscribes the email to the list and returns the confirmation
+// link sent to it.
+func subscribeTo(t *testing.T, app *TestApp, email string, list string) string {
+	urlChan := make(chan string, 1)
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/email", app.EmailClient.BaseURL()),
+		func(r *http.Request) (*http.Response, error) {
+			var payload internal.SendEmailRequest
+			err := json.NewDecoder(r.Body).Decode(&payload)
+			assert.Nil(t, err)
+			urls := ExtractURLs(payload.HtmlBody)
+			require.Equal(t, 1, len(urls))
+			urlChan <- urls[0]
+			return httpmock.NewStringResponse(http.StatusOK, `{"status": "created"}`), nil
+		})
+
+	form := url.Values{"name": {"le guin"}, "email": {email}, "list": {list}}
+	resp, err := app.PostSubscriptions(form.Encode())
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	confirmationURL, err := SetURLPort(<-urlChan, uint16(app.Port))
+	require.Nil(t, err)
+	return confirmationURL
+}
+
+func confirm(t *testing.T, confirmationURL string) {
+	resp, err := http.Get(confirmationURL)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// publishTo publishes a newsletter to the lists and returns the recipients.
+func publishTo(t *testing.T, app *TestApp, lists ...string) []string {
+	var mu sync.Mutex
+	var recipients []string
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	RegisterEmailResponders(app, func(payload internal.SendEmailRequest) int {
+		mu.Lock()
+		recipients = append(recipients, payload.To)
+		mu.Unlock()
+		return http.StatusOK
+	})
+
+	encoded, err := json.Marshal(lists)
+	require.Nil(t, err)
+	resp, err := app.PostNewsletters(fmt.Sprintf(`{
+	"title": "Test Newsletter",
+	"content": {"text": "Plain text", "html": "<p>HTML</p>"},
+	"lists": %s
+	}`, encoded))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	mu.Lock()
+	defer mu.Unlock()
+	return recipients
+}
+
+func TestCreatedListsAreListed(t *testing.T) {
+	app := SpawnApp()
+	createList(t, &app, "engineering")
+
+	resp, err := app.Get("/lists")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var lists []map[string]string
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&lists))
+	var slugs []string
+	for _, list := range lists {
+		slugs = append(slugs, list["slug"])
+	}
+	assert.ElementsMatch(t, []string{"newsletter", "engineering"}, slugs)
+}
+
+func TestCreatingListsRequiresAuthentication(t *testing.T) {
+	app := SpawnApp()
+
+	resp, err := http.Post(fmt.Sprintf("%s/lists", app.Address), "application/json",
+		strings.NewReader(`{"slug": "engineering", "name": "Engineering blog"}`))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestCreatingAListTwiceIsAConflict(t *testing.T) {
+	app := SpawnApp()
+	createList(t, &app, "engineering")
+
+	resp, err := app.PostLists(`{"slug": "engineering", "name": "Engineering blog"}`)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestListsWithInvalidSlugsAreRejected(t *testing.T) {
+	app := SpawnApp()
+	for _, slug := range []string{"", "Engineering", "engineering blog", "-engineering"} {
+		resp, err := app.PostLists(fmt.Sprintf(`{"slug": %q, "name": "Engineering blog"}`, slug))
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, slug)
+	}
+}
+
+func TestSubscribingToAnUnknownListIsRejected(t *testing.T) {
+	app := SpawnApp()
+
+	resp, err := app.PostSubscriptions("name=le%20guin&email=ursula_le_guin%40gmail.com&list=unknown")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	msg, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "Unknown list", string(msg))
+}
+
+func TestEachListNeedsItsOwnConfirmation(t *testing.T) {
+	app := SpawnApp()
+	createList(t, &app, "engineering")
+	const email = "ursula_le_guin@gmail.com"
+
+	confirm(t, subscribeTo(t, &app, email, "newsletter"))
+	engineeringURL := subscribeTo(t, &app, email, "engineering")
+	assert.Empty(t, publishTo(t, &app, "engineering"))
+	assert.Equal(t, []string{email}, publishTo(t, &app, "newsletter"))
+
+	confirm(t, engineeringURL)
+	assert.Equal(t, []string{email}, publishTo(t, &app, "engineering"))
+}
+
+func TestNewslettersAreOnlyDeliveredToTheirLists(t *testing.T) {
+	app := SpawnApp()
+	createList(t, &app, "engineering")
+	confirm(t, subscribeTo(t, &app, "reader@example.com", "newsletter"))
+	confirm(t, subscribeTo(t, &app, "engineer@example.com", "engineering"))
+
+	assert.Equal(t, []string{"engineer@example.com"}, publishTo(t, &app, "engineering"))
+	assert.Equal(t, []string{"reader@example.com"}, publishTo(t, &app))
+	assert.ElementsMatch(t, []string{"reader@example.com", "engineer@example.com"}, publishTo(t, &app, "newsletter", "engineering"))
+}
+
+func TestSubscribersOfSeveralListsReceiveANewsletterOnce(t *testing.T) {
+	app := SpawnApp()
+	createList(t, &app, "engineering")
+	const email = "ursula_le_guin@gmail.com"
+	confirm(t, subscribeTo(t, &app, email, "newsletter"))
+	confirm(t, subscribeTo(t, &app, email, "engineering"))
+
+	assert.Equal(t, []string{email}, publishTo(t, &app, "newsletter", "engineering"))
+}
+
+func TestNewslettersToUnknownListsAreRejected(t *testing.T) {
+	app := SpawnApp()
+
+	resp, err := app.PostNewsletters(`{
+	"title": "Test Newsletter",
+	"content": {"text": "Plain text", "html": "<p>HTML</p>"},
+	"lists": ["unknown"]
+	}`)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logo is enough of a PNG image to be recognized as one.
+var logo = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func attachmentsRequestBody(attachments string) string {
+	return fmt.Sprintf(`{
+	"title": "Newsletter with attachments",
+	"content": {
+		"text": "Newsletter body as plain text",
+		"html": "<p><img src=\"cid:logo\"> Newsletter body as HTML</p>"
+	},
+	"attachments": %s
+	}`, attachments)
+}
+
+func TestNewslettersAreSentWithTheirAttachments(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	body := attachmentsRequestBody(fmt.Sprintf(`[
+		{"name": "logo.png", "content_type": "image/png", "content_id": "logo", "content": %q},
+		{"name": "agenda.txt", "content_type": "text/plain", "content": %q}
+	]`, base64.StdEncoding.EncodeToString(logo), base64.StdEncoding.EncodeToString([]byte("agenda"))))
+
+	emails := publishToAll(t, &app, body, http.StatusOK)
+
+	require.Len(t, emails, 1)
+	assert.Equal(t, []internal.AttachmentRequest{
+		{Name: "logo.png", Content: base64.StdEncoding.EncodeToString(logo), ContentType: "image/png", ContentID: "cid:logo"},
+		{Name: "agenda.txt", Content: "YWdlbmRh", ContentType: "text/plain"},
+	}, emails[subscriberEmail].Attachments)
+	var attachments []models.IssueAttachment
+	require.Nil(t, app.DBPool.Where("newsletter_issue_id = ?", sentIssue(t, &app).ID).Order("position").Find(&attachments).Error)
+	require.Len(t, attachments, 2)
+	assert.Equal(t, logo, attachments[0].Content)
+	assert.Equal(t, "agenda.txt", attachments[1].Name)
+}
+
+func TestNewslettersWithInvalidAttachmentsAreRejected(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	tooLarge := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", internal.MaxAttachmentsSize+1)))
+	testCases := []struct {
+		attachments string
+		status      int
+		err         string
+	}{
+		{`[{"name": "setup.exe", "content_type": "text/plain", "content": "TVo="}]`, http.StatusBadRequest, "forbidden extension"},
+		{`[{"name": "a.zip", "content_type": "application/zip", "content": "UEs="}]`, http.StatusBadRequest, "unknown type"},
+		{`[{"name": "a.png", "content_type": "image/png", "content": "PGh0bWw+"}]`, http.StatusBadRequest, "not a png"},
+		{`[{"name": "a.txt", "content_type": "text/plain", "content": "not base64!"}]`, http.StatusBadRequest, "invalid base64"},
+		{`[{"content_type": "text/plain", "content": "YQ=="}]`, http.StatusBadRequest, "missing name"},
+		{`[{"name": "logo.png", "asset": "images/logo.png"}]`, http.StatusBadRequest, "unknown asset"},
+		{fmt.Sprintf(`[{"name": "a.txt", "content_type": "text/plain", "content": %q}]`, tooLarge), http.StatusRequestEntityTooLarge, "too large"},
+	}
+	for _, tc := range testCases {
+		resp, err := app.PostNewsletters(attachmentsRequestBody(tc.attachments))
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, tc.status, resp.StatusCode, tc.err)
+	}
+	var count int64
+	require.Nil(t, app.DBPool.Model(&models.NewsletterIssue{}).Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const personalizedIssue = `
+	"title": "News for {{.Name}}",
+	"content": {
+		"text": "Hi {{.Name}}, here is the news",
+		"html": "<p>Hi {{.Name}}, here is the news</p>"
+	},
+	"templated": true`
+
+func TestTestEmailsAreOnlySentToTheTestAddresses(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+
+	var mu sync.Mutex
+	var payloads []internal.SendEmailRequest
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/email", app.EmailClient.BaseURL()),
+		func(r *http.Request) (*http.Response, error) {
+			var payload internal.SendEmailRequest
+			err := json.NewDecoder(r.Body).Decode(&payload)
+			assert.Nil(t, err)
+			mu.Lock()
+			payloads = append(payloads, payload)
+			mu.Unlock()
+			return httpmock.NewStringResponse(http.StatusOK, `{"status": "created"}`), nil
+		})
+
+	body := fmt.Sprintf(`{%s,
+	"subscriber_email": "ursula_le_guin@gmail.com",
+	"test_emails": ["editor@example.com", "reviewer@example.com"]
+	}`, personalizedIssue)
+	resp, err := app.PostNewsletterTest(body)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, payloads, 2)
+	assert.Equal(t, "editor@example.com", payloads[0].To)
+	assert.Equal(t, "reviewer@example.com", payloads[1].To)
+	for _, payload := range payloads {
+		assert.Equal(t, "News for le guin", payload.Subject)
+		assert.Equal(t, "<p>Hi le guin, here is the news</p>", payload.HtmlBody)
+		assert.Equal(t, "Hi le guin, here is the news", payload.TextBody)
+		assert.Equal(t, "broadcast", payload.MessageStream)
+	}
+}
+
+func TestTestEmailsReturn400ForInvalidData(t *testing.T) {
+	app := SpawnApp()
+	testCases := []struct {
+		body string
+		err  string
+	}{
+		{fmt.Sprintf(`{%s}`, personalizedIssue), "missing test emails"},
+		{fmt.Sprintf(`{%s, "test_emails": []}`, personalizedIssue), "empty test emails"},
+		{fmt.Sprintf(`{%s, "test_emails": ["not-an-email"]}`, personalizedIssue), "invalid test email"},
+		{`{"title": "{{.Name", "content": {"text": "t", "html": "h"}, "templated": true, "test_emails": ["editor@example.com"]}`, "invalid template"},
+	}
+	for _, tc := range testCases {
+		resp, err := app.PostNewsletterTest(tc.body)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, tc.err)
+	}
+}
+
+func TestPreviewReturnsTheHtmlAsTheSubscriberReceivesIt(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+
+	body := fmt.Sprintf(`{%s, "subscriber_email": "ursula_le_guin@gmail.com"}`, personalizedIssue)
+	resp, err := app.PostNewsletterPreview(body)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	html, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	assert.Equal(t, "<p>Hi le guin, here is the news</p>", string(html))
+}
+
+func TestPreviewUsesASampleSubscriberByDefault(t *testing.T) {
+	app := SpawnApp()
+
+	resp, err := app.PostNewsletterPreview(fmt.Sprintf(`{%s}`, personalizedIssue))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	html, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	assert.Equal(t, "<p>Hi Sample Subscriber, here is the news</p>", string(html))
+}
+
+func TestPreviewForAnUnknownSubscriberReturns404(t *testing.T) {
+	app := SpawnApp()
+
+	body := fmt.Sprintf(`{%s, "subscriber_email": "nobody@example.com"}`, personalizedIssue)
+	resp, err := app.PostNewsletterPreview(body)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestPreviewOfAScheduledNewsletter(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+
+	body := fmt.Sprintf(`{%s, "send_at": %q}`, personalizedIssue, time.Now().Add(time.Hour).Format(time.RFC3339))
+	resp, err := app.PostNewsletters(body)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var issue struct {
+		ID string `json:"id"`
+	}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&issue))
+
+	resp, err = app.GetNewsletterPreview(issue.ID, "ursula_le_guin@gmail.com")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	html, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(html), "<p>Hi le guin, here is the news</p>"))
+	assert.Contains(t, string(html), "View this issue in your browser")
+}
+
+func TestPreviewRequiresAuthorization(t *testing.T) {
+	app := SpawnApp()
+
+	url := fmt.Sprintf("%s/newsletters/preview", app.Address)
+	resp, err := http.Post(url, "application/json", nil)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, `Basic realm="publish"`, resp.Header.Get("WWW-Authenticate"))
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scheduledRequestBody(sendAt string) string {
+	return fmt.Sprintf(`{
+	"title": "Scheduled Newsletter",
+	"content": {
+		"text": "Newsletter body as plain text",
+		"html": "<p>Newsletter body as HTML</p>"
+	},
+	"send_at": %q
+	}`, sendAt)
+}
+
+func scheduleNewsletter(t *testing.T, app *TestApp, sendAt time.Time) string {
+	resp, err := app.PostNewsletters(scheduledRequestBody(sendAt.Format(time.RFC3339Nano)))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var issue struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&issue))
+	assert.Equal(t, models.IssueStatusScheduled, issue.Status)
+	return issue.ID
+}
+
+func countDeliveries(app *TestApp) *uint32 {
+	var reqCnt uint32
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	RegisterEmailResponders(app, func(internal.SendEmailRequest) int {
+		atomic.AddUint32(&reqCnt, 1)
+		return http.StatusOK
+	})
+	return &reqCnt
+}
+
+func issueStatus(app *TestApp, id string) string {
+	var issue models.NewsletterIssue
+	app.DBPool.Where("newsletter_issue_id = ?", id).First(&issue)
+	return issue.Status
+}
+
+func TestScheduledNewslettersAreNotDeliveredImmediately(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	reqCnt := countDeliveries(&app)
+	defer httpmock.DeactivateAndReset()
+
+	id := scheduleNewsletter(t, &app, time.Now().Add(time.Hour))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, uint32(0), atomic.LoadUint32(reqCnt))
+	assert.Equal(t, models.IssueStatusScheduled, issueStatus(&app, id))
+}
+
+func TestScheduledNewslettersAreDeliveredWhenDue(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	reqCnt := countDeliveries(&app)
+	defer httpmock.DeactivateAndReset()
+
+	id := scheduleNewsletter(t, &app, time.Now().Add(time.Second))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint32(reqCnt) == 1 && issueStatus(&app, id) == models.IssueStatusSent
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestCancelledNewslettersAreNotDelivered(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	reqCnt := countDeliveries(&app)
+	defer httpmock.DeactivateAndReset()
+
+	id := scheduleNewsletter(t, &app, time.Now().Add(time.Second))
+	resp, err := app.DeleteNewsletter(id)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, uint32(0), atomic.LoadUint32(reqCnt))
+	assert.Equal(t, models.IssueStatusCancelled, issueStatus(&app, id))
+
+	resp, err = app.DeleteNewsletter(id)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestRescheduledNewslettersAreDeliveredAtTheNewTime(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	reqCnt := countDeliveries(&app)
+	defer httpmock.DeactivateAndReset()
+
+	id := scheduleNewsletter(t, &app, time.Now().Add(24*time.Hour))
+	sendAt := time.Now().Add(time.Second).Format(time.RFC3339Nano)
+	resp, err := app.PatchNewsletter(id, fmt.Sprintf(`{"send_at": %q}`, sendAt))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint32(reqCnt) == 1 && issueStatus(&app, id) == models.IssueStatusSent
+	}, 5*time.Second, 50*time.Millisecond)
+
+	sendAt = time.Now().Add(time.Hour).Format(time.RFC3339Nano)
+	resp, err = app.PatchNewsletter(id, fmt.Sprintf(`{"send_at": %q}`, sendAt))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestSchedulingNewslettersReturns400ForInvalidSchedules(t *testing.T) {
+	app := SpawnApp()
+	testCases := []struct {
+		body string
+		err  string
+	}{
+		{scheduledRequestBody(time.Now().Add(-time.Hour).Format(time.RFC3339)), "send_at in the past"},
+		{scheduledRequestBody("next monday"), "unparseable send_at"},
+		{`{
+		"title": "Newsletter!",
+		"content": {"text": "text", "html": "<p>html</p>"},
+		"send_at": "2099-01-01T09:00",
+		"time_zone": "Mars/Olympus_Mons"
+		}`, "unknown time zone"},
+	}
+	for _, tc := range testCases {
+		resp, err := app.PostNewsletters(tc.body)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, tc.err)
+	}
+}
+
+func TestReschedulingAnUnknownNewsletterReturns404(t *testing.T) {
+	app := SpawnApp()
+	resp, err := app.PatchNewsletter("00000000-0000-0000-0000-000000000000", `{"send_at": "2099-01-01T09:00"}`)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestReschedulingOrCancellingAMalformedIDReturns404(t *testing.T) {
+	app := SpawnApp()
+	resp, err := app.PatchNewsletter("not-a-uuid", `{"send_at": "2099-01-01T09:00"}`)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = app.DeleteNewsletter("not-a-uuid")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -1,17 +1,20 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
 	"github.com/jarcoal/httpmock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -27,7 +30,7 @@ const requestBody = `{
 
 func createUnconfirmedSubscriber(t *testing.T, app *TestApp) string {
 	const body = "name=le%20guin&email=ursula_le_guin%40gmail.com"
-	urlChan := make(chan string)
+	urlChan := make(chan string, 1)
 	httpmock.ActivateNonDefault(app.EmailClient.Client())
 	defer httpmock.DeactivateAndReset()
 	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/email", app.EmailClient.BaseURL()),
@@ -69,10 +72,9 @@ func TestNewslettersAreNotDeliveredToUncomfirmedSubscribers(t *testing.T) {
 
 	httpmock.ActivateNonDefault(app.EmailClient.Client())
 	defer httpmock.DeactivateAndReset()
-	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/email", app.EmailClient.BaseURL()),
-		func(r *http.Request) (*http.Response, error) {
-			panic("should not be called")
-		})
+	RegisterEmailResponders(&app, func(internal.SendEmailRequest) int {
+		panic("should not be called")
+	})
 	resp, err := app.PostNewsletters(requestBody)
 	assert.Nil(t, err)
 	defer resp.Body.Close()
@@ -85,11 +87,10 @@ func TestNewslettersAreDeliveredToConfirmedSubscribers(t *testing.T) {
 	var reqCnt uint32
 	httpmock.ActivateNonDefault(app.EmailClient.Client())
 	defer httpmock.DeactivateAndReset()
-	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/email", app.EmailClient.BaseURL()),
-		func(r *http.Request) (*http.Response, error) {
-			atomic.AddUint32(&reqCnt, 1)
-			return httpmock.NewStringResponse(http.StatusOK, `{"status": "created"}`), nil
-		})
+	RegisterEmailResponders(&app, func(internal.SendEmailRequest) int {
+		atomic.AddUint32(&reqCnt, 1)
+		return http.StatusOK
+	})
 	resp, err := app.PostNewsletters(requestBody)
 	assert.Nil(t, err)
 	defer resp.Body.Close()
@@ -97,6 +98,103 @@ func TestNewslettersAreDeliveredToConfirmedSubscribers(t *testing.T) {
 	assert.Equal(t, uint32(1), atomic.LoadUint32(&reqCnt))
 }
 
+func TestNewslettersFailWithoutBeingStoredIfSubscribersCantBeLoaded(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	require.Nil(t, app.DBPool.Exec("ALTER TABLE list_subscriptions RENAME COLUMN status TO missing_status;").Error)
+
+	resp, err := app.PostNewsletters(requestBody)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	var issues int64
+	app.DBPool.Model(&models.NewsletterIssue{}).Count(&issues)
+	assert.Zero(t, issues)
+}
+
+func TestNewslettersWithLiteralBracesArePublishedAsWritten(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	var mu sync.Mutex
+	var sent []internal.SendEmailRequest
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	RegisterEmailResponders(&app, func(request internal.SendEmailRequest) int {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, request)
+		return http.StatusOK
+	})
+
+	resp, err := app.PostNewsletters(`{
+		"title": "Templates in Go: {{.Name}}",
+		"content": {"text": "Write {{ and }} around actions", "html": "<p>Write {{ and }} around actions</p>"}
+	}`)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, sent, 1)
+	assert.Equal(t, "Templates in Go: {{.Name}}", sent[0].Subject)
+	assert.True(t, strings.HasPrefix(sent[0].TextBody, "Write {{ and }} around actions"))
+}
+
+func TestNewslettersAreSentEvenIfTheClientGivesUp(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	var reqCnt uint32
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	RegisterEmailResponders(&app, func(internal.SendEmailRequest) int {
+		time.Sleep(300 * time.Millisecond)
+		atomic.AddUint32(&reqCnt, 1)
+		return http.StatusOK
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, app.Address+"/newsletters", strings.NewReader(requestBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(app.testUser.Username, app.testUser.Password)
+	_, err := app.apiClient.Do(req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	assert.Eventually(t, func() bool {
+		var issue models.NewsletterIssue
+		return app.DBPool.First(&issue).Error == nil && issue.Status == models.IssueStatusSent
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&reqCnt))
+}
+
+func TestNewslettersAreSentThroughTheBatchEndpoint(t *testing.T) {
+	app := SpawnApp()
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		confirm(t, subscribeTo(t, &app, email, models.DefaultListSlug))
+	}
+	var messages uint32
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/email/batch", app.EmailClient.BaseURL()),
+		func(r *http.Request) (*http.Response, error) {
+			var payloads []internal.SendEmailRequest
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&payloads))
+			atomic.AddUint32(&messages, uint32(len(payloads)))
+			results := make([]map[string]any, len(payloads))
+			for i, payload := range payloads {
+				results[i] = map[string]any{"To": payload.To, "ErrorCode": 0, "Message": "OK"}
+			}
+			return httpmock.NewJsonResponse(http.StatusOK, results)
+		})
+
+	resp, err := app.PostNewsletters(requestBody)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, uint32(3), atomic.LoadUint32(&messages))
+}
+
 func TestNewslettersReturns400ForInvalidData(t *testing.T) {
 	app := SpawnApp()
 	testCases := []struct {
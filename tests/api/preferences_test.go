@@ -0,0 +1,198 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const subscriberEmail = "ursula_le_guin@gmail.com"
+
+func preferencesOf(t *testing.T, app *TestApp, email string) models.Subscription {
+	var subscription models.Subscription
+	require.Nil(t, app.DBPool.Where("email = ?", email).First(&subscription).Error)
+	return subscription
+}
+
+func auditActions(t *testing.T, app *TestApp, subscriptionID string) []string {
+	var actions []string
+	require.Nil(t, app.DBPool.Model(&models.SubscriptionAuditEntry{}).
+		Where("subscription_id = ?", subscriptionID).Order("created_at").Pluck("action", &actions).Error)
+	return actions
+}
+
+func savePreferences(t *testing.T, app *TestApp, form url.Values) {
+	resp, err := app.PostPreferences(form.Encode())
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Location"), "/preferences?token="))
+}
+
+func TestNewslettersLinkToThePreferenceCenter(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	token := preferencesOf(t, &app, subscriberEmail).PreferencesToken
+	require.NotEmpty(t, token)
+
+	email := publishNewsletter(t, &app)
+	preferencesURL := fmt.Sprintf("http://127.0.0.1/preferences?token=%s&issue=%s", token, sentIssue(t, &app).ID)
+	assert.Contains(t, email.HtmlBody, fmt.Sprintf(`href="%s"`, html.EscapeString(preferencesURL)))
+	assert.Contains(t, ExtractURLs(email.TextBody), preferencesURL)
+
+	link, err := SetURLPort(preferencesURL, app.Port)
+	require.Nil(t, err)
+	resp, err := http.Get(link)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	page := readBody(t, resp)
+	assert.Contains(t, page, subscriberEmail)
+	assert.Contains(t, page, `value="le guin"`)
+}
+
+func TestPreferencesRejectInvalidTokens(t *testing.T) {
+	app := SpawnApp()
+	testCases := []struct {
+		token    string
+		expected int
+	}{
+		{"", http.StatusBadRequest},
+		{"short", http.StatusBadRequest},
+		{"aaaaaaaaaaaaaaaaaaaaaaaaa", http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		resp, err := app.Get("/preferences?token=" + tc.token)
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, tc.expected, resp.StatusCode, tc.token)
+
+		resp, err = app.PostPreferences(url.Values{"token": {tc.token}, "name": {"someone"}}.Encode())
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, tc.expected, resp.StatusCode, tc.token)
+	}
+}
+
+func TestSubscribersCanChangeTheirName(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	subscription := preferencesOf(t, &app, subscriberEmail)
+
+	savePreferences(t, &app, url.Values{"token": {subscription.PreferencesToken}, "name": {"ursula"}})
+
+	assert.Equal(t, "ursula", preferencesOf(t, &app, subscriberEmail).Name)
+	assert.Equal(t, []string{models.AuditActionNameChanged}, auditActions(t, &app, subscription.ID))
+}
+
+func TestInvalidPreferencesAreRejected(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	token := preferencesOf(t, &app, subscriberEmail).PreferencesToken
+
+	testCases := []url.Values{
+		{"token": {token}, "frequency": {"daily"}},
+		{"token": {token}, "pause_weeks": {"-1"}},
+		{"token": {token}, "pause_weeks": {"100"}},
+		{"token": {token}, "lists": {"unknown"}},
+		{"token": {token}, "action": {"explode"}},
+	}
+	for _, form := range testCases {
+		resp, err := app.PostPreferences(form.Encode())
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, form.Encode())
+	}
+}
+
+func TestUnsubscribingFromEverythingStopsNewsletters(t *testing.T) {
+	app := SpawnApp()
+	createList(t, &app, "engineering")
+	confirm(t, subscribeTo(t, &app, subscriberEmail, "newsletter"))
+	confirm(t, subscribeTo(t, &app, subscriberEmail, "engineering"))
+	subscription := preferencesOf(t, &app, subscriberEmail)
+
+	savePreferences(t, &app, url.Values{"token": {subscription.PreferencesToken}, "action": {"unsubscribe_all"}})
+
+	assert.Equal(t, models.SubscriptionStatusUnsubscribed, preferencesOf(t, &app, subscriberEmail).Status)
+	assert.Empty(t, publishTo(t, &app, "newsletter", "engineering"))
+	assert.Equal(t, []string{models.AuditActionUnsubscribedAll}, auditActions(t, &app, subscription.ID))
+}
+
+func TestSubscribersCanPickTheirLists(t *testing.T) {
+	app := SpawnApp()
+	createList(t, &app, "engineering")
+	confirm(t, subscribeTo(t, &app, subscriberEmail, "newsletter"))
+	subscription := preferencesOf(t, &app, subscriberEmail)
+
+	savePreferences(t, &app, url.Values{"token": {subscription.PreferencesToken}, "lists": {"", "engineering"}})
+
+	assert.Empty(t, publishTo(t, &app, "newsletter"))
+	assert.Equal(t, []string{subscriberEmail}, publishTo(t, &app, "engineering"))
+	assert.ElementsMatch(t, []string{models.AuditActionListSubscribed, models.AuditActionListUnsubscribed}, auditActions(t, &app, subscription.ID))
+}
+
+func TestPausedSubscribersReceiveNoNewsletters(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	token := preferencesOf(t, &app, subscriberEmail).PreferencesToken
+
+	savePreferences(t, &app, url.Values{"token": {token}, "pause_weeks": {"2"}})
+	pausedUntil := preferencesOf(t, &app, subscriberEmail).PausedUntil
+	require.NotNil(t, pausedUntil)
+	assert.WithinDuration(t, time.Now().Add(14*24*time.Hour), *pausedUntil, time.Minute)
+	assert.Empty(t, publishTo(t, &app))
+
+	savePreferences(t, &app, url.Values{"token": {token}, "pause_weeks": {"0"}})
+	assert.Nil(t, preferencesOf(t, &app, subscriberEmail).PausedUntil)
+	assert.Equal(t, []string{subscriberEmail}, publishTo(t, &app))
+}
+
+func TestWeeklySubscribersReceiveADigest(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	token := preferencesOf(t, &app, subscriberEmail).PreferencesToken
+
+	savePreferences(t, &app, url.Values{"token": {token}, "frequency": {"weekly"}})
+	assert.Empty(t, publishTo(t, &app))
+
+	digests := make(chan internal.SendEmailRequest, 1)
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/email", app.EmailClient.BaseURL()),
+		func(r *http.Request) (*http.Response, error) {
+			var payload internal.SendEmailRequest
+			err := json.NewDecoder(r.Body).Decode(&payload)
+			assert.Nil(t, err)
+			digests <- payload
+			return httpmock.NewStringResponse(http.StatusOK, `{"status": "created"}`), nil
+		})
+	require.Nil(t, app.DBPool.Model(&models.Subscription{}).Where("email = ?", subscriberEmail).
+		Update("next_digest_at", time.Now().Add(-time.Minute)).Error)
+
+	select {
+	case digest := <-digests:
+		assert.Equal(t, subscriberEmail, digest.To)
+		assert.Equal(t, "Your weekly digest", digest.Subject)
+		assert.Contains(t, digest.HtmlBody, "<h2>Test Newsletter</h2>")
+		assert.Contains(t, digest.TextBody, "Plain text")
+		assert.Contains(t, ExtractURLs(digest.TextBody), fmt.Sprintf("http://127.0.0.1/preferences?token=%s", token))
+	case <-time.After(2 * time.Second):
+		t.Fatal("no digest was sent")
+	}
+	// the next digest is stored once the scheduler commits, after sending
+	assert.Eventually(t, func() bool {
+		next := preferencesOf(t, &app, subscriberEmail).NextDigestAt
+		return next != nil && next.After(time.Now().Add(6*24*time.Hour))
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The stress tests send many requests at once, run them with -race: make
+// stress.
+
+const stressRequests = 12
+
+func TestConcurrentSubscribesForTheSameEmailAllSucceed(t *testing.T) {
+	const body = "name=le%20guin&email=ursula_le_guin%40gmail.com"
+	app := SpawnApp()
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	var mu sync.Mutex
+	var links []string
+	RegisterEmailResponders(&app, func(payload internal.SendEmailRequest) int {
+		mu.Lock()
+		defer mu.Unlock()
+		links = append(links, ExtractURLs(payload.TextBody)...)
+		return http.StatusOK
+	})
+
+	var wg sync.WaitGroup
+	for range stressRequests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := app.PostSubscriptions(body)
+			if assert.Nil(t, err) {
+				defer resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var subscriptions []models.Subscription
+	require.Nil(t, app.DBPool.Find(&subscriptions).Error)
+	require.Len(t, subscriptions, 1)
+	var listSubscriptions []models.ListSubscription
+	require.Nil(t, app.DBPool.Find(&listSubscriptions).Error)
+	require.Len(t, listSubscriptions, 1)
+	assert.Equal(t, models.SubscriptionStatusPending, listSubscriptions[0].Status)
+	// every pending subscribe sends a link, each of them confirms
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(links) == stressRequests
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConcurrentSubscribesAndConfirmationsLeaveTheSubscriberConfirmed(t *testing.T) {
+	const body = "name=le%20guin&email=ursula_le_guin%40gmail.com"
+	app := SpawnApp()
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	links := make(chan string, 2*stressRequests)
+	RegisterEmailResponders(&app, func(payload internal.SendEmailRequest) int {
+		for _, link := range ExtractURLs(payload.TextBody) {
+			links <- link
+		}
+		return http.StatusOK
+	})
+	subscribe := func() {
+		resp, err := app.PostSubscriptions(body)
+		if assert.Nil(t, err) {
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}
+	confirm := func(link string) {
+		confirmationURL, err := SetURLPort(link, app.Port)
+		require.Nil(t, err)
+		resp, err := app.apiClient.Get(confirmationURL)
+		if assert.Nil(t, err) {
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	for range stressRequests {
+		subscribe()
+	}
+	var wg sync.WaitGroup
+	for range stressRequests {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			subscribe()
+		}()
+		go func() {
+			defer wg.Done()
+			confirm(<-links)
+		}()
+	}
+	wg.Wait()
+
+	var subscription models.Subscription
+	require.Nil(t, app.DBPool.First(&subscription).Error)
+	assert.Equal(t, models.SubscriptionStatusConfirmed, subscription.Status)
+	var listSubscriptions []models.ListSubscription
+	require.Nil(t, app.DBPool.Find(&listSubscriptions).Error)
+	require.Len(t, listSubscriptions, 1)
+	assert.Equal(t, models.SubscriptionStatusConfirmed, listSubscriptions[0].Status)
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/guuzaa/email-newsletter/internal"
 	"github.com/guuzaa/email-newsletter/internal/database/models"
@@ -30,6 +32,7 @@ func TestSubscribeReturnsA200forValidFormData(t *testing.T) {
 			assert.NotEmpty(t, payload.From)
 			assert.NotEmpty(t, payload.To)
 			assert.Equal(t, "Welcome!", payload.Subject)
+			assert.Equal(t, "outbound", payload.MessageStream)
 			urls := ExtractURLs(payload.HtmlBody)
 			require.Equal(t, 1, len(urls))
 			assert.Contains(t, urls[0], "127.0.0.1")
@@ -166,7 +169,7 @@ func TestSubscribeReturnsA200WhenFieldsArePresentButEmpty(t *testing.T) {
 func TestSubscribeFailsIfThereIsAFatalDatabaseSubscriptionTokensDontExistError(t *testing.T) {
 	const body = "name=le%20guin&email=ursula_le_guin%40gmail.com"
 	app := SpawnApp()
-	d := app.DBPool.Exec("ALTER TABLE subscription_tokens DROP COLUMN subscription_token;")
+	d := app.DBPool.Exec("ALTER TABLE subscription_tokens RENAME COLUMN subscription_token TO missing_subscription_token;")
 	require.Nil(t, d.Error)
 
 	resp, err := app.PostSubscriptions(body)
@@ -178,7 +181,7 @@ func TestSubscribeFailsIfThereIsAFatalDatabaseSubscriptionTokensDontExistError(t
 func TestSubscribeFailsIfThereIsAFatalDatabaseSubscriptionsEmailDontExistError(t *testing.T) {
 	const body = "name=le%20guin&email=ursula_le_guin%40gmail.com"
 	app := SpawnApp()
-	d := app.DBPool.Exec("ALTER TABLE subscriptions DROP COLUMN email;")
+	d := app.DBPool.Exec("ALTER TABLE subscriptions RENAME COLUMN email TO missing_email;")
 	require.Nil(t, d.Error)
 
 	resp, err := app.PostSubscriptions(body)
@@ -186,3 +189,62 @@ func TestSubscribeFailsIfThereIsAFatalDatabaseSubscriptionsEmailDontExistError(t
 	defer resp.Body.Close()
 	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
 }
+
+func TestSubscribeSucceedsAndRetriesTheConfirmationEmailWhenTheProviderFails(t *testing.T) {
+	const body = "name=le%20guin&email=ursula_le_guin%40gmail.com"
+	app := SpawnApp()
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	var attempts atomic.Int32
+	sent := make(chan string, 1)
+	RegisterEmailResponders(&app, func(payload internal.SendEmailRequest) int {
+		if attempts.Add(1) == 1 {
+			return http.StatusTooManyRequests
+		}
+		sent <- payload.To
+		return http.StatusOK
+	})
+
+	resp, err := app.PostSubscriptions(body)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the outbox sends it once the provider takes it
+	select {
+	case to := <-sent:
+		assert.Equal(t, "ursula_le_guin@gmail.com", to)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the confirmation email was never sent")
+	}
+	assert.Eventually(t, func() bool {
+		var pending int64
+		app.DBPool.Model(&models.OutboxMessage{}).Count(&pending)
+		return pending == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSubscribeFailsWithoutSendingIfTheSubscriptionCantBeStored(t *testing.T) {
+	const body = "name=le%20guin&email=ursula_le_guin%40gmail.com"
+	app := SpawnApp()
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	var sent atomic.Int32
+	RegisterEmailResponders(&app, func(internal.SendEmailRequest) int {
+		sent.Add(1)
+		return http.StatusOK
+	})
+	d := app.DBPool.Exec("ALTER TABLE outbox RENAME COLUMN recipient TO missing_recipient;")
+	require.Nil(t, d.Error)
+
+	resp, err := app.PostSubscriptions(body)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	// the subscription was rolled back along with its email
+	var subscriptions int64
+	app.DBPool.Model(&models.Subscription{}).Count(&subscriptions)
+	assert.Zero(t, subscriptions)
+	assert.Zero(t, sent.Load())
+}
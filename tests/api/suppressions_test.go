@@ -0,0 +1,233 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type suppressionResponse struct {
+	Email  string `json:"email"`
+	Reason string `json:"reason"`
+	Source string `json:"source"`
+}
+
+func suppress(t *testing.T, app *TestApp, email string, reason string) {
+	resp, err := app.PostSuppressions(fmt.Sprintf(`{"email": %q, "reason": %q}`, email, reason))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func listSuppressions(t *testing.T, app *TestApp, query string) []suppressionResponse {
+	resp, err := app.GetSuppressions(query)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var suppressions []suppressionResponse
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&suppressions))
+	return suppressions
+}
+
+func TestConfirmationEmailsAreNotSentToSuppressedAddresses(t *testing.T) {
+	app := SpawnApp()
+	suppress(t, &app, subscriberEmail, models.SuppressionReasonManual)
+
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/email", app.EmailClient.BaseURL()),
+		func(r *http.Request) (*http.Response, error) {
+			panic("should not be called")
+		})
+	resp, err := app.PostSubscriptions("name=le%20guin&email=ursula_le_guin%40gmail.com")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestNewslettersAreNotDeliveredToSuppressedSubscribers(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	require.Equal(t, []string{subscriberEmail}, publishTo(t, &app))
+
+	suppress(t, &app, subscriberEmail, models.SuppressionReasonManual)
+	assert.Empty(t, publishTo(t, &app))
+}
+
+func TestNewslettersAreNotDeliveredToSuppressedSubscribersWhateverTheCase(t *testing.T) {
+	app := SpawnApp()
+	confirm(t, subscribeTo(t, &app, "Ursula@Example.com", models.DefaultListSlug))
+	require.Equal(t, []string{"Ursula@Example.com"}, publishTo(t, &app))
+
+	suppress(t, &app, "ursula@example.com", models.SuppressionReasonManual)
+	assert.Empty(t, publishTo(t, &app))
+}
+
+func TestTestEmailsSkipSuppressedAddresses(t *testing.T) {
+	app := SpawnApp()
+	suppress(t, &app, "editor@example.com", models.SuppressionReasonManual)
+
+	var mu sync.Mutex
+	var recipients []string
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/email", app.EmailClient.BaseURL()),
+		func(r *http.Request) (*http.Response, error) {
+			var payload internal.SendEmailRequest
+			err := json.NewDecoder(r.Body).Decode(&payload)
+			assert.Nil(t, err)
+			mu.Lock()
+			recipients = append(recipients, payload.To)
+			mu.Unlock()
+			return httpmock.NewStringResponse(http.StatusOK, `{"status": "created"}`), nil
+		})
+
+	body := fmt.Sprintf(`{%s, "test_emails": ["editor@example.com", "reviewer@example.com"]}`, personalizedIssue)
+	resp, err := app.PostNewsletterTest(body)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"reviewer@example.com"}, recipients)
+}
+
+func TestSuppressionsCanBeAddedListedAndRemoved(t *testing.T) {
+	app := SpawnApp()
+	suppress(t, &app, "first@example.com", models.SuppressionReasonManual)
+	suppress(t, &app, "second@example.com", models.SuppressionReasonHardBounce)
+
+	suppressions := listSuppressions(t, &app, "")
+	require.Len(t, suppressions, 2)
+	for _, s := range suppressions {
+		assert.Equal(t, models.SuppressionSourceAdmin, s.Source)
+	}
+	bounced := listSuppressions(t, &app, "?reason=hard_bounce")
+	require.Len(t, bounced, 1)
+	assert.Equal(t, "second@example.com", bounced[0].Email)
+
+	resp, err := app.DeleteSuppression("first@example.com")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, listSuppressions(t, &app, ""), 1)
+
+	resp, err = app.DeleteSuppression("first@example.com")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestSuppressionsIgnoreTheCaseOfAddresses(t *testing.T) {
+	app := SpawnApp()
+	suppress(t, &app, "Editor@Example.com", models.SuppressionReasonManual)
+	suppressions := listSuppressions(t, &app, "")
+	require.Len(t, suppressions, 1)
+	assert.Equal(t, "editor@example.com", suppressions[0].Email)
+
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/email", app.EmailClient.BaseURL()),
+		func(r *http.Request) (*http.Response, error) {
+			panic("should not be called")
+		})
+	body := fmt.Sprintf(`{%s, "test_emails": ["EDITOR@example.com"]}`, personalizedIssue)
+	resp, err := app.PostNewsletterTest(body)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = app.DeleteSuppression("editor@EXAMPLE.com")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, listSuppressions(t, &app, ""))
+}
+
+func TestInvalidSuppressionsAreRejected(t *testing.T) {
+	app := SpawnApp()
+	testCases := []struct {
+		body string
+		msg  string
+	}{
+		{`{"email": "not-an-email"}`, "invalid email"},
+		{`{"email": "someone@example.com", "reason": "bored"}`, "unknown reason"},
+		{`{"reason": "manual"}`, "missing email"},
+	}
+	for _, tc := range testCases {
+		resp, err := app.PostSuppressions(tc.body)
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "The API did not fail with 400 Bad Request when the payload was %s.", tc.msg)
+	}
+}
+
+func TestSuppressionsCanBeImported(t *testing.T) {
+	app := SpawnApp()
+	csv := strings.Join([]string{
+		"email,reason",
+		"first@example.com",
+		"second@example.com,spam_complaint",
+		"not-an-email",
+		"third@example.com,bored",
+		"",
+	}, "\n")
+
+	resp, err := app.PostSuppressionsImport("?reason=hard_bounce", csv)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var result struct {
+		Imported int `json:"imported"`
+		Skipped  []struct {
+			Line  int    `json:"line"`
+			Email string `json:"email"`
+		} `json:"skipped"`
+	}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, 2, result.Imported)
+	require.Len(t, result.Skipped, 2)
+	assert.Equal(t, 4, result.Skipped[0].Line)
+	assert.Equal(t, "third@example.com", result.Skipped[1].Email)
+
+	first, ok := suppressionOf(&app, "first@example.com")
+	require.True(t, ok)
+	assert.Equal(t, models.SuppressionReasonHardBounce, first.Reason)
+	assert.Equal(t, models.SuppressionSourceImport, first.Source)
+	second, ok := suppressionOf(&app, "second@example.com")
+	require.True(t, ok)
+	assert.Equal(t, models.SuppressionReasonSpamComplaint, second.Reason)
+}
+
+func TestManagingSuppressionsRequiresAuthentication(t *testing.T) {
+	app := SpawnApp()
+	requests := []*http.Request{}
+	for _, r := range []struct{ method, path, body string }{
+		{http.MethodGet, "/admin/suppressions", ""},
+		{http.MethodPost, "/admin/suppressions", `{"email": "someone@example.com"}`},
+		{http.MethodPost, "/admin/suppressions/import", "someone@example.com"},
+		{http.MethodDelete, "/admin/suppressions/someone@example.com", ""},
+	} {
+		req, err := http.NewRequest(r.method, app.Address+r.path, strings.NewReader(r.body))
+		require.Nil(t, err)
+		requests = append(requests, req)
+	}
+	for _, req := range requests {
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "%s %s", req.Method, req.URL.Path)
+	}
+	_, ok := suppressionOf(&app, "someone@example.com")
+	assert.False(t, ok)
+}
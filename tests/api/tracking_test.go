@@ -0,0 +1,171 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/guuzaa/email-newsletter/internal"
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const trackedIssue = `{
+	"title": "Tracked Newsletter",
+	"content": {
+		"text": "Read https://go.dev/blog to learn more.",
+		"html": "<p>Read <a href=\"https://go.dev/blog\">the blog</a></p>"
+	},
+	"tracking": true
+	}`
+
+var (
+	openPixel  = regexp.MustCompile(`http://127\.0\.0\.1/t/o/[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.gif`)
+	clickLinks = regexp.MustCompile(`http://127\.0\.0\.1/t/c/[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+`)
+)
+
+func trackingEvents(t *testing.T, app *TestApp, kind string) []models.TrackingEvent {
+	var events []models.TrackingEvent
+	require.Nil(t, app.DBPool.Where("kind = ?", kind).Order("created_at").Find(&events).Error)
+	return events
+}
+
+func getTracked(t *testing.T, app *TestApp, trackingURL string) *http.Response {
+	localURL, err := SetURLPort(trackingURL, app.Port)
+	require.Nil(t, err)
+	resp, err := app.apiClient.Get(localURL)
+	require.Nil(t, err)
+	return resp
+}
+
+func TestOpensOfTrackedIssuesAreRecorded(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	email := publishIssue(t, &app, trackedIssue)
+
+	pixel := openPixel.FindString(email.HtmlBody)
+	require.NotEmpty(t, pixel)
+	resp := getTracked(t, &app, pixel)
+	body := readBody(t, resp)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/gif", resp.Header.Get("Content-Type"))
+	assert.Contains(t, resp.Header.Get("Cache-Control"), "no-store")
+	assert.True(t, strings.HasPrefix(body, "GIF89a"))
+
+	events := trackingEvents(t, &app, models.TrackingEventOpen)
+	require.Len(t, events, 1)
+	assert.Equal(t, sentIssue(t, &app).ID, events[0].NewsletterIssueID)
+	assert.Equal(t, preferencesOf(t, &app, subscriberEmail).ID, events[0].SubscriptionID)
+}
+
+func TestOpensWhileTheIssueIsBeingSentAreRecorded(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	httpmock.ActivateNonDefault(app.EmailClient.Client())
+	defer httpmock.DeactivateAndReset()
+	RegisterEmailResponders(&app, func(payload internal.SendEmailRequest) int {
+		// the email is opened before the request publishing it is done
+		resp := getTracked(t, &app, openPixel.FindString(payload.HtmlBody))
+		resp.Body.Close()
+		return http.StatusOK
+	})
+	resp, err := app.PostNewsletters(trackedIssue)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	events := trackingEvents(t, &app, models.TrackingEventOpen)
+	require.Len(t, events, 1)
+	assert.Equal(t, sentIssue(t, &app).ID, events[0].NewsletterIssueID)
+}
+
+func TestClicksOfTrackedIssuesAreRecordedAndRedirected(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	email := publishIssue(t, &app, trackedIssue)
+
+	htmlLinks := clickLinks.FindAllString(email.HtmlBody, -1)
+	textLinks := clickLinks.FindAllString(email.TextBody, -1)
+	// the issue's link and the "view in browser" link
+	require.Len(t, htmlLinks, 2)
+	require.Len(t, textLinks, 2)
+	assert.True(t, strings.HasPrefix(email.TextBody, "Read http://127.0.0.1/t/c/"))
+	assert.Contains(t, email.TextBody, " to learn more.")
+	assert.NotContains(t, email.TextBody, "/t/o/")
+	// the preferences link is never wrapped
+	assert.Contains(t, email.HtmlBody, `href="http://127.0.0.1/preferences?token=`)
+
+	for _, link := range []string{htmlLinks[0], textLinks[0]} {
+		resp := getTracked(t, &app, link)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.Equal(t, "https://go.dev/blog", resp.Header.Get("Location"))
+	}
+	events := trackingEvents(t, &app, models.TrackingEventClick)
+	require.Len(t, events, 2)
+	assert.Equal(t, "https://go.dev/blog", events[0].URL)
+}
+
+func TestIssuesAreNotTrackedUnlessTurnedOn(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	email := publishIssue(t, &app, strings.Replace(trackedIssue, `"tracking": true`, `"tracking": false`, 1))
+
+	assert.NotContains(t, email.HtmlBody, "/t/")
+	assert.Equal(t, "Read https://go.dev/blog to learn more.", strings.SplitN(email.TextBody, "\n", 2)[0])
+}
+
+func TestSubscribersCanOptOutOfTracking(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	subscription := preferencesOf(t, &app, subscriberEmail)
+	savePreferences(t, &app, url.Values{"token": {subscription.PreferencesToken}, "tracking": {"opt_out"}})
+	assert.True(t, preferencesOf(t, &app, subscriberEmail).TrackingOptOut)
+	assert.Equal(t, []string{models.AuditActionTrackingChanged}, auditActions(t, &app, subscription.ID))
+
+	email := publishIssue(t, &app, trackedIssue)
+	assert.NotContains(t, email.HtmlBody, "/t/")
+	assert.NotContains(t, email.TextBody, "/t/")
+}
+
+func TestOptingOutStopsRecordingEventsOfEarlierIssues(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	email := publishIssue(t, &app, trackedIssue)
+	subscription := preferencesOf(t, &app, subscriberEmail)
+	savePreferences(t, &app, url.Values{"token": {subscription.PreferencesToken}, "tracking": {"opt_out"}})
+
+	resp := getTracked(t, &app, openPixel.FindString(email.HtmlBody))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = getTracked(t, &app, clickLinks.FindString(email.HtmlBody))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Empty(t, trackingEvents(t, &app, models.TrackingEventOpen))
+	assert.Empty(t, trackingEvents(t, &app, models.TrackingEventClick))
+}
+
+func TestTamperedTrackingLinksAreRejected(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+	email := publishIssue(t, &app, trackedIssue)
+	link := clickLinks.FindString(email.HtmlBody)
+	pixel := openPixel.FindString(email.HtmlBody)
+
+	for _, tampered := range []string{
+		link[:len(link)-2] + "xx",
+		strings.Replace(pixel, "/t/o/", "/t/c/", 1),
+		strings.Replace(link, "/t/c/", "/t/o/", 1) + ".gif",
+		"http://127.0.0.1/t/c/garbage",
+	} {
+		resp := getTracked(t, &app, tampered)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, tampered)
+	}
+	assert.Empty(t, trackingEvents(t, &app, models.TrackingEventClick))
+	assert.Empty(t, trackingEvents(t, &app, models.TrackingEventOpen))
+}
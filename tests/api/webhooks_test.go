@@ -0,0 +1,180 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/guuzaa/email-newsletter/internal/database/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func hardBounce(email string) string {
+	return hardBounceOf(email, "883953f4-6105-42a2-a16a-77a8eac79483")
+}
+
+// hardBounceOf is the hard bounce of the message with the ID.
+func hardBounceOf(email, messageID string) string {
+	return fmt.Sprintf(`{
+	"RecordType": "Bounce",
+	"ID": 4323372036854775807,
+	"Type": "HardBounce",
+	"TypeCode": 1,
+	"Name": "Hard bounce",
+	"MessageID": %q,
+	"Email": %q,
+	"From": "test@example.com",
+	"BouncedAt": "2026-10-19T16:33:54.9070259Z",
+	"Inactive": true,
+	"CanActivate": true,
+	"MessageStream": "outbound"
+	}`, messageID, email)
+}
+
+func subscriptionChange(email string, suppress bool, reason string) string {
+	return fmt.Sprintf(`{
+	"RecordType": "SubscriptionChange",
+	"MessageID": "883953f4-6105-42a2-a16a-77a8eac79483",
+	"ChangedAt": "2026-10-19T10:53:34.416071Z",
+	"Recipient": %q,
+	"Origin": "Recipient",
+	"SuppressSending": %t,
+	"SuppressionReason": %q,
+	"MessageStream": "outbound"
+	}`, email, suppress, reason)
+}
+
+func postWebhook(t *testing.T, app *TestApp, body string) {
+	resp, err := app.PostPostmarkWebhook(body)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func suppressionOf(app *TestApp, email string) (models.Suppression, bool) {
+	var suppression models.Suppression
+	err := app.DBPool.Where("email = ?", email).First(&suppression).Error
+	return suppression, err == nil
+}
+
+func TestWebhooksRequireCredentials(t *testing.T) {
+	app := SpawnApp()
+	url := fmt.Sprintf("%s/webhooks/postmark", app.Address)
+
+	resp, err := http.Post(url, "application/json", strings.NewReader(hardBounce(subscriberEmail)))
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(hardBounce(subscriberEmail)))
+	req.SetBasicAuth("postmark", "wrong-password")
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, _ = http.NewRequest(http.MethodPost, url, strings.NewReader(hardBounce(subscriberEmail)))
+	req.Header.Set("X-Webhook-Secret", "webhook-secret")
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestHardBouncesSuppressTheSubscriber(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+
+	postWebhook(t, &app, hardBounce(subscriberEmail))
+
+	assert.Equal(t, models.SubscriptionStatusBounced, preferencesOf(t, &app, subscriberEmail).Status)
+	suppression, ok := suppressionOf(&app, subscriberEmail)
+	require.True(t, ok)
+	assert.Equal(t, models.SuppressionReasonHardBounce, suppression.Reason)
+	assert.Equal(t, models.SuppressionSourcePostmark, suppression.Source)
+	assert.Empty(t, publishTo(t, &app))
+}
+
+func TestSoftBouncesAreIgnored(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+
+	postWebhook(t, &app, fmt.Sprintf(`{"RecordType": "Bounce", "Type": "SoftBounce", "Email": %q, "Inactive": false}`, subscriberEmail))
+
+	assert.Equal(t, models.SubscriptionStatusConfirmed, preferencesOf(t, &app, subscriberEmail).Status)
+	_, ok := suppressionOf(&app, subscriberEmail)
+	assert.False(t, ok)
+	assert.Equal(t, []string{subscriberEmail}, publishTo(t, &app))
+}
+
+func TestSpamComplaintsSuppressTheSubscriber(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+
+	postWebhook(t, &app, fmt.Sprintf(`{"RecordType": "SpamComplaint", "Type": "SpamComplaint", "Email": %q}`, subscriberEmail))
+
+	subscription := preferencesOf(t, &app, subscriberEmail)
+	assert.Equal(t, models.SubscriptionStatusComplained, subscription.Status)
+	suppression, ok := suppressionOf(&app, subscriberEmail)
+	require.True(t, ok)
+	assert.Equal(t, models.SuppressionReasonSpamComplaint, suppression.Reason)
+	assert.Equal(t, []string{models.AuditActionComplained}, auditActions(t, &app, subscription.ID))
+	assert.Empty(t, publishTo(t, &app))
+}
+
+func TestSubscriptionChangesSuppressAndReactivate(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+
+	postWebhook(t, &app, subscriptionChange(subscriberEmail, true, "HardBounce"))
+	assert.Equal(t, models.SubscriptionStatusBounced, preferencesOf(t, &app, subscriberEmail).Status)
+	assert.Empty(t, publishTo(t, &app))
+
+	postWebhook(t, &app, subscriptionChange(subscriberEmail, false, ""))
+	assert.Equal(t, models.SubscriptionStatusConfirmed, preferencesOf(t, &app, subscriberEmail).Status)
+	_, ok := suppressionOf(&app, subscriberEmail)
+	assert.False(t, ok)
+	assert.Equal(t, []string{subscriberEmail}, publishTo(t, &app))
+}
+
+func TestSubscriptionChangesMatchSubscribersRegardlessOfCase(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+
+	postWebhook(t, &app, subscriptionChange(strings.ToUpper(subscriberEmail), true, "HardBounce"))
+
+	assert.Equal(t, models.SubscriptionStatusBounced, preferencesOf(t, &app, subscriberEmail).Status)
+}
+
+func TestManualSuppressionsUnsubscribe(t *testing.T) {
+	app := SpawnApp()
+	createConfirmedSubscriber(t, &app)
+
+	postWebhook(t, &app, subscriptionChange(subscriberEmail, true, "ManualSuppression"))
+
+	assert.Equal(t, models.SubscriptionStatusUnsubscribed, preferencesOf(t, &app, subscriberEmail).Status)
+	suppression, ok := suppressionOf(&app, subscriberEmail)
+	require.True(t, ok)
+	assert.Equal(t, models.SuppressionReasonUnsubscribed, suppression.Reason)
+}
+
+func TestWebhooksForUnknownAddressesAreSuppressed(t *testing.T) {
+	app := SpawnApp()
+
+	postWebhook(t, &app, hardBounce("stranger@example.com"))
+
+	_, ok := suppressionOf(&app, "stranger@example.com")
+	assert.True(t, ok)
+}
+
+func TestMalformedWebhooksAreRejected(t *testing.T) {
+	app := SpawnApp()
+	for _, body := range []string{`not json`, `{"RecordType": "Bounce", "Type": "HardBounce"}`} {
+		resp, err := app.PostPostmarkWebhook(body)
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+}
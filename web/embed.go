@@ -9,4 +9,14 @@ var (
 	LoginHTML []byte
 	//go:embed index.html
 	HomeHTML []byte
+	//go:embed admin/newsletters.html
+	AdminNewslettersHTML []byte
+	//go:embed admin/issue_stats.html
+	AdminIssueStatsHTML []byte
+	//go:embed archive/index.html
+	ArchiveIndexHTML string
+	//go:embed archive/issue.html
+	ArchiveIssueHTML string
+	//go:embed preferences.html
+	PreferencesHTML string
 )